@@ -0,0 +1,51 @@
+package http
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+Load the token administrators send from the file at path, which
+enables the admin endpoints. The token must be at least 32 bytes.
+*/
+func WithAdminToken(path string) Option {
+	return func(us *UserService) error {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		token := bytes.TrimSpace(raw)
+		if len(token) < 32 {
+			return fmt.Errorf("%s: admin token must be at least 32 bytes", path)
+		}
+
+		us.admin = token
+
+		return nil
+	}
+}
+
+/* Wrap a handler so it can only be called with the admin token. */
+func (us *UserService) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), us.admin) != 1 {
+			log.Printf("[%s] %s %s: no valid admin token", r.RemoteAddr, r.Method, r.URL.Path)
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+
+			us.fail(w, r, http.StatusUnauthorized, "an admin token is required")
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,220 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+A hash for a password nobody knows, checked when no user matches so
+that a failed authentication takes as long whether or not the user
+exists.
+*/
+var unknownUserHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("unknown user")
+	if err != nil {
+		log.Fatalf("unable to hash password for unknown users %q", err.Error())
+	}
+
+	return hash
+})
+
+/*
+The body returned when a user is authenticated. When sessions are
+enabled it includes the tokens of the new session.
+*/
+type authenticated struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	*tokenPair
+}
+
+/*
+Find the user logging in with the email or nickname in data and check
+their password. Returns nil if nobody matches, along with how long to
+wait before trying again if the failure locked them out.
+
+The password of a locked account isn't checked at all, and each
+failure against an account counts towards locking it. If the user is
+enrolled in TOTP the second factor in data must match too, and
+errSecondFactorRequired is returned when there isn't one.
+*/
+func (us *UserService) verifyCredentials(data map[string]string) (*user, time.Duration, error) {
+	filters := []*filter{}
+	for _, key := range []string{"email", "nickname"} {
+		value, ok := data[key]
+		if ok {
+			filters = append(filters, belongsTo(key, value))
+		}
+	}
+
+	users, err := us.store.List(filters)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := us.clock()
+	password := data["password"]
+
+	var retryAfter time.Duration
+	unlocked := []*user{}
+
+	for _, user := range users {
+		wait := user.Auth.retryAfter(now)
+		if wait > 0 {
+			retryAfter = max(retryAfter, wait)
+			continue
+		}
+
+		unlocked = append(unlocked, user)
+
+		ok, err := us.checkPassword(user, password)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ok && user.Auth.TOTP.enrolled() {
+			err = us.useSecondFactor(user.ID, data, now)
+			if errors.Is(err, errInvalidSecondFactor) {
+				ok = false
+			} else if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if ok {
+			if user.Auth.FailedAttempts > 0 {
+				_, err = us.unlockAccount(user.ID)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+
+			return user, 0, nil
+		}
+	}
+
+	if len(users) == 0 {
+		verifyPassword(unknownUserHash(), password)
+	}
+
+	for _, user := range unlocked {
+		wait, err := us.failAccount(user.ID, now)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		retryAfter = max(retryAfter, wait)
+	}
+
+	return nil, retryAfter, nil
+}
+
+func (us *UserService) authenticate(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/authenticate: attempting to authenticate", sender)
+
+	data := map[string]string{}
+
+	err := decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil {
+		log.Printf("[%s] POST /users/authenticate: unable to decode JSON: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, "the request body is not a JSON object of strings")
+		return
+	}
+
+	_, email := data["email"]
+	_, nickname := data["nickname"]
+	_, password := data["password"]
+
+	if email == nickname || !password {
+		log.Printf("[%s] POST /users/authenticate: expected password and one of email or nickname", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected password and one of email or nickname")
+		return
+	}
+
+	address := remoteAddress(r)
+
+	retryAfter := us.throttle.retryAfter(address, us.clock())
+	if retryAfter > 0 {
+		log.Printf("[%s] POST /users/authenticate: too many failures from %q", sender, address)
+
+		us.tooManyRequests(w, r, retryAfter)
+		return
+	}
+
+	user, retryAfter, err := us.verifyCredentials(data)
+	if errors.Is(err, errSecondFactorRequired) {
+		log.Printf("[%s] POST /users/authenticate: password matched but a second factor is required", sender)
+
+		us.hc.increment("authenticate.second_factor_required")
+		us.problem(w, r, &problem{
+			Type:   problemTypes + "second-factor-required",
+			Title:  "Second factor required",
+			Status: http.StatusUnauthorized,
+			Detail: "the password matched, send it again with totp or recovery_code",
+		})
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/authenticate: unable to verify credentials: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to verify credentials")
+		return
+	}
+
+	if user == nil {
+		retryAfter = max(retryAfter, us.throttle.fail(address, us.clock()))
+		if retryAfter > 0 {
+			log.Printf("[%s] POST /users/authenticate: credentials did not match and are locked for %s", sender, retryAfter)
+
+			us.hc.increment("authenticate.failure")
+			us.tooManyRequests(w, r, retryAfter)
+			return
+		}
+
+		log.Printf("[%s] POST /users/authenticate: credentials did not match", sender)
+
+		us.hc.increment("authenticate.failure")
+		us.fail(w, r, http.StatusUnauthorized, "the credentials did not match")
+		return
+	}
+
+	us.throttle.succeed(address)
+
+	response := &authenticated{ID: user.ID, Status: "authenticated"}
+
+	if us.tokens != nil {
+		response.tokenPair, err = us.issueTokens(user.ID)
+		if err != nil {
+			log.Printf("[%s] POST /users/authenticate: unable to issue tokens: %s", sender, err.Error())
+
+			us.fail(w, r, http.StatusInternalServerError, "unable to issue tokens")
+			return
+		}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("[%s] POST /users/authenticate: unable to marshal response %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to marshal the response")
+		return
+	}
+
+	log.Printf("[%s] POST /users/authenticate: authenticated %q", sender, user.ID)
+
+	us.hc.increment("authenticate.success")
+	us.hc.increment(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,198 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* POST a body to /users/authenticate and get the response. */
+func postAuthenticate(t *testing.T, us *UserService, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/users/authenticate", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	return w
+}
+
+/* Get the count of key from the healthcheck. */
+func healthcheckCount(t *testing.T, us *UserService, key string) int {
+	req, err := http.NewRequest("GET", "/healthcheck", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	counts := map[string]int{}
+
+	err = json.NewDecoder(w.Body).Decode(&counts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return counts[key]
+}
+
+/*
+TestAuthenticateSucceeds: Given I have created a User when I call
+POST /users/authenticate with their email or nickname and password
+then the HTTP status code will be 200 OK and the response will contain
+their id.
+*/
+func TestAuthenticateSucceeds(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
+	})
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, body := range []string{
+		`{"email":"alice@bob.com","password":"f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"}`,
+		`{"nickname":"AB123","password":"f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"}`,
+	} {
+		w := postAuthenticate(t, us, body)
+
+		status := w.Result().StatusCode
+		if status != http.StatusOK {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+		}
+
+		got := authenticated{}
+
+		err = json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if got.ID != users[0].ID || got.Status != "authenticated" {
+			t.Fatalf("expected user %q to be authenticated but got %+v", users[0].ID, got)
+		}
+	}
+
+	count := healthcheckCount(t, us, "authenticate.success")
+	if count != 2 {
+		t.Fatalf("expected 2 successful authentications in the healthcheck but got %d", count)
+	}
+}
+
+/*
+TestAuthenticateIgnoresCase: Given I have created a User when I call
+POST /users/authenticate with their email or nickname in another case
+then the HTTP status code will be 200 OK, as they're unique regardless
+of case, with the memory store and the SQL store.
+*/
+func TestAuthenticateIgnoresCase(t *testing.T) {
+	for name, options := range map[string][]Option{
+		"memory": {},
+		"sql":    {WithDatabase(filepath.Join(t.TempDir(), "users.db"))},
+	} {
+		us, err := NewUserService(options...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		postAlice(t, us)
+
+		for _, body := range []string{
+			`{"email":"Alice@Bob.com","password":"` + alicePassword + `"}`,
+			`{"nickname":"ab123","password":"` + alicePassword + `"}`,
+		} {
+			status := postAuthenticate(t, us, body).Result().StatusCode
+			if status != http.StatusOK {
+				t.Fatalf("%s: Unexpected error code for %s. Got %d, %d expected.", name, body, status, http.StatusOK)
+			}
+		}
+
+		us.Close()
+	}
+}
+
+/*
+TestAuthenticateStatusIsUnauthorized: Given I have created a User when
+I call POST /users/authenticate with the wrong password or for a User
+that doesn't exist then the HTTP status code will be 401 Unauthorized.
+*/
+func TestAuthenticateStatusIsUnauthorized(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
+	})
+
+	bodies := []string{
+		`{"email":"alice@bob.com","password":"wrong"}`,
+		`{"nickname":"AB123","password":""}`,
+		`{"email":"ken@bob.com","password":"f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"}`,
+	}
+
+	for _, body := range bodies {
+		w := postAuthenticate(t, us, body)
+
+		status := w.Result().StatusCode
+		if status != http.StatusUnauthorized {
+			t.Fatalf("%s: Unexpected error code. Got %d, %d expected.", body, status, http.StatusUnauthorized)
+		}
+	}
+
+	count := healthcheckCount(t, us, "authenticate.failure")
+	if count != len(bodies) {
+		t.Fatalf("expected %d failed authentications in the healthcheck but got %d", len(bodies), count)
+	}
+}
+
+/*
+TestAuthenticateStatusIsBadRequest: Given I have rendered a request
+body that isn't JSON, is missing the password or doesn't have exactly
+one of email and nickname when I call POST /users/authenticate then
+the HTTP status code will be 400 Bad Request.
+*/
+func TestAuthenticateStatusIsBadRequest(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, body := range []string{
+		`not json`,
+		`{"email":"alice@bob.com"}`,
+		`{"password":"secret"}`,
+		`{"email":"alice@bob.com","nickname":"AB123","password":"secret"}`,
+	} {
+		w := postAuthenticate(t, us, body)
+
+		status := w.Result().StatusCode
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s: Unexpected error code. Got %d, %d expected.", body, status, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Returned when a cursor wasn't made by this service, or is for another sort. */
+var errInvalidCursor = errors.New("cursor is not valid")
+
+/*
+cursorSigner signs the cursors of GET /users, so a client can't make
+up its own. Its key is loaded by WithCursorKey, so cursors can still be
+used after a restart or by another instance with the same key. Without
+one a key is made when the service starts, and cursors can't be used
+after a restart.
+*/
+type cursorSigner struct {
+	key []byte
+}
+
+/*
+The position a cursor points after: the sort it was made for and the
+value of each of the attributes sorted by of the last user on a page.
+*/
+type cursorPosition struct {
+	Sort  string            `json:"sort"`
+	After map[string]string `json:"after"`
+}
+
+func newCursorSigner() (*cursorSigner, error) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursorSigner{key: key}, nil
+}
+
+/* Load the key cursors are signed with from the file at path. */
+func loadCursorSigner(path string) (*cursorSigner, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := bytes.TrimSpace(raw)
+	if len(key) < 32 {
+		return nil, fmt.Errorf("%s: cursor key must be at least 32 bytes", path)
+	}
+
+	return &cursorSigner{key: key}, nil
+}
+
+/*
+Sign the cursors of GET /users with the key in the file at path, rather
+than one made when the service starts, so they outlive it.
+*/
+func WithCursorKey(path string) Option {
+	return func(us *UserService) error {
+		cursors, err := loadCursorSigner(path)
+		if err != nil {
+			return err
+		}
+
+		us.cursors = cursors
+
+		return nil
+	}
+}
+
+/* Format keys as they'd be sent in the sort query parameter. */
+func formatSort(keys []sortKey) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = key.attribute
+		if key.descending {
+			fields[i] = "-" + key.attribute
+		}
+	}
+
+	return strings.Join(fields, ",")
+}
+
+/*
+Get the value of an attribute users can be sorted by, as it's kept in
+a cursor. Times are in nanoseconds so none of their precision is lost.
+*/
+func sortValue(u *user, attribute string) string {
+	switch attribute {
+	case "created_at":
+		return strconv.FormatInt(u.CreatedAt.tm.UnixNano(), 10)
+	case "id":
+		return u.ID
+	case "updated_at":
+		return strconv.FormatInt(u.UpdatedAt.tm.UnixNano(), 10)
+	}
+
+	return u.attribute(attribute)
+}
+
+/* Set an attribute users can be sorted by from its value in a cursor. */
+func setSortValue(u *user, attribute string, value string) error {
+	switch attribute {
+	case "country":
+		u.Country = value
+	case "created_at", "updated_at":
+		nanoseconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		tm := &u.CreatedAt.tm
+		if attribute == "updated_at" {
+			tm = &u.UpdatedAt.tm
+		}
+
+		*tm = time.Unix(0, nanoseconds)
+	case "email":
+		u.Email = value
+	case "email_verified":
+		u.EmailVerified = value == "true"
+	case "first_name":
+		u.FirstName = value
+	case "id":
+		u.ID = value
+	case "last_name":
+		u.LastName = value
+	case "nickname":
+		u.Nickname = value
+	}
+
+	return nil
+}
+
+/* Sign a message with the key. */
+func (cs *cursorSigner) mac(message []byte) []byte {
+	mac := hmac.New(sha256.New, cs.key)
+	mac.Write(message)
+
+	return mac.Sum(nil)
+}
+
+/* Make a cursor that points after last in users sorted by keys. */
+func (cs *cursorSigner) encode(keys []sortKey, last *user) (string, error) {
+	position := cursorPosition{
+		Sort:  formatSort(keys),
+		After: make(map[string]string, len(keys)),
+	}
+
+	for _, key := range keys {
+		position.After[key.attribute] = sortValue(last, key.attribute)
+	}
+
+	raw, err := json.Marshal(&position)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+
+	return enc.EncodeToString(raw) + "." + enc.EncodeToString(cs.mac(raw)), nil
+}
+
+/*
+Get the position a cursor points after, as a user with the attributes
+sorted by set, so it can be compared with users. The cursor must have
+been made for the same sort as keys, or errInvalidCursor is returned.
+*/
+func (cs *cursorSigner) decode(cursor string, keys []sortKey) (*user, error) {
+	payload, signature, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+
+	enc := base64.RawURLEncoding
+
+	raw, err := enc.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	mac, err := enc.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, cs.mac(raw)) {
+		return nil, errInvalidCursor
+	}
+
+	position := cursorPosition{}
+
+	err = json.Unmarshal(raw, &position)
+	if err != nil || position.Sort != formatSort(keys) {
+		return nil, errInvalidCursor
+	}
+
+	after := &user{}
+	for _, key := range keys {
+		value, ok := position.After[key.attribute]
+		if !ok {
+			return nil, errInvalidCursor
+		}
+
+		err = setSortValue(after, key.attribute, value)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+	}
+
+	return after, nil
+}
@@ -0,0 +1,322 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+/* Open a cursorSigner, failing the test if it can't be. */
+func openCursorSigner(t *testing.T) *cursorSigner {
+	cs, err := newCursorSigner()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return cs
+}
+
+/*
+TestCursorRoundTrip: Given a cursor made after a user when it is
+decoded with the same sort then its position compares equal to the
+user, and it's refused for another sort, key or if tampered with.
+*/
+func TestCursorRoundTrip(t *testing.T) {
+	cs := openCursorSigner(t)
+
+	keys, err := parseSort([]string{"-updated_at,last_name"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	last := &user{
+		ID:        "9f4ce4f5-32bf-499d-af6c-c475293d7612",
+		LastName:  "Bob",
+		UpdatedAt: datetime{tm: time.Unix(1700000000, 123456789)},
+	}
+
+	cursor, err := cs.encode(keys, last)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	after, err := cs.decode(cursor, keys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if compareUsers(last, after, keys) != 0 {
+		t.Fatalf("expected the position to equal the user but got %+v", after)
+	}
+
+	for name, forgery := range map[string]struct {
+		cs     *cursorSigner
+		cursor string
+		keys   []sortKey
+	}{
+		"another sort":  {cs, cursor, defaultSort},
+		"another key":   {openCursorSigner(t), cursor, keys},
+		"tampered with": {cs, "e30" + cursor[3:], keys},
+		"not a cursor":  {cs, "nonsense", keys},
+	} {
+		_, err = forgery.cs.decode(forgery.cursor, forgery.keys)
+		if !errors.Is(err, errInvalidCursor) {
+			t.Fatalf("%s: expected errInvalidCursor but got %v", name, err)
+		}
+	}
+}
+
+/* GET a page of url and get its Users' nicknames and the cursor of the next page. */
+func getCursorPage(t *testing.T, us *UserService, url string) ([]string, string) {
+	w := serveWithToken(t, us, "GET", url, "", "")
+
+	status := w.Result().StatusCode
+	if status == http.StatusNoContent {
+		return nil, ""
+	} else if status != http.StatusOK {
+		t.Fatalf("%s: Got %d, %d expected.", url, status, http.StatusOK)
+	}
+
+	page := struct {
+		Users      []map[string]string `json:"users"`
+		NextCursor string              `json:"next_cursor"`
+	}{}
+
+	err := json.NewDecoder(w.Body).Decode(&page)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nicknames := []string{}
+	for _, user := range page.Users {
+		nicknames = append(nicknames, user["nickname"])
+	}
+
+	return nicknames, page.NextCursor
+}
+
+/*
+TestCursorWalkSurvivesWrites: Given I walk every User by cursor when
+Users are created and deleted between pages then every User that was
+there the whole time is seen exactly once, for each sort.
+*/
+func TestCursorWalkSurvivesWrites(t *testing.T) {
+	for _, sort := range []string{"", "-created_at", "last_name,-nickname"} {
+		now := time.Unix(1700000000, 0)
+
+		us, err := NewUserService(WithClock(func() time.Time { return now }))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		postNumberedUsers(t, us, 10)
+
+		ids := map[string]string{}
+		for _, user := range getUsers(t, us, "/users") {
+			ids[user["nickname"]] = user["id"]
+		}
+
+		seen := map[string]int{}
+		deleted := map[string]bool{}
+
+		url := "/users?limit=3&sort=" + sort
+		for page := 0; ; page++ {
+			nicknames, cursor := getCursorPage(t, us, url)
+			for _, nickname := range nicknames {
+				seen[nickname]++
+			}
+
+			if cursor == "" {
+				break
+			}
+
+			/* sign someone up, and delete someone seen and someone not */
+
+			now = now.Add(time.Second)
+
+			postUser(t, us, map[string]string{
+				"country":    "GB",
+				"email":      fmt.Sprintf("new_%d@bob.com", page),
+				"first_name": "New",
+				"last_name":  fmt.Sprintf("%d", page),
+				"nickname":   fmt.Sprintf("new_%d", page),
+				"password":   alicePassword,
+			})
+
+			for _, nickname := range []string{nicknames[0], fmt.Sprintf("user_%d", 9-page)} {
+				if deleted[nickname] || ids[nickname] == "" {
+					continue
+				}
+
+				serveWithToken(t, us, "DELETE", "/users/"+ids[nickname], "", "")
+				deleted[nickname] = true
+			}
+
+			url = "/users?limit=3&sort=" + sort + "&cursor=" + cursor
+		}
+
+		for i := 0; i < 10; i++ {
+			nickname := fmt.Sprintf("user_%d", i)
+			if deleted[nickname] && seen[nickname] <= 1 {
+				continue
+			}
+
+			if seen[nickname] != 1 {
+				t.Fatalf("sort %q: expected %s to be seen once but was seen %d times", sort, nickname, seen[nickname])
+			}
+		}
+	}
+}
+
+/*
+TestCursorStatusIsBadRequest: Given I call GET /users with a cursor
+that isn't valid, is for another sort or is sent with a page then the
+HTTP status code will be 400 Bad Request.
+*/
+func TestCursorStatusIsBadRequest(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postNumberedUsers(t, us, 3)
+
+	_, cursor := getCursorPage(t, us, "/users?limit=1")
+	if cursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+
+	for _, url := range []string{
+		"/users?cursor=nonsense",
+		"/users?cursor=" + cursor + "&sort=nickname",
+		"/users?cursor=" + cursor + "&page=1",
+	} {
+		w := serveWithToken(t, us, "GET", url, "", "")
+
+		expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+	}
+}
+
+/*
+TestCursorKeyOutlivesService: Given two UserServices with the same
+cursor key when a cursor from one is sent to the other then it's the
+next page, but to a service with another key it's 400 Bad Request. A
+key shorter than 32 bytes isn't accepted.
+*/
+func TestCursorKeyOutlivesService(t *testing.T) {
+	dir := t.TempDir()
+
+	key := filepath.Join(dir, "cursor.key")
+
+	err := os.WriteFile(key, []byte("a cursor key that is at least 32 bytes long\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	store := NewMemoryStore()
+
+	services := []*UserService{}
+	for _, options := range [][]Option{
+		{WithStore(store), WithCursorKey(key)},
+		{WithStore(store), WithCursorKey(key)},
+		{WithStore(store)},
+	} {
+		us, err := NewUserService(options...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		services = append(services, us)
+	}
+
+	postNumberedUsers(t, services[0], 4)
+
+	_, cursor := getCursorPage(t, services[0], "/users?limit=2")
+
+	nicknames, _ := getCursorPage(t, services[1], "/users?limit=2&cursor="+cursor)
+	if len(nicknames) != 2 {
+		t.Fatalf("expected the next page from another service with the key but got %v", nicknames)
+	}
+
+	w := serveWithToken(t, services[2], "GET", "/users?limit=2&cursor="+cursor, "", "")
+
+	expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+
+	short := filepath.Join(dir, "short.key")
+
+	err = os.WriteFile(short, []byte("too short"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = NewUserService(WithCursorKey(short))
+	if err == nil {
+		t.Fatal("expected a short cursor key to be refused")
+	}
+}
+
+/*
+TestCursorWalkSurvivesRestart: Given Users created within the same
+second in a data directory when a walk by cursor is continued after
+the service restarts with the same cursor key then every User is seen
+once, in order.
+*/
+func TestCursorWalkSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	key := filepath.Join(t.TempDir(), "cursor.key")
+
+	err := os.WriteFile(key, []byte("a cursor key that is at least 32 bytes long\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	open := func() *UserService {
+		us, err := NewUserService(WithDataDir(dir, 0), WithCursorKey(key), WithClock(func() time.Time { return now }))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		return us
+	}
+
+	us := open()
+
+	for _, nickname := range []string{"aaa", "bbb", "ccc"} {
+		postUser(t, us, map[string]string{
+			"country":    "GB",
+			"email":      nickname + "@bob.com",
+			"first_name": "Rob",
+			"last_name":  "Bob",
+			"nickname":   nickname,
+			"password":   alicePassword,
+		})
+
+		now = now.Add(100 * time.Millisecond)
+	}
+
+	seen, cursor := getCursorPage(t, us, "/users?limit=1")
+
+	us.Close()
+
+	us = open()
+	defer us.Close()
+
+	for cursor != "" {
+		var nicknames []string
+		nicknames, cursor = getCursorPage(t, us, "/users?limit=1&cursor="+cursor)
+		seen = append(seen, nicknames...)
+	}
+
+	if !slices.Equal(seen, []string{"aaa", "bbb", "ccc"}) {
+		t.Fatalf("expected aaa, bbb and ccc but got %v", seen)
+	}
+}
@@ -0,0 +1,216 @@
+package http
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+/* How many users are written to an export between flushes. */
+const exportFlushEvery = 100
+
+/* The formats GET /users/export can write, and their content types. */
+var exportFormats = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+/* The columns of a CSV export when fields isn't set. */
+var exportColumns = fieldset{"id", "email", "nickname", "first_name", "last_name", "country", "email_verified", "created_at", "updated_at"}
+
+/* Get the value of field of u as it's written to a CSV export. */
+func exportValue(u *user, field string) string {
+	switch field {
+	case "created_at":
+		return u.CreatedAt.tm.UTC().Format(DtLayout)
+	case "email_verified":
+		return strconv.FormatBool(u.EmailVerified)
+	case "id":
+		return u.ID
+	case "updated_at":
+		return u.UpdatedAt.tm.UTC().Format(DtLayout)
+	}
+
+	return u.attribute(field)
+}
+
+/*
+exportWriter writes the users of GET /users/export to its response as
+they're walked, either as a line of JSON each or as CSV. The headers
+aren't written until the first user, or the end if there are none, so
+a failure before then can still be a problem.
+*/
+type exportWriter struct {
+	csv     *csv.Writer
+	encoder *json.Encoder
+	fields  fieldset
+	format  string
+	hc      *healthchecker
+	rc      *http.ResponseController
+	started bool
+	w       http.ResponseWriter
+	written int
+}
+
+func newExportWriter(w http.ResponseWriter, format string, fields fieldset, hc *healthchecker) *exportWriter {
+	ew := &exportWriter{
+		fields: fields,
+		format: format,
+		hc:     hc,
+		rc:     http.NewResponseController(w),
+		w:      w,
+	}
+
+	if format == "csv" {
+		ew.csv = csv.NewWriter(w)
+
+		if ew.fields == nil {
+			ew.fields = exportColumns
+		}
+	} else {
+		ew.encoder = json.NewEncoder(w)
+	}
+
+	return ew
+}
+
+/* Write the headers, and the header row of a CSV export. */
+func (ew *exportWriter) start() error {
+	if ew.started {
+		return nil
+	}
+
+	ew.started = true
+
+	ew.w.Header().Set("Content-Type", exportFormats[ew.format])
+	ew.w.Header().Set("Content-Disposition", `attachment; filename="users.`+ew.format+`"`)
+
+	ew.hc.increment(http.StatusOK)
+	ew.w.WriteHeader(http.StatusOK)
+
+	if ew.csv != nil {
+		return ew.csv.Write(ew.fields)
+	}
+
+	return nil
+}
+
+/* Write u to the export, flushing every exportFlushEvery users. */
+func (ew *exportWriter) write(u *user) error {
+	err := ew.start()
+	if err != nil {
+		return err
+	}
+
+	if ew.csv != nil {
+		record := make([]string, len(ew.fields))
+		for i, field := range ew.fields {
+			record[i] = exportValue(u, field)
+		}
+
+		err = ew.csv.Write(record)
+	} else {
+		err = ew.encoder.Encode(u.project(ew.fields))
+	}
+	if err != nil {
+		return err
+	}
+
+	ew.written++
+	if ew.written%exportFlushEvery == 0 {
+		return ew.flush()
+	}
+
+	return nil
+}
+
+/* Flush what has been written so far to the client. */
+func (ew *exportWriter) flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+
+		err := ew.csv.Error()
+		if err != nil {
+			return err
+		}
+	}
+
+	return ew.rc.Flush()
+}
+
+/* Finish the export, writing the headers if there were no users. */
+func (ew *exportWriter) close() error {
+	err := ew.start()
+	if err != nil {
+		return err
+	}
+
+	return ew.flush()
+}
+
+/*
+Stream every user that matches the filters of the request, as GET
+/users would have them, from a snapshot of the store. If it fails once
+users have been written the response is aborted, so a client can't
+mistake part of an export for all of it.
+*/
+func (us *UserService) export(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+
+	if _, ok := exportFormats[format]; !ok {
+		log.Printf("[%s] GET /users/export: %q is not a format", sender, format)
+
+		us.fail(w, r, http.StatusBadRequest, "format must be ndjson or csv")
+		return
+	}
+
+	fields, err := parseFields(query)
+	if err != nil {
+		log.Printf("[%s] GET /users/export: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filters, err := parseFilters(query, us.clock())
+	if err != nil {
+		log.Printf("[%s] GET /users/export: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[%s] GET /users/export: attempting to export users as %s", sender, format)
+
+	ew := newExportWriter(w, format, fields, us.hc)
+
+	err = us.store.Walk(r.Context(), filters, ew.write)
+	if err == nil {
+		err = ew.close()
+	}
+
+	if r.Context().Err() != nil {
+		log.Printf("[%s] GET /users/export: gone after %d users", sender, ew.written)
+		return
+	} else if err != nil && !ew.started {
+		log.Printf("[%s] GET /users/export: unable to export users %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to export users")
+		return
+	} else if err != nil {
+		log.Printf("[%s] GET /users/export: unable to export users after %d %q", sender, ew.written, err.Error())
+
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Printf("[%s] GET /users/export: exported %d users", sender, ew.written)
+}
@@ -0,0 +1,295 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A ResponseRecorder that counts how many times it is flushed. */
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (fc *flushCounter) Flush() {
+	fc.flushes++
+	fc.ResponseRecorder.Flush()
+}
+
+/* GET url from us, counting the flushes of the response. */
+func serveExport(t *testing.T, us *UserService, url string) *flushCounter {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	fc := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	us.ServeHTTP(fc, req)
+
+	return fc
+}
+
+/* Decode each line of an NDJSON export. */
+func decodeExport(t *testing.T, body string) []map[string]string {
+	users := []map[string]string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		user := map[string]string{}
+
+		err := json.Unmarshal(scanner.Bytes(), &user)
+		if err != nil {
+			t.Fatalf("%q: %s", scanner.Text(), err.Error())
+		}
+
+		users = append(users, user)
+	}
+
+	return users
+}
+
+/*
+TestUsersExportStreams: Given I have created Users when I call GET
+/users/export then every User is written as a line of JSON, oldest
+first, with the same attributes as GET /users and flushed as it goes,
+and filters and fields work as they do for GET /users, with the memory
+store and the SQL store.
+*/
+func TestUsersExportStreams(t *testing.T) {
+	for name, options := range map[string][]Option{
+		"memory": {},
+		"sql":    {WithDatabase(filepath.Join(t.TempDir(), "users.db"))},
+	} {
+		now := time.Unix(1700000000, 0)
+
+		us, err := NewUserService(append(options, WithClock(func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}))...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		postNumberedUsers(t, us, 250)
+
+		fc := serveExport(t, us, "/users/export")
+		if fc.Code != http.StatusOK || fc.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("%s: expected 200 OK with NDJSON but got %d with %q", name, fc.Code, fc.Header().Get("Content-Type"))
+		}
+
+		if fc.flushes < 250/exportFlushEvery {
+			t.Fatalf("%s: expected at least %d flushes but got %d", name, 250/exportFlushEvery, fc.flushes)
+		}
+
+		exported := decodeExport(t, fc.Body.String())
+		listed := getUsers(t, us, "/users?limit=1000")
+
+		if len(exported) != len(listed) {
+			t.Fatalf("%s: expected %d users but got %d", name, len(listed), len(exported))
+		}
+
+		for i, user := range exported {
+			for key, value := range listed[i] {
+				if user[key] != value {
+					t.Fatalf("%s: expected %s of user %d to be %q but got %q", name, key, i, value, user[key])
+				}
+			}
+		}
+
+		for _, query := range []string{"nickname[prefix]=user_1&country=GB", "q=user+42", "created_at[gt]=-1h&last_name[in]=7,8,9"} {
+			expected := getNicknames(t, us, "/users?limit=1000&"+query)
+
+			nicknames := []string{}
+			for _, user := range decodeExport(t, serveExport(t, us, "/users/export?"+query).Body.String()) {
+				nicknames = append(nicknames, user["nickname"])
+			}
+
+			if got := strings.Join(nicknames, ","); got != expected {
+				t.Fatalf("%s: %s: expected %s but got %s", name, query, expected, got)
+			}
+		}
+
+		for _, user := range decodeExport(t, serveExport(t, us, "/users/export?fields=id,nickname").Body.String()) {
+			if len(user) != 2 || user["id"] == "" || user["nickname"] == "" {
+				t.Fatalf("%s: expected only the id and nickname but got %v", name, user)
+			}
+		}
+	}
+}
+
+/*
+TestUsersExportCSV: Given I have created Users when I call GET
+/users/export with format=csv then there's a header row of the columns
+and a row for each User with the same values as GET /users.
+*/
+func TestUsersExportCSV(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postNumberedUsers(t, us, 3)
+	listed := getUsers(t, us, "/users")
+
+	for _, test := range []struct {
+		query   string
+		columns []string
+	}{
+		{"", exportColumns},
+		{"&fields=nickname,id", []string{"nickname", "id"}},
+	} {
+		fc := serveExport(t, us, "/users/export?format=csv"+test.query)
+		if fc.Code != http.StatusOK || !strings.HasPrefix(fc.Header().Get("Content-Type"), "text/csv") {
+			t.Fatalf("%s: expected 200 OK with CSV but got %d with %q", test.query, fc.Code, fc.Header().Get("Content-Type"))
+		}
+
+		records, err := csv.NewReader(fc.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(records) != len(listed)+1 || !slices.Equal(records[0], test.columns) {
+			t.Fatalf("%s: expected the columns %v and %d rows but got %v", test.query, test.columns, len(listed), records)
+		}
+
+		for i, record := range records[1:] {
+			for j, column := range test.columns {
+				if record[j] != listed[i][column] {
+					t.Fatalf("%s: expected %s of user %d to be %q but got %q", test.query, column, i, listed[i][column], record[j])
+				}
+			}
+		}
+	}
+}
+
+/*
+TestStoresWalkSnapshot: Given a store with Users when Users are created
+and deleted while it's being walked then the walk sees the Users as
+they were when it started, and it stops when its context is cancelled.
+*/
+func TestStoresWalkSnapshot(t *testing.T) {
+	for name, store := range map[string]Store{
+		"memory": NewMemoryStore(),
+		"sql":    openSQL(t, filepath.Join(t.TempDir(), "users.db")),
+	} {
+		nicknames := []string{}
+		for i := 0; i < 300; i++ {
+			nicknames = append(nicknames, fmt.Sprintf("user_%d", i))
+		}
+
+		ids := createUsers(t, store, nicknames...)
+
+		seen := map[string]bool{}
+
+		err := store.Walk(context.Background(), nil, func(user *user) error {
+			if len(seen) == 0 {
+				createUsers(t, store, "latecomer")
+
+				err := store.Delete(ids[len(ids)-1])
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+
+			seen[user.ID] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(seen) != len(ids) || !seen[ids[len(ids)-1]] {
+			t.Fatalf("%s: expected the %d users from the start but got %d", name, len(ids), len(seen))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		visited := 0
+
+		err = store.Walk(ctx, nil, func(user *user) error {
+			visited++
+			cancel()
+
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) || visited >= len(ids) {
+			t.Fatalf("%s: expected the walk to be cancelled but got %v after %d users", name, err, visited)
+		}
+
+		store.Close()
+	}
+}
+
+/* A Store that fails part way through a walk. */
+type brokenWalkStore struct {
+	Store
+}
+
+func (bws brokenWalkStore) Walk(ctx context.Context, filters []*filter, visit func(user *user) error) error {
+	err := bws.Store.Walk(ctx, filters, func(user *user) error {
+		err := visit(user)
+		if err != nil {
+			return err
+		}
+
+		return errBroken
+	})
+
+	return err
+}
+
+/*
+TestUsersExportFailures: Given I call GET /users/export with a format
+or filter that isn't valid then the HTTP status code will be 400 Bad
+Request, if the store fails before any Users are written it will be
+500 Internal Server Error, and if it fails after the response is
+aborted.
+*/
+func TestUsersExportFailures(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, query := range []string{"format=xml", "nickname[bogus]=rob", "fields=password", "q=%40"} {
+		w := serveWithToken(t, us, "GET", "/users/export?"+query, "", "")
+
+		expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users/export")
+	}
+
+	broken, err := NewUserService(WithStore(brokenStore{}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := serveWithToken(t, broken, "GET", "/users/export", "", "")
+
+	expectProblem(t, w, http.StatusInternalServerError, "internal-server-error", "/users/export")
+
+	store := NewMemoryStore()
+	createUsers(t, store, "rob")
+
+	halfBroken, err := NewUserService(WithStore(brokenWalkStore{store}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Fatal("expected the response to be aborted")
+		}
+	}()
+
+	serveExport(t, halfBroken, "/users/export")
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+/*
+The attributes of a user in SCHEMA.md that are returned by GET, and
+how to set each of them on a sparseUser from a publicUser. password is
+in the schema but is write only, so it's never one of them.
+*/
+var userFields = map[string]func(su *sparseUser, pu *publicUser){
+	"country":        func(su *sparseUser, pu *publicUser) { su.Country = &pu.Country },
+	"created_at":     func(su *sparseUser, pu *publicUser) { su.CreatedAt = &pu.CreatedAt },
+	"email":          func(su *sparseUser, pu *publicUser) { su.Email = &pu.Email },
+	"email_verified": func(su *sparseUser, pu *publicUser) { su.EmailVerified = &pu.EmailVerified },
+	"first_name":     func(su *sparseUser, pu *publicUser) { su.FirstName = &pu.FirstName },
+	"id":             func(su *sparseUser, pu *publicUser) { su.ID = &pu.ID },
+	"last_name":      func(su *sparseUser, pu *publicUser) { su.LastName = &pu.LastName },
+	"nickname":       func(su *sparseUser, pu *publicUser) { su.Nickname = &pu.Nickname },
+	"updated_at":     func(su *sparseUser, pu *publicUser) { su.UpdatedAt = &pu.UpdatedAt },
+}
+
+/* The attributes of users to return. nil is all of them. */
+type fieldset []string
+
+/*
+Parse the fields query parameter, a comma separated list of the
+attributes to return. Each must be one of the userFields, and only
+asked for once.
+*/
+func parseFields(query url.Values) (fieldset, error) {
+	if !query.Has("fields") {
+		return nil, nil
+	}
+
+	fields := fieldset{}
+	for _, field := range strings.Split(strings.Join(query["fields"], ","), ",") {
+		if _, ok := userFields[field]; !ok {
+			return nil, fmt.Errorf("fields: %q is not an attribute of users that can be returned", field)
+		}
+
+		if slices.Contains(fields, field) {
+			return nil, fmt.Errorf("fields: %q is asked for more than once", field)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+/*
+A publicUser with only some of its attributes. Those that aren't nil
+are returned, even when they're empty, so it marshals like publicUser
+does without a map for each user.
+*/
+type sparseUser struct {
+	CreatedAt *datetime `json:"created_at,omitempty"`
+	Country   *string   `json:"country,omitempty"`
+	Email     *string   `json:"email,omitempty"`
+	FirstName *string   `json:"first_name,omitempty"`
+	ID        *string   `json:"id,omitempty"`
+	LastName  *string   `json:"last_name,omitempty"`
+	Nickname  *string   `json:"nickname,omitempty"`
+	UpdatedAt *datetime `json:"updated_at,omitempty"`
+
+	EmailVerified *bool `json:"email_verified,omitempty,string"`
+}
+
+/* Get how u is returned with only the attributes in fields. */
+func (u *user) project(fields fieldset) any {
+	pu := u.public()
+	if fields == nil {
+		return pu
+	}
+
+	su := &sparseUser{}
+	for _, field := range fields {
+		userFields[field](su, pu)
+	}
+
+	return su
+}
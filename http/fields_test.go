@@ -0,0 +1,195 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Get the names of the attributes in the table of the schema in SCHEMA.md. */
+func schemaAttributes(t *testing.T) []string {
+	file, err := os.Open("../docs/endpoints/users/SCHEMA.md")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+
+	attributes := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		cells := strings.Split(scanner.Text(), "|")
+		if len(cells) < 3 {
+			continue
+		}
+
+		name := strings.TrimSpace(cells[1])
+		if name == "attribute" || name == "-" {
+			continue
+		}
+
+		attributes = append(attributes, name)
+	}
+
+	return attributes
+}
+
+/* Get the keys of m in order. */
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+/*
+TestUserFieldsMatchSchema: Given the attributes of the schema in
+SCHEMA.md when they are compared with the fields that can be asked for
+and the JSON of a publicUser then they are the same, apart from the
+write only password.
+*/
+func TestUserFieldsMatchSchema(t *testing.T) {
+	schema := slices.DeleteFunc(schemaAttributes(t), func(attribute string) bool {
+		return attribute == "password"
+	})
+	slices.Sort(schema)
+
+	fields := sortedKeys(userFields)
+	if !slices.Equal(schema, fields) {
+		t.Fatalf("expected the fields %v of the schema but got %v", schema, fields)
+	}
+
+	raw, err := json.Marshal(&publicUser{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	public := map[string]any{}
+
+	err = json.Unmarshal(raw, &public)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	returned := sortedKeys(public)
+	if !slices.Equal(schema, returned) {
+		t.Fatalf("expected a publicUser to have the fields %v of the schema but got %v", schema, returned)
+	}
+}
+
+/*
+TestUsersGetFields: Given I have created Users when I call GET /users
+or GET /users/{id} with fields then each User has only those
+attributes, with the same values as without fields.
+*/
+func TestUsersGetFields(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	us, err := NewUserService(WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postNumberedUsers(t, us, 3)
+
+	full := getUsers(t, us, "/users")
+
+	for _, fields := range []string{"id,nickname", "email_verified,created_at,updated_at", "country", strings.Join(sortedKeys(userFields), ",")} {
+		names := strings.Split(fields, ",")
+
+		sparse := getUsers(t, us, "/users?fields="+fields)
+		if len(sparse) != len(full) {
+			t.Fatalf("%s: expected %d users but got %d", fields, len(full), len(sparse))
+		}
+
+		for i, user := range sparse {
+			if len(user) != len(names) {
+				t.Fatalf("%s: expected only those attributes but got %v", fields, user)
+			}
+
+			for _, name := range names {
+				if user[name] != full[i][name] {
+					t.Fatalf("%s: expected %s %q but got %q", fields, name, full[i][name], user[name])
+				}
+			}
+		}
+	}
+
+	w := serveWithToken(t, us, "GET", "/users/"+full[0]["id"]+"?fields=nickname", "", "")
+
+	user := map[string]string{}
+
+	err = json.NewDecoder(w.Body).Decode(&user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(user) != 1 || user["nickname"] != full[0]["nickname"] {
+		t.Fatalf("expected only the nickname %q but got %v", full[0]["nickname"], user)
+	}
+}
+
+/*
+TestFieldsStatusIsBadRequest: Given I call GET /users or GET
+/users/{id} with fields that aren't returned, are empty or are asked
+for twice then the HTTP status code will be 400 Bad Request.
+*/
+func TestFieldsStatusIsBadRequest(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postNumberedUsers(t, us, 1)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+
+	for _, path := range []string{"/users", "/users/" + id} {
+		for _, fields := range []string{"password", "bogus", "id,id", "", "id,,nickname", "id,%20nickname"} {
+			w := serveWithToken(t, us, "GET", path+"?fields="+fields, "", "")
+
+			expectProblem(t, w, http.StatusBadRequest, "bad-request", path)
+		}
+	}
+}
+
+/*
+BenchmarkMarshalSparseUsers: compare marshalling a page of the largest
+size with only the id and nickname of each user to marshalling all of
+their attributes and to a map of the two for each user.
+*/
+func BenchmarkMarshalSparseUsers(b *testing.B) {
+	users := make([]*user, maxLimit)
+	for i := range users {
+		users[i] = &user{ID: "9f4ce4f5-32bf-499d-af6c-c475293d7612", Nickname: "AB123", Email: "alice@bob.com", FirstName: "Alice", LastName: "Bob", Country: "GB"}
+	}
+
+	for name, project := range map[string]func(u *user) any{
+		"sparse": func(u *user) any { return u.project(fieldset{"id", "nickname"}) },
+		"full":   func(u *user) any { return u.project(nil) },
+		"map":    func(u *user) any { return map[string]string{"id": u.ID, "nickname": u.Nickname} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				page := make([]any, len(users))
+				for j, user := range users {
+					page[j] = project(user)
+				}
+
+				_, err := json.Marshal(page)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package http
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+A filter on an attribute of users, from a query parameter of GET /users
+such as nickname[prefix]=ro. Strings are compared by operator with any
+of values, ignoring case if caseless, and the result is flipped if
+negated. Times are compared by operator with tm. The q parameter is a
+filter whose operator is search and whose values are its terms, and a
+filter whose operator is key finds the user an email or nickname
+belongs to by its uniqueKey.
+*/
+type filter struct {
+	attribute string
+	operator  string
+	caseless  bool
+	negated   bool
+	values    []string
+	tm        time.Time
+}
+
+/* The attributes users can be filtered on, and the operators each can use. */
+var filterOperators = map[string][]string{
+	"country":        stringOperators,
+	"created_at":     timeOperators,
+	"email":          stringOperators,
+	"email_verified": {"eq"},
+	"first_name":     stringOperators,
+	"last_name":      stringOperators,
+	"nickname":       stringOperators,
+	"updated_at":     timeOperators,
+}
+
+var (
+	/* Operators of string attributes, which can be prefixed by not_ or i. */
+	stringOperators = []string{"eq", "prefix", "contains", "in"}
+
+	/* Operators of times. */
+	timeOperators = []string{"gt", "gte", "lt", "lte"}
+)
+
+/* Make a filter for users whose attribute is exactly value. */
+func equals(attribute string, value string) *filter {
+	return &filter{attribute: attribute, operator: "eq", values: []string{value}}
+}
+
+/*
+Make a filter for the user the email or nickname value belongs to,
+whatever its case, which stores answer from their index of uniqueKeys.
+*/
+func belongsTo(attribute string, value string) *filter {
+	return &filter{attribute: attribute, operator: "key", caseless: true, values: []string{value}}
+}
+
+/*
+Parse the filter of the query parameter key, i.e. an attribute and an
+optional operator in brackets, and its value. A time is either RFC 3339
+or a duration relative to now, e.g. -24h for a day ago.
+*/
+func parseFilter(key string, value string, now time.Time) (*filter, error) {
+	attribute, operator, bracketed := strings.Cut(key, "[")
+	if !bracketed {
+		operator = "eq]"
+	}
+
+	operator, closed := strings.CutSuffix(operator, "]")
+	if !closed {
+		return nil, fmt.Errorf("%s: expected the operator to end with ]", key)
+	}
+
+	operators, ok := filterOperators[attribute]
+	if !ok {
+		return nil, fmt.Errorf("%s: users can't be filtered on %q", key, attribute)
+	}
+
+	f := &filter{attribute: attribute}
+
+	if slices.Equal(operators, stringOperators) {
+		operator, f.negated = strings.CutPrefix(operator, "not_")
+		f.caseless = operator != "in" && strings.HasPrefix(operator, "i")
+		if f.caseless {
+			operator = operator[1:]
+		}
+	}
+
+	if !slices.Contains(operators, operator) {
+		return nil, fmt.Errorf("%s: %q is not an operator of %s", key, operator, attribute)
+	}
+
+	f.operator = operator
+
+	switch {
+	case attribute == "email_verified":
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("%s: email_verified must be true or false, not %q", key, value)
+		}
+
+		f.values = []string{value}
+	case slices.Equal(operators, timeOperators):
+		tm, err := parseFilterTime(value, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: expected an RFC 3339 time or a duration such as -24h, not %q", key, value)
+		}
+
+		f.tm = tm
+	case operator == "in":
+		f.values = strings.Split(value, ",")
+	default:
+		f.values = []string{value}
+	}
+
+	return f, nil
+}
+
+/* Parse the search q, which must have at least one term. */
+func parseSearch(q string) (*filter, error) {
+	terms := tokenize(q)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("q: expected a word to search for, not %q", q)
+	}
+
+	return &filter{attribute: "q", operator: "search", values: terms}, nil
+}
+
+/* Parse an RFC 3339 time, or a duration with a sign relative to now. */
+func parseFilterTime(value string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return now.Add(duration), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+/*
+Parse the filters in the query parameters of GET /users, including
+the search q. A parameter with brackets must be a valid filter, while
+others that aren't the name of an attribute are left for something
+else. Each value of a parameter is a filter of its own, and users have
+to match all of them. An empty q is no search at all.
+*/
+func parseFilters(query url.Values, now time.Time) ([]*filter, error) {
+	keys := []string{}
+	for key := range query {
+		attribute, _, bracketed := strings.Cut(key, "[")
+		if _, ok := filterOperators[attribute]; ok || bracketed {
+			keys = append(keys, key)
+		}
+	}
+
+	/* so the first error is always the same one */
+	slices.Sort(keys)
+
+	filters := []*filter{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			f, err := parseFilter(key, value, now)
+			if err != nil {
+				return nil, err
+			}
+
+			filters = append(filters, f)
+		}
+	}
+
+	for _, q := range query["q"] {
+		if q == "" {
+			continue
+		}
+
+		f, err := parseSearch(q)
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+/* Does the user match the filter? */
+func (f *filter) matches(u *user) bool {
+	switch f.attribute {
+	case "created_at":
+		return compareTime(u.CreatedAt.tm, f.operator, f.tm)
+	case "updated_at":
+		return compareTime(u.UpdatedAt.tm, f.operator, f.tm)
+	case "q":
+		return searchMatches(u, f.values)
+	}
+
+	value := u.attribute(f.attribute)
+	if f.caseless {
+		value = strings.ToLower(value)
+	}
+
+	matched := slices.ContainsFunc(f.values, func(filter string) bool {
+		if f.caseless {
+			filter = strings.ToLower(filter)
+		}
+
+		switch f.operator {
+		case "contains":
+			return strings.Contains(value, filter)
+		case "prefix":
+			return strings.HasPrefix(value, filter)
+		}
+
+		return value == filter
+	})
+
+	return matched != f.negated
+}
+
+/* Compare tm to the time of a filter with operator. */
+func compareTime(tm time.Time, operator string, filter time.Time) bool {
+	switch operator {
+	case "gt":
+		return tm.After(filter)
+	case "gte":
+		return !tm.Before(filter)
+	case "lt":
+		return tm.Before(filter)
+	}
+
+	return !tm.After(filter)
+}
+
+/*
+Can the filter be answered from an index of exact values, i.e. is it
+a case sensitive eq or in that isn't negated?
+*/
+func (f *filter) exact() bool {
+	return (f.operator == "eq" || f.operator == "in") && !f.caseless && !f.negated
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/* Parse a query string, failing the test if it can't be. */
+func parseQuery(t *testing.T, query string) url.Values {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return values
+}
+
+/*
+TestParseFilters: Given the query parameters of GET /users when they
+are parsed then each value of a filter is a filter of its own, with
+the operator, case and negation of its key, and other parameters are
+left alone.
+*/
+func TestParseFilters(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	filters, err := parseFilters(parseQuery(t, "country[not_iin]=gb,fr&created_at[gte]=-24h&created_at[lt]=2024-01-15T09:30:00Z&limit=5&nickname=rob&sort=id"), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(filters) != 4 {
+		t.Fatalf("expected 4 filters but got %d", len(filters))
+	}
+
+	country := filters[0]
+	if country.attribute != "country" || country.operator != "in" || !country.caseless || !country.negated || len(country.values) != 2 {
+		t.Fatalf("expected a negated caseless in filter of 2 countries but got %+v", country)
+	}
+
+	for i, expected := range []time.Time{now.Add(-24 * time.Hour), time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)} {
+		if !filters[i+1].tm.Equal(expected) {
+			t.Fatalf("expected created_at filter at %s but got %s", expected, filters[i+1].tm)
+		}
+	}
+
+	nickname := filters[3]
+	if nickname.operator != "eq" || nickname.caseless || nickname.negated || nickname.values[0] != "rob" {
+		t.Fatalf("expected an eq filter of rob but got %+v", nickname)
+	}
+}
+
+/*
+TestUsersGetFiltersWithOperators: Given I have created Users a second
+apart when I call GET /users with filters that have operators then only
+the Users that match all of them are returned, with the memory store
+and the SQL store.
+*/
+func TestUsersGetFiltersWithOperators(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+
+	for name, options := range map[string][]Option{
+		"memory": {},
+		"sql":    {WithDatabase(filepath.Join(t.TempDir(), "users.db"))},
+	} {
+		now := start
+
+		us, err := NewUserService(append(options, WithClock(func() time.Time { return now }))...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		postSortableUsers(t, us, &now, [][2]string{
+			{"Rob", "Smith"},
+			{"robert", "smith"},
+			{"alice", "Jones"},
+			{"bobby", "Brown"},
+		})
+
+		now = start.Add(24*time.Hour + 2*time.Second)
+
+		at := func(seconds int) string {
+			return start.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339)
+		}
+
+		for query, expected := range map[string]string{
+			"nickname[prefix]=rob":                                   "robert",
+			"nickname[iprefix]=rob":                                  "Rob,robert",
+			"nickname[contains]=ob":                                  "Rob,robert,bobby",
+			"nickname[not_contains]=ob":                              "alice",
+			"last_name[ieq]=SMITH":                                   "Rob,robert",
+			"last_name[not_ieq]=smith":                               "alice,bobby",
+			"last_name[icontains]=O":                                 "alice,bobby",
+			"nickname[in]=alice,bobby,nobody":                        "alice,bobby",
+			"nickname[not_in]=alice,bobby":                           "Rob,robert",
+			"nickname[iin]=rob,ALICE":                                "Rob,alice",
+			"nickname[not_eq]=Rob&last_name[iprefix]=s":              "robert",
+			"email_verified=false&nickname[prefix]=r":                "robert",
+			"created_at[gte]=-24h":                                   "alice,bobby",
+			"created_at[lt]=" + at(1):                                "Rob",
+			"created_at[gte]=" + at(1) + "&created_at[lt]=" + at(3):  "robert,alice",
+			"created_at[gt]=" + at(1) + "&updated_at[lte]=" + at(2):  "alice",
+			"country=GB&nickname[prefix]=b&created_at[gte]=" + at(0): "bobby",
+		} {
+			got := getNicknames(t, us, "/users?"+query)
+			if got != expected {
+				t.Fatalf("%s: %s: expected %s but got %s", name, query, expected, got)
+			}
+		}
+	}
+}
+
+/*
+TestUsersGetRefusesBadFilters: Given I call GET /users with a filter
+on an attribute that can't be filtered, an operator it can't use or a
+value that isn't valid then the HTTP status code will be 400 Bad
+Request.
+*/
+func TestUsersGetRefusesBadFilters(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, query := range []string{
+		"nickname[bogus]=rob",
+		"nickname[prefix=rob",
+		"password[eq]=secret",
+		"[eq]=rob",
+		"created_at=2024-01-15T09:30:00Z",
+		"created_at[gte]=yesterday",
+		"created_at[not_gt]=-1h",
+		"created_at[icontains]=2024",
+		"email_verified[not_eq]=true",
+		"email_verified=yes",
+	} {
+		w := serveWithToken(t, us, "GET", "/users?"+url.PathEscape(query), "", "")
+
+		expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+	}
+}
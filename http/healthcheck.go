@@ -4,17 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 )
 
 type healthchecker struct {
 	callback chan func()
+	gauges   map[string]func() (int, error)
 	statuses map[string]int
 }
 
 func newHealthchecker() *healthchecker {
 	hc := &healthchecker{
 		callback: make(chan func()),
+		gauges:   make(map[string]func() (int, error)),
 		statuses: make(map[string]int),
 	}
 
@@ -36,31 +39,58 @@ func (hc *healthchecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[%s] GET /healthcheck: getting healthcheck", sender)
 
 	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeProblem(w, r, newProblem(http.StatusMethodNotAllowed, "this endpoint only allows GET"))
 		return
 	}
 
-	ch := make(chan []byte)
+	ch := make(chan map[string]int)
 
 	hc.callback <- func() {
-		snapshot, err := json.Marshal(hc.statuses)
-		if err != nil {
-			log.Printf("[%s] GET /healthcheck: unable to statuses users %q", sender, err.Error())
+		ch <- maps.Clone(hc.statuses)
+	}
 
-			w.WriteHeader(http.StatusInternalServerError)
+	statuses := <-ch
 
+	/* gauges are measured outside of the goroutine as they may be slow */
+	for key, measure := range hc.gauges {
+		value, err := measure()
+		if err != nil {
+			log.Printf("[%s] GET /healthcheck: unable to measure %q: %s", sender, key, err.Error())
+
+			writeProblem(w, r, newProblem(http.StatusInternalServerError, "unable to measure "+key))
 			return
 		}
 
-		log.Printf("[%s] GET /healthcheck: got healthcheck", sender)
-		ch <- snapshot
+		statuses[key] = value
+	}
+
+	snapshot, err := json.Marshal(statuses)
+	if err != nil {
+		log.Printf("[%s] GET /healthcheck: unable to marshal statuses %q", sender, err.Error())
+
+		writeProblem(w, r, newProblem(http.StatusInternalServerError, "unable to marshal statuses"))
+		return
 	}
 
-	w.Write(<-ch)
+	log.Printf("[%s] GET /healthcheck: got healthcheck", sender)
+	w.Write(snapshot)
+}
+
+/*
+Report the current value of measure as key in every healthcheck,
+e.g. how many accounts are locked. Gauges must be added before the
+healthchecker is served.
+*/
+func (hc *healthchecker) gauge(key string, measure func() (int, error)) {
+	hc.gauges[key] = measure
 }
 
-func (hc *healthchecker) increment(status int) {
+/*
+Count another of key, which is either a HTTP status code returned or
+the name of an event such as "authenticate.failure".
+*/
+func (hc *healthchecker) increment(key any) {
 	hc.callback <- func() {
-		hc.statuses[fmt.Sprint(status)] += 1
+		hc.statuses[fmt.Sprint(key)] += 1
 	}
 }
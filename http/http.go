@@ -1,12 +1,15 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,13 +20,45 @@ type datetime struct {
 }
 
 type UserService struct {
-	callback chan func()
+	admin    []byte
+	clock    func() time.Time
+	cursors  *cursorSigner
 	hc       *healthchecker
 	mux      *http.ServeMux
-	users    map[string]*user
+	notifier Notifier
+	store    Store
+	throttle *addressThrottle
+	tokens   *tokenSigner
 }
 
+/* Option configures a UserService as it is created. */
+type Option func(us *UserService) error
+
+/*
+user is the internal model of a user, as kept in a Store. Its JSON is
+how a Store persists it, it is never sent to clients - see publicUser.
+*/
 type user struct {
+	CreatedAt datetime  `json:"created_at"`
+	Country   string    `json:"country"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name"`
+	ID        string    `json:"id"`
+	LastName  string    `json:"last_name"`
+	Nickname  string    `json:"nickname"`
+	Password  string    `json:"password"`
+	UpdatedAt datetime  `json:"updated_at"`
+	Auth      authState `json:"auth"`
+
+	EmailVerified bool `json:"email_verified"`
+}
+
+/*
+publicUser is how a user is represented in responses. It is kept
+apart from user, the internal model, so that credentials and anything
+else added to user are never serialized to clients by accident.
+*/
+type publicUser struct {
 	CreatedAt datetime `json:"created_at"`
 	Country   string   `json:"country"`
 	Email     string   `json:"email"`
@@ -31,8 +66,10 @@ type user struct {
 	ID        string   `json:"id"`
 	LastName  string   `json:"last_name"`
 	Nickname  string   `json:"nickname"`
-	Password  string   `json:"password"`
 	UpdatedAt datetime `json:"updated_at"`
+
+	/* a string like every other attribute, i.e. "true" or "false" */
+	EmailVerified bool `json:"email_verified,string"`
 }
 
 const DtLayout = "2006-01-02T15:04.05Z"
@@ -45,14 +82,21 @@ func NewDatetime() datetime {
 
 /* Marshal the datetime in custom datetime format */
 func (dt *datetime) MarshalJSON() ([]byte, error) {
-	b := fmt.Sprintf(`"%s"`, dt.tm.Format(DtLayout))
+	b := fmt.Sprintf(`"%s"`, dt.tm.UTC().Format(DtLayout))
 
 	return []byte(b), nil
 }
 
-/* Marshal the datetime in custom datetime format */
+/* Unmarshal the datetime from custom datetime format */
 func (dt *datetime) UnmarshalJSON(b []byte) error {
-	tm, err := time.Parse(DtLayout, string(b))
+	var s string
+
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	tm, err := time.Parse(DtLayout, s)
 	if err != nil {
 		return err
 	}
@@ -62,158 +106,425 @@ func (dt *datetime) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-/* Create a new UserService. */
-func NewUserService() (*UserService, error) {
-	us := &UserService{
-		callback: make(chan func()),
-		hc:       newHealthchecker(),
-		mux:      http.NewServeMux(),
-		users:    make(map[string]*user),
-	}
+/*
+Marshal the user as a Store persists it, with its times to the
+nanosecond in RFC 3339 rather than the DtLayout of responses, which is
+only to the second. Users created in the same second would otherwise
+come back from the wal or a snapshot in another order, and cursors
+made before a restart would no longer point at them.
+*/
+func (u *user) MarshalJSON() ([]byte, error) {
+	type plain user
+
+	return json.Marshal(&struct {
+		*plain
+		CreatedAt string `json:"created_at"`
+		UpdatedAt string `json:"updated_at"`
+	}{
+		plain:     (*plain)(u),
+		CreatedAt: u.CreatedAt.tm.UTC().Format(time.RFC3339Nano),
+		UpdatedAt: u.UpdatedAt.tm.UTC().Format(time.RFC3339Nano),
+	})
+}
 
-	us.mux.Handle("/healthcheck", us.hc)
-	us.mux.Handle("/users", us)
+/*
+Unmarshal a user as a Store persists it. Times saved before they were
+kept to the nanosecond are in DtLayout.
+*/
+func (u *user) UnmarshalJSON(b []byte) error {
+	type plain user
 
-	go func() {
-		for {
-			(<-us.callback)()
+	persisted := struct {
+		*plain
+		CreatedAt string `json:"created_at"`
+		UpdatedAt string `json:"updated_at"`
+	}{plain: (*plain)(u)}
+
+	err := json.Unmarshal(b, &persisted)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range []struct {
+		value string
+		tm    *time.Time
+	}{
+		{persisted.CreatedAt, &u.CreatedAt.tm},
+		{persisted.UpdatedAt, &u.UpdatedAt.tm},
+	} {
+		tm, err := time.Parse(time.RFC3339Nano, t.value)
+		if err != nil {
+			tm, err = time.Parse(DtLayout, t.value)
+		}
+		if err != nil {
+			return err
 		}
-	}()
 
-	return us, nil
+		*t.tm = tm
+	}
+
+	return nil
 }
 
-/* Add a new user to the in-memory storage mechanism. */
-func (us *UserService) addUser(user *user) {
-	us.callback <- func() {
-		us.users[user.ID] = user
+/*
+Keep the users of the UserService in the directory dir so they survive
+restarts, taking a snapshot of them every snapshotInterval.
+*/
+func WithDataDir(dir string, snapshotInterval time.Duration) Option {
+	return func(us *UserService) error {
+		store, err := NewDurableMemoryStore(dir, snapshotInterval)
+		if err != nil {
+			return err
+		}
+
+		us.store = store
+
+		return nil
 	}
 }
 
-/* Delete a user from the in-memory storage mechanism. */
-func (us *UserService) deleteUser(id string) bool {
-	ch := make(chan bool)
+/* Keep the users of the UserService in the SQL database file at path. */
+func WithDatabase(path string) Option {
+	return func(us *UserService) error {
+		store, err := NewSQLStore(path)
+		if err != nil {
+			return err
+		}
+
+		us.store = store
 
-	us.callback <- func() {
-		_, ok := us.users[id]
+		return nil
+	}
+}
 
-		if ok {
-			delete(us.users, id)
-		}
+/* Set the storage mechanism used by the UserService. */
+func WithStore(store Store) Option {
+	return func(us *UserService) error {
+		us.store = store
 
-		ch <- ok
+		return nil
 	}
+}
+
+/* Make the clock of the UserService now, so time can be controlled in tests. */
+func WithClock(clock func() time.Time) Option {
+	return func(us *UserService) error {
+		us.clock = clock
 
-	return <-ch
+		return nil
+	}
 }
 
 /*
-Get a filtered list of the Users from the in-memory storage
-mechanism.
+Create a new UserService. Unless an Option says otherwise users are
+kept in the in-memory storage mechanism.
 */
-func (us *UserService) getUsers(filters map[string]string) []*user {
-	ch := make(chan []*user)
-
-	us.callback <- func() {
-		users := []*user{}
-		for _, user := range us.users {
-			current := map[string]string{
-				"country":    user.Country,
-				"email":      user.Email,
-				"first_name": user.FirstName,
-				"last_name":  user.LastName,
-				"nickname":   user.Nickname,
-			}
-
-			add := true
-			for key, filter := range filters {
-				if current[key] != filter {
-					add = false
-					break
-				}
-			}
-
-			if !add {
-				continue
-			}
-
-			users = append(users, user)
+func NewUserService(options ...Option) (*UserService, error) {
+	us := &UserService{
+		clock:    time.Now,
+		hc:       newHealthchecker(),
+		mux:      http.NewServeMux(),
+		throttle: newAddressThrottle(),
+	}
+
+	for _, option := range options {
+		err := option(us)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if us.cursors == nil {
+		cursors, err := newCursorSigner()
+		if err != nil {
+			return nil, err
 		}
 
-		ch <- users
+		us.cursors = cursors
 	}
 
-	return <-ch
+	if us.store == nil {
+		us.store = NewMemoryStore()
+	}
+
+	if us.notifier == nil {
+		us.notifier = logNotifier{}
+	}
+
+	us.hc.gauge("locked.accounts", us.lockedAccounts)
+	us.hc.gauge("locked.addresses", us.lockedAddresses)
+
+	us.mux.HandleFunc("/", us.notFound)
+
+	us.route("/healthcheck", map[string]http.Handler{
+		http.MethodGet: us.hc,
+	})
+
+	us.route("/users", map[string]http.Handler{
+		http.MethodGet:  http.HandlerFunc(us.get),
+		http.MethodPost: http.HandlerFunc(us.post),
+	})
+
+	us.route("/users/export", map[string]http.Handler{
+		http.MethodGet: http.HandlerFunc(us.export),
+	})
+
+	us.route("/users/{id}", map[string]http.Handler{
+		http.MethodDelete: us.requireSelf(us.delete),
+		http.MethodGet:    http.HandlerFunc(us.getUser),
+		http.MethodPatch:  us.requireSelf(us.patch),
+	})
+
+	us.route("/users/authenticate", map[string]http.Handler{
+		http.MethodPost: http.HandlerFunc(us.authenticate),
+	})
+
+	us.route("/users/verify-email", map[string]http.Handler{
+		http.MethodPost: http.HandlerFunc(us.verifyEmail),
+	})
+
+	us.route("/users/password-reset", map[string]http.Handler{
+		http.MethodPost: http.HandlerFunc(us.passwordReset),
+	})
+
+	us.route("/users/password-reset/confirm", map[string]http.Handler{
+		http.MethodPost: http.HandlerFunc(us.passwordResetConfirm),
+	})
+
+	if us.tokens != nil {
+		/* without sessions anyone could enrol someone else, so there's no MFA */
+		us.route("/users/{id}/mfa/totp", map[string]http.Handler{
+			http.MethodPost: us.requireSelf(us.enrolTOTP),
+		})
+
+		us.route("/users/{id}/mfa/totp/confirm", map[string]http.Handler{
+			http.MethodPost: us.requireSelf(us.confirmTOTP),
+		})
+
+		us.route("/users/token/refresh", map[string]http.Handler{
+			http.MethodPost: http.HandlerFunc(us.refresh),
+		})
+
+		us.route("/users/token/revoke", map[string]http.Handler{
+			http.MethodPost: http.HandlerFunc(us.revoke),
+		})
+	}
+
+	if us.admin != nil {
+		us.route("/users/import", map[string]http.Handler{
+			http.MethodPost: us.requireAdmin(us.importUsers),
+		})
+
+		us.route("/users/{id}/unlock", map[string]http.Handler{
+			http.MethodPost: us.requireAdmin(us.unlock),
+		})
+	}
+
+	return us, nil
 }
 
-/* Modify a user from the in-memory storage mechanism. */
-func (us *UserService) modifyUser(id string, data map[string]string) bool {
-	ch := make(chan bool)
+/* Get the representation of the user returned to clients. */
+func (u *user) public() *publicUser {
+	return &publicUser{
+		CreatedAt: u.CreatedAt,
+		Country:   u.Country,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		ID:        u.ID,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		UpdatedAt: u.UpdatedAt,
+
+		EmailVerified: u.EmailVerified,
+	}
+}
 
-	us.callback <- func() {
-		user, ok := us.users[id]
-		if !ok {
-			ch <- false
-			return
-		}
+/* Make a copy of the user that can be modified independently. */
+func (u *user) clone() *user {
+	c := *u
+	c.Auth = u.Auth.clone()
 
-		attributes := []struct {
-			key    string
-			target *string
-		}{
-			{"country", &(user.Country)},
-			{"email", &(user.Email)},
-			{"first_name", &(user.FirstName)},
-			{"last_name", &(user.LastName)},
-			{"nickname", &(user.Nickname)},
-			{"password", &(user.Password)},
-		}
+	return &c
+}
 
-		modified := false
-		for _, attribute := range attributes {
-			value, ok := data[attribute.key]
+/* Get the value of the attribute with the JSON name key, as it's filtered on. */
+func (u *user) attribute(key string) string {
+	switch key {
+	case "country":
+		return u.Country
+	case "email":
+		return u.Email
+	case "email_verified":
+		return strconv.FormatBool(u.EmailVerified)
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "nickname":
+		return u.Nickname
+	}
 
-			if !ok {
-				continue
-			}
+	return ""
+}
 
-			*(attribute.target) = value
-			modified = true
+/* Does the user match each of the filters? */
+func (u *user) matches(filters []*filter) bool {
+	for _, f := range filters {
+		if !f.matches(u) {
+			return false
 		}
+	}
+
+	return true
+}
 
-		if modified {
-			user.UpdatedAt.tm = time.Now()
+/*
+Set the user's attributes to the values in data, keyed by the
+attribute's JSON name, as of now. Returns whether anything was
+modified.
+*/
+func (u *user) modify(data map[string]string, now time.Time) bool {
+	attributes := []struct {
+		key    string
+		target *string
+	}{
+		{"country", &(u.Country)},
+		{"email", &(u.Email)},
+		{"first_name", &(u.FirstName)},
+		{"last_name", &(u.LastName)},
+		{"nickname", &(u.Nickname)},
+		{"password", &(u.Password)},
+	}
+
+	modified := false
+	for _, attribute := range attributes {
+		value, ok := data[attribute.key]
+
+		if !ok {
+			continue
 		}
 
-		ch <- true
+		*(attribute.target) = value
+		modified = true
 	}
 
-	return <-ch
+	if modified {
+		u.UpdatedAt.tm = now
+	}
+
+	return modified
 }
 
-/* Serves HTTP on the requested addr */
-func (us *UserService) ListenAndServe(addr string) error {
-	return http.ListenAndServe(addr, us.mux)
+/* Release the resources held by the UserService's Store. */
+func (us *UserService) Close() error {
+	return us.store.Close()
 }
 
-/* Handler method ServeHTTP for UserService. */
+/*
+How long ListenAndServe waits for the requests in flight to finish once
+it has been told to stop.
+*/
+const shutdownTimeout = 30 * time.Second
+
+/*
+Serves HTTP on the requested addr until ctx is done, then stops taking
+requests and waits up to shutdownTimeout for those in flight. It
+returns nil once they're finished, so the UserService can be closed.
+*/
+func (us *UserService) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: us}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return srv.Shutdown(shutdown)
+}
+
+/*
+Handler method ServeHTTP for UserService. Requests are routed by
+their method and path to the handler for that endpoint.
+*/
 func (us *UserService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodDelete:
-		us.delete(w, r)
-	case http.MethodGet:
-		us.get(w, r)
-	case http.MethodPatch:
-		us.patch(w, r)
-	case http.MethodPost:
-		us.post(w, r)
+	us.mux.ServeHTTP(w, withRequestID(w, r))
+}
+
+/*
+The standard HTTP methods, less HEAD which is routed with GET. Each
+one an endpoint doesn't support is answered with 405 Method Not
+Allowed.
+*/
+var routedMethods = []string{
+	http.MethodConnect,
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodOptions,
+	http.MethodPatch,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodTrace,
+}
+
+/*
+Register the handler for each method of the endpoint at path, and
+answer the rest of routedMethods with 405 Method Not Allowed.
+
+The unsupported methods are registered one by one rather than with a
+pattern for every method, as that would conflict with the methods of
+/users/{id} for a fixed path such as /users/authenticate.
+*/
+func (us *UserService) route(path string, handlers map[string]http.Handler) {
+	allowed := []string{}
+	for method, handler := range handlers {
+		us.mux.Handle(method+" "+path, handler)
+
+		allowed = append(allowed, method)
+		if method == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+
+	slices.Sort(allowed)
+
+	notAllowed := us.methodNotAllowed(allowed...)
+	for _, method := range routedMethods {
+		_, ok := handlers[method]
+		if !ok {
+			us.mux.Handle(method+" "+path, notAllowed)
+		}
 	}
 }
 
+/*
+Make a handler for the methods an endpoint doesn't support, which
+lists those it does in the Allow header.
+*/
+func (us *UserService) methodNotAllowed(allowed ...string) http.Handler {
+	allow := strings.Join(allowed, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] %s %s: method not allowed", r.RemoteAddr, r.Method, r.URL.Path)
+
+		w.Header().Set("Allow", allow)
+
+		us.fail(w, r, http.StatusMethodNotAllowed, "this endpoint only allows "+allow)
+	})
+}
+
 func (us *UserService) delete(w http.ResponseWriter, r *http.Request) {
 	sender := r.RemoteAddr
 
-	id := filepath.Base(r.URL.Path)
+	id := r.PathValue("id")
 
 	log.Printf("[%s] DELETE /users: attempting to delete user %q", sender, id)
 
@@ -221,17 +532,20 @@ func (us *UserService) delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("[%s] DELETE /users: %q is not a valid user id", sender, id)
 
-		us.hc.increment(http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
 		return
 	}
 
-	ok := us.deleteUser(id)
-	if !ok {
+	err = us.store.Delete(id)
+	if errors.Is(err, ErrNotFound) {
 		log.Printf("[%s] DELETE /users: %q is not a user", sender, id)
 
-		us.hc.increment(http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if err != nil {
+		log.Printf("[%s] DELETE /users: unable to delete %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to delete the user")
 		return
 	}
 
@@ -246,62 +560,76 @@ func (us *UserService) get(w http.ResponseWriter, r *http.Request) {
 
 	url := r.URL.Query()
 
-	limit := 0
-	for _, value := range url["limit"] {
-		i, err := strconv.Atoi(value)
-		if err != nil {
-			continue
-		}
+	pagination, err := parsePagination(url)
+	if err != nil {
+		log.Printf("[%s] GET /users: %s", sender, err.Error())
 
-		limit = i
-		break
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	page := 0
-	for _, value := range url["page"] {
-		i, err := strconv.Atoi(value)
-		if err != nil {
-			continue
-		}
+	fields, err := parseFields(url)
+	if err != nil {
+		log.Printf("[%s] GET /users: %s", sender, err.Error())
 
-		page = i
-		break
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	filters := map[string]string{}
-	for _, key := range []string{"country", "email", "first_name", "last_name", "nickname"} {
-		query, ok := url[key]
+	filters, err := parseFilters(url, us.clock())
+	if err != nil {
+		log.Printf("[%s] GET /users: %s", sender, err.Error())
 
-		if !ok {
-			continue
-		}
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-		for _, value := range query {
-			filters[key] = value
-		}
+	keys, err := parseSort(url["sort"])
+	if err != nil {
+		log.Printf("[%s] GET /users: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	log.Printf("[%s] GET /users: attempting to get users", sender)
 
-	users := us.getUsers(filters)
+	users, err := us.store.List(filters)
+	if err != nil {
+		log.Printf("[%s] GET /users: unable to get users %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to get users")
 
-	if limit != 0 {
-		start := (page * limit)
-		end := start + limit
-		users = users[start:end]
+		return
 	}
 
-	body, err := json.Marshal(users)
+	sortUsers(users, keys)
+
+	response, err := us.paginate(r, users, keys, pagination, fields)
+	if errors.Is(err, errInvalidCursor) {
+		log.Printf("[%s] GET /users: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, "the cursor is not valid, or is for another sort")
+		return
+	} else if err != nil {
+		log.Printf("[%s] GET /users: unable to paginate users %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to paginate users")
+		return
+	}
+
+	setPageLinks(w, r, response)
+
+	body, err := json.Marshal(response)
 	if err != nil {
 		log.Printf("[%s] GET /users: unable to marshal users %q", sender, err.Error())
 
-		us.hc.increment(http.StatusInternalServerError)
-		w.WriteHeader(http.StatusInternalServerError)
+		us.fail(w, r, http.StatusInternalServerError, "unable to marshal users")
 
 		return
 	}
 
-	if len(users) == 0 {
+	if len(response.Users) == 0 {
 		us.hc.increment(http.StatusNoContent)
 		w.WriteHeader(http.StatusNoContent)
 	}
@@ -310,10 +638,60 @@ func (us *UserService) get(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+func (us *UserService) getUser(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	id := r.PathValue("id")
+
+	log.Printf("[%s] GET /users/{id}: attempting to get user %q", sender, id)
+
+	err := uuid.Validate(id)
+	if err != nil {
+		log.Printf("[%s] GET /users/{id}: %q is not a valid user id", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query())
+	if err != nil {
+		log.Printf("[%s] GET /users/{id}: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := us.store.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("[%s] GET /users/{id}: %q is not a user", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if err != nil {
+		log.Printf("[%s] GET /users/{id}: unable to get %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to get the user")
+		return
+	}
+
+	body, err := json.Marshal(user.project(fields))
+	if err != nil {
+		log.Printf("[%s] GET /users/{id}: unable to marshal user %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to marshal the user")
+		return
+	}
+
+	log.Printf("[%s] GET /users/{id}: got %q", sender, id)
+
+	us.hc.increment(http.StatusOK)
+	w.Write(body)
+}
+
 func (us *UserService) patch(w http.ResponseWriter, r *http.Request) {
 	sender := r.RemoteAddr
 
-	id := filepath.Base(r.URL.Path)
+	id := r.PathValue("id")
 
 	log.Printf("[%s] PATCH /users: attempting to patch user %q", sender, id)
 
@@ -321,8 +699,7 @@ func (us *UserService) patch(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("[%s] PATCH /users: %q is not a valid user id", sender, id)
 
-		us.hc.increment(http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
 		return
 	}
 
@@ -331,31 +708,89 @@ func (us *UserService) patch(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
 		log.Printf("[%s] PATCH /users: no body sent with %q", sender, id)
 
-		us.hc.increment(http.StatusBadRequest)
-		w.WriteHeader(http.StatusBadRequest)
+		us.fail(w, r, http.StatusBadRequest, "expected a request body")
+		return
+	}
+
+	err = decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
 		return
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		log.Printf("[%s] PATCH /users: unable to decode JSON on %q: %s", sender, id, err.Error())
 
-		us.hc.increment(http.StatusBadRequest)
-		w.WriteHeader(http.StatusBadRequest)
+		us.fail(w, r, http.StatusBadRequest, "the request body is not a JSON object of strings")
 		return
 	}
 
-	ok := us.modifyUser(id, data)
-	if !ok {
+	errs := validateUser(data, true)
+	if len(errs) > 0 {
+		log.Printf("[%s] PATCH /users: unable to patch as attributes of %q were invalid", sender, id)
+
+		us.invalid(w, r, errs)
+		return
+	}
+
+	password, ok := data["password"]
+	if ok {
+		data["password"], err = hashPassword(password)
+		if err != nil {
+			log.Printf("[%s] PATCH /users: unable to hash password of %q: %s", sender, id, err.Error())
+
+			us.fail(w, r, http.StatusInternalServerError, "unable to hash the password")
+			return
+		}
+	}
+
+	now := us.clock()
+
+	token, verification, err := newEmailVerification(id, now)
+	if err != nil {
+		log.Printf("[%s] PATCH /users: unable to make email verification for %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to make an email verification")
+		return
+	}
+
+	emailChanged := false
+
+	patched, err := us.store.Update(id, func(user *user) error {
+		email, ok := data["email"]
+		emailChanged = ok && email != user.Email
+
+		user.modify(data, now)
+
+		/* a new email has to be verified all over again */
+		if emailChanged {
+			user.EmailVerified = false
+			user.Auth.EmailVerification = verification
+		}
+
+		return nil
+	})
+	var conflict *conflictError
+	if errors.Is(err, ErrNotFound) {
 		log.Printf("[%s] PATCH /users: %q is not a user", sender, id)
 
-		us.hc.increment(http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if errors.As(err, &conflict) {
+		us.conflict(w, r, conflict)
+		return
+	} else if err != nil {
+		log.Printf("[%s] PATCH /users: unable to patch %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to patch the user")
 		return
 	}
 
 	log.Printf("[%s] PATCH /users: patched %q", sender, id)
 
+	if emailChanged {
+		us.sendEmailVerification(id, patched.Email, token, now)
+	}
+
 	us.hc.increment(http.StatusNoContent)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -368,29 +803,76 @@ func (us *UserService) post(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]string{}
 
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
 	if err != nil {
 		log.Printf("[%s] POST /users: unable to decode JSON on %q: %s", sender, id, err.Error())
 
-		us.hc.increment(http.StatusBadRequest)
-		w.WriteHeader(http.StatusBadRequest)
+		us.fail(w, r, http.StatusBadRequest, "the request body is not a JSON object of strings")
 		return
 	}
 
-	expected := []string{"country", "email", "first_name", "last_name", "nickname", "password"}
-	for _, key := range expected {
-		_, ok := data[key]
-		if !ok {
-			log.Printf("[%s] POST /users: unable to add as attribute %q was missing on %q", sender, id, key)
+	errs := validateUser(data, false)
+	if len(errs) > 0 {
+		log.Printf("[%s] POST /users: unable to add as attributes of %q were invalid", sender, id)
 
-			us.hc.increment(http.StatusBadRequest)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+		us.invalid(w, r, errs)
+		return
+	}
+
+	password, err := hashPassword(data["password"])
+	if err != nil {
+		log.Printf("[%s] POST /users: unable to hash password of %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to hash the password")
+		return
+	}
+
+	now := us.clock()
+
+	user, token, err := newUser(id, data, password, now)
+	if err != nil {
+		log.Printf("[%s] POST /users: unable to make email verification for %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to make an email verification")
+		return
+	}
+
+	var conflict *conflictError
+
+	err = us.store.Create(user)
+	if errors.As(err, &conflict) {
+		us.conflict(w, r, conflict)
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users: unable to add %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to add the user")
+		return
 	}
 
-	now := time.Now()
-	user := user{
+	log.Printf("[%s] POST /users: added %q", sender, id)
+
+	us.sendEmailVerification(id, user.Email, token, now)
+
+	us.hc.increment(http.StatusCreated)
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+Make a user from attributes that have already been validated and the
+hash of their password, with the token that verifies their email.
+*/
+func newUser(id string, data map[string]string, password string, now time.Time) (*user, string, error) {
+	token, verification, err := newEmailVerification(id, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &user{
 		CreatedAt: datetime{tm: now},
 		Country:   data["country"],
 		Email:     data["email"],
@@ -398,13 +880,10 @@ func (us *UserService) post(w http.ResponseWriter, r *http.Request) {
 		ID:        id,
 		LastName:  data["last_name"],
 		Nickname:  data["nickname"],
-		Password:  data["password"],
+		Password:  password,
 		UpdatedAt: datetime{tm: now},
+		Auth:      authState{EmailVerification: verification},
 	}
 
-	us.addUser(&user)
-	log.Printf("[%s] POST /users: added %q", sender, id)
-
-	us.hc.increment(http.StatusCreated)
-	w.WriteHeader(http.StatusCreated)
+	return user, token, nil
 }
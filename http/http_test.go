@@ -2,10 +2,13 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,7 +35,7 @@ func TestLimitAndPageUserCount(t *testing.T) {
 
 	for i := 0; i < max; i++ {
 		data := map[string]string{
-			"country":    "UK",
+			"country":    "GB",
 			"email":      fmt.Sprintf("user_%d@bob.com", i),
 			"first_name": "User",
 			"last_name":  fmt.Sprintf("%d", i),
@@ -68,7 +71,7 @@ func TestLimitAndPageUserCount(t *testing.T) {
 	w := httptest.NewRecorder()
 	us.ServeHTTP(w, get)
 
-	resp_body := []map[string]string{}
+	resp_body := userList{}
 
 	err = json.NewDecoder(w.Body).Decode(&resp_body)
 	if err != nil {
@@ -99,7 +102,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 
 	data := []map[string]string{
 		{
-			"country":    "UK",
+			"country":    "GB",
 			"email":      "alice@bob.com",
 			"first_name": "Alice",
 			"last_name":  "Bob",
@@ -107,7 +110,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 			"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
 		},
 		{
-			"country":    "USA",
+			"country":    "US",
 			"email":      "robbob@bob.com",
 			"first_name": "Robert",
 			"last_name":  "Bob",
@@ -115,7 +118,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 			"password":   "d4b7404ebda22784cb763ad4f3441d9df589f4822aadbb3c22c6bf6c6d808cf3",
 		},
 		{
-			"country":    "Canada/Australia",
+			"country":    "CA",
 			"email":      "rob@bob.com",
 			"first_name": "Rob",
 			"last_name":  "Pike",
@@ -123,7 +126,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 			"password":   "f9c33006f81d188494d2b108a7977ec2710d9fe6c7d33b1b01792eac812d5069",
 		},
 		{
-			"country":    "USA",
+			"country":    "US",
 			"email":      "ken@bob.com",
 			"first_name": "Ken",
 			"last_name":  "Thompson",
@@ -131,7 +134,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 			"password":   "b3bb4cd67f11e1f6350a5792c8a0f91c2e7920ab93ccd7e964d97d79ad9f8270",
 		},
 		{
-			"country":    "Switzerland",
+			"country":    "CH",
 			"email":      "robert@bob.com",
 			"first_name": "Robert",
 			"last_name":  "Griesemer",
@@ -155,7 +158,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 	}
 
 	filters := map[string]string{
-		"country":    "USA",
+		"country":    "US",
 		"email":      "robbob@bob.com",
 		"first_name": "Robert",
 		"last_name":  "Bob",
@@ -179,7 +182,7 @@ func TestGetFiltersFilterUsers(t *testing.T) {
 		w := httptest.NewRecorder()
 		us.ServeHTTP(w, get)
 
-		resp_body := []map[string]string{}
+		resp_body := userList{}
 
 		err = json.NewDecoder(w.Body).Decode(&resp_body)
 		if err != nil {
@@ -210,7 +213,7 @@ func TestPatchModifiesUpdatedAt(t *testing.T) {
 	}
 
 	debut := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -240,7 +243,7 @@ func TestPatchModifiesUpdatedAt(t *testing.T) {
 	created_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(created_get_resp, created_get_req)
 
-	created_get_body := []map[string]string{}
+	created_get_body := userList{}
 
 	err = json.NewDecoder(created_get_resp.Body).Decode(&created_get_body)
 	if err != nil {
@@ -255,7 +258,7 @@ func TestPatchModifiesUpdatedAt(t *testing.T) {
 	url := fmt.Sprintf("/users/%s", id)
 
 	finale := map[string]string{
-		"country":    "USA",
+		"country":    "US",
 		"email":      "ken@bob.com",
 		"first_name": "Ken",
 		"last_name":  "Thompson",
@@ -286,7 +289,7 @@ func TestPatchModifiesUpdatedAt(t *testing.T) {
 	patched_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(patched_get_resp, patched_get_req)
 
-	patched_get_body := []map[string]string{}
+	patched_get_body := userList{}
 
 	err = json.NewDecoder(patched_get_resp.Body).Decode(&patched_get_body)
 	if err != nil {
@@ -300,6 +303,36 @@ func TestPatchModifiesUpdatedAt(t *testing.T) {
 	}
 }
 
+/*
+TestPatchUsesClock: Given the UserService has a clock when I modify a
+User with PATCH then their updated_at is the time of the clock.
+*/
+func TestPatchUsesClock(t *testing.T) {
+	now := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	us, err := NewUserService(WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+
+	now = now.Add(time.Hour)
+
+	status := serveWithToken(t, us, "PATCH", "/users/"+id, "", `{"first_name":"Alicia"}`).Result().StatusCode
+	if status != http.StatusNoContent {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusNoContent)
+	}
+
+	expected := now.Format(DtLayout)
+
+	if got := getUsers(t, us, "/users")[0]["updated_at"]; got != expected {
+		t.Fatalf("expected updated_at %q but got %q", expected, got)
+	}
+}
+
 /*
 TestPatchModifiesAttributes: Given I have created a User and
 modified any of the following attributes: country, email, first_name,
@@ -315,7 +348,7 @@ func TestPatchModifiesAttributes(t *testing.T) {
 	}
 
 	debut := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -345,7 +378,7 @@ func TestPatchModifiesAttributes(t *testing.T) {
 	created_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(created_get_resp, created_get_req)
 
-	created_get_body := []map[string]string{}
+	created_get_body := userList{}
 
 	err = json.NewDecoder(created_get_resp.Body).Decode(&created_get_body)
 	if err != nil {
@@ -358,7 +391,7 @@ func TestPatchModifiesAttributes(t *testing.T) {
 	/* patch each attribute on the user and check if it has updated */
 
 	finale := map[string]string{
-		"country":    "USA",
+		"country":    "US",
 		"email":      "ken@bob.com",
 		"first_name": "Ken",
 		"last_name":  "Thompson",
@@ -398,7 +431,7 @@ func TestPatchModifiesAttributes(t *testing.T) {
 		patched_get_resp := httptest.NewRecorder()
 		us.ServeHTTP(patched_get_resp, patched_get_req)
 
-		patched_get_body := []map[string]string{}
+		patched_get_body := userList{}
 
 		err = json.NewDecoder(patched_get_resp.Body).Decode(&patched_get_body)
 		if err != nil {
@@ -409,7 +442,18 @@ func TestPatchModifiesAttributes(t *testing.T) {
 
 		current := patched_get_body[0][attribute]
 
-		if (current == stale) || (current != fresh) {
+		/* passwords are never returned, so check the stored hash */
+
+		if attribute == "password" {
+			stored, err := us.store.Get(id)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			current = stored.Password
+		}
+
+		if sameAttribute(attribute, stale, current) || !sameAttribute(attribute, fresh, current) {
 			t.Fatalf("expected attribute %q to be modified from %q to %q but got %q", attribute, stale, fresh, current)
 		}
 	}
@@ -428,7 +472,7 @@ func TestPostAndPatchStatusIsNoContent(t *testing.T) {
 	}
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -456,7 +500,7 @@ func TestPostAndPatchStatusIsNoContent(t *testing.T) {
 	get_resp := httptest.NewRecorder()
 	us.ServeHTTP(get_resp, get_req)
 
-	get_body := []map[string]string{}
+	get_body := userList{}
 
 	err = json.NewDecoder(get_resp.Body).Decode(&get_body)
 	if err != nil {
@@ -525,7 +569,7 @@ func TestPostAndDeleteStatusIsNoContent(t *testing.T) {
 	}
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -553,7 +597,7 @@ func TestPostAndDeleteStatusIsNoContent(t *testing.T) {
 	get_resp := httptest.NewRecorder()
 	us.ServeHTTP(get_resp, get_req)
 
-	get_body := []map[string]string{}
+	get_body := userList{}
 
 	err = json.NewDecoder(get_resp.Body).Decode(&get_body)
 	if err != nil {
@@ -620,7 +664,7 @@ func TestPostAndDeleteRemovesUserFromGet(t *testing.T) {
 	/* create user */
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -650,7 +694,7 @@ func TestPostAndDeleteRemovesUserFromGet(t *testing.T) {
 	created_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(created_get_resp, created_get_req)
 
-	created_get_body := []map[string]string{}
+	created_get_body := userList{}
 
 	err = json.NewDecoder(created_get_resp.Body).Decode(&created_get_body)
 	if err != nil {
@@ -686,7 +730,7 @@ func TestPostAndDeleteRemovesUserFromGet(t *testing.T) {
 	deleted_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(deleted_get_resp, deleted_get_req)
 
-	deleted_get_body := []map[string]string{}
+	deleted_get_body := userList{}
 
 	err = json.NewDecoder(deleted_get_resp.Body).Decode(&deleted_get_body)
 	if err != nil {
@@ -715,7 +759,7 @@ func TestMultiplePostAndDeleteRemovesUserFromGet(t *testing.T) {
 
 	data := map[string](map[string]string){
 		"rob": {
-			"country":    "Canada/Australia",
+			"country":    "CA",
 			"email":      "rob@bob.com",
 			"first_name": "Rob",
 			"last_name":  "Pike",
@@ -723,7 +767,7 @@ func TestMultiplePostAndDeleteRemovesUserFromGet(t *testing.T) {
 			"password":   "f9c33006f81d188494d2b108a7977ec2710d9fe6c7d33b1b01792eac812d5069",
 		},
 		"ken": {
-			"country":    "USA",
+			"country":    "US",
 			"email":      "ken@bob.com",
 			"first_name": "Ken",
 			"last_name":  "Thompson",
@@ -731,7 +775,7 @@ func TestMultiplePostAndDeleteRemovesUserFromGet(t *testing.T) {
 			"password":   "b3bb4cd67f11e1f6350a5792c8a0f91c2e7920ab93ccd7e964d97d79ad9f8270",
 		},
 		"griesemer": {
-			"country":    "Switzerland",
+			"country":    "CH",
 			"email":      "robert@bob.com",
 			"first_name": "Robert",
 			"last_name":  "Griesemer",
@@ -764,7 +808,7 @@ func TestMultiplePostAndDeleteRemovesUserFromGet(t *testing.T) {
 	created_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(created_get_resp, created_get_req)
 
-	created_get_body := []map[string]string{}
+	created_get_body := userList{}
 
 	err = json.NewDecoder(created_get_resp.Body).Decode(&created_get_body)
 	if err != nil {
@@ -795,7 +839,7 @@ func TestMultiplePostAndDeleteRemovesUserFromGet(t *testing.T) {
 	deleted_get_resp := httptest.NewRecorder()
 	us.ServeHTTP(deleted_get_resp, deleted_get_req)
 
-	deleted_get_body := []map[string]string{}
+	deleted_get_body := userList{}
 
 	err = json.NewDecoder(deleted_get_resp.Body).Decode(&deleted_get_body)
 	if err != nil {
@@ -823,7 +867,7 @@ func TestAddedStatusUsersGet(t *testing.T) {
 	}
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -887,8 +931,8 @@ func TestEmptyStatusUsersGet(t *testing.T) {
 TestMultiUsersGet: Given I have created multiple Users when I call
 the GET method then the Users I have created will return with the
 following fields populated: created_at, country, email, first_name,
-last_name, nickname, password and updated_at with the values I
-created them with and the types/formats specified in
+last_name, nickname and updated_at with the values I created them
+with and the types/formats specified in
 ./docs/endpoints/users/SCHEMA.md
 */
 func TestMultiUsersGet(t *testing.T) {
@@ -899,7 +943,7 @@ func TestMultiUsersGet(t *testing.T) {
 
 	data := map[string](map[string]string){
 		"rob": {
-			"country":    "Canada/Australia",
+			"country":    "CA",
 			"email":      "rob@bob.com",
 			"first_name": "Rob",
 			"last_name":  "Pike",
@@ -907,7 +951,7 @@ func TestMultiUsersGet(t *testing.T) {
 			"password":   "f9c33006f81d188494d2b108a7977ec2710d9fe6c7d33b1b01792eac812d5069",
 		},
 		"ken": {
-			"country":    "USA",
+			"country":    "US",
 			"email":      "ken@bob.com",
 			"first_name": "Ken",
 			"last_name":  "Thompson",
@@ -915,7 +959,7 @@ func TestMultiUsersGet(t *testing.T) {
 			"password":   "b3bb4cd67f11e1f6350a5792c8a0f91c2e7920ab93ccd7e964d97d79ad9f8270",
 		},
 		"griesemer": {
-			"country":    "Switzerland",
+			"country":    "CH",
 			"email":      "robert@bob.com",
 			"first_name": "Robert",
 			"last_name":  "Griesemer",
@@ -946,7 +990,7 @@ func TestMultiUsersGet(t *testing.T) {
 	w := httptest.NewRecorder()
 	us.ServeHTTP(w, get)
 
-	resp_body := []map[string]string{}
+	resp_body := userList{}
 
 	err = json.NewDecoder(w.Body).Decode(&resp_body)
 	if err != nil {
@@ -959,6 +1003,12 @@ func TestMultiUsersGet(t *testing.T) {
 		posted_user := data[got_user["nickname"]]
 
 		for key, expected := range posted_user {
+			/* passwords are never returned */
+
+			if key == "password" {
+				continue
+			}
+
 			got := got_user[key]
 
 			if expected != got {
@@ -984,8 +1034,8 @@ func TestMultiUsersGet(t *testing.T) {
 TestSingleUsersGet: Given I have created a User when I call the GET
 method then the User I have created will return with the following
 fields populated: created_at, country, email, first_name, last_name,
-nickname, password and updated_at with the values I created them with
-and the types/formats specified in ./docs/endpoints/users/SCHEMA.md
+nickname and updated_at with the values I created them with and the
+types/formats specified in ./docs/endpoints/users/SCHEMA.md
 */
 func TestSingleUsersGet(t *testing.T) {
 	us, err := NewUserService()
@@ -994,7 +1044,7 @@ func TestSingleUsersGet(t *testing.T) {
 	}
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -1022,7 +1072,7 @@ func TestSingleUsersGet(t *testing.T) {
 	w := httptest.NewRecorder()
 	us.ServeHTTP(w, get)
 
-	resp_body := []map[string]string{}
+	resp_body := userList{}
 
 	err = json.NewDecoder(w.Body).Decode(&resp_body)
 	if err != nil {
@@ -1032,6 +1082,12 @@ func TestSingleUsersGet(t *testing.T) {
 	user := resp_body[0]
 
 	for key, expected := range data {
+		/* passwords are never returned */
+
+		if key == "password" {
+			continue
+		}
+
 		got := user[key]
 
 		if expected != got {
@@ -1060,7 +1116,7 @@ in the response the HTTP status code will be set to 201 Created.
 */
 func TestCorrectUsersPost(t *testing.T) {
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -1104,7 +1160,7 @@ func TestWrongUsersPost(t *testing.T) {
 	expected := []string{"country", "email", "first_name", "last_name", "nickname", "password"}
 
 	data := map[string]string{
-		"country":    "UK",
+		"country":    "GB",
 		"email":      "alice@bob.com",
 		"first_name": "Alice",
 		"last_name":  "Bob",
@@ -1148,3 +1204,410 @@ func TestWrongUsersPost(t *testing.T) {
 		}
 	}
 }
+
+/*
+TestGetUserByID: Given I have created a User when I call the GET
+method on /users/{id} then the HTTP status code will be 200 OK and
+the response will be the User with that id.
+*/
+func TestGetUserByID(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data := map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
+	}
+
+	post_body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	post_req, err := http.NewRequest("POST", "/users", bytes.NewReader(post_body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us.ServeHTTP(httptest.NewRecorder(), post_req)
+
+	list_req, err := http.NewRequest("GET", "/users", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list_resp := httptest.NewRecorder()
+	us.ServeHTTP(list_resp, list_req)
+
+	list_body := userList{}
+
+	err = json.NewDecoder(list_resp.Body).Decode(&list_body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	id := list_body[0]["id"]
+
+	get_req, err := http.NewRequest("GET", fmt.Sprintf("/users/%s", id), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	get_resp := httptest.NewRecorder()
+	us.ServeHTTP(get_resp, get_req)
+
+	status := get_resp.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	user := map[string]string{}
+
+	err = json.NewDecoder(get_resp.Body).Decode(&user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if user["id"] != id {
+		t.Fatalf("Expected user %q but got %q", id, user["id"])
+	}
+
+	for key, expected := range data {
+		/* passwords are never returned */
+
+		if key == "password" {
+			continue
+		}
+
+		got := user[key]
+
+		if expected != got {
+			t.Fatalf("Expected attribute %q to be %q but got %q", key, expected, got)
+		}
+	}
+}
+
+/*
+TestGetUserStatusIsNotFound: Given I have not created a User when I
+call the GET method on /users/{id} then the HTTP status code will be
+404 Not Found.
+*/
+func TestGetUserStatusIsNotFound(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, id := range []string{uuid.NewString(), "not-a-uuid"} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("/users/%s", id), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		us.ServeHTTP(w, req)
+
+		status := w.Result().StatusCode
+		if status != http.StatusNotFound {
+			t.Fatalf("Unexpected error code for %q. Got %d, %d expected.", id, status, http.StatusNotFound)
+		}
+	}
+}
+
+/*
+TestUnsupportedMethodStatusIsMethodNotAllowed: Given an endpoint
+doesn't support a method when I call it with that method then the
+HTTP status code will be 405 Method Not Allowed and the Allow header
+will list the methods it does support.
+*/
+func TestUnsupportedMethodStatusIsMethodNotAllowed(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	requests := []struct {
+		method string
+		url    string
+		allow  string
+	}{
+		{"DELETE", "/users", "GET, HEAD, POST"},
+		{"PATCH", "/users", "GET, HEAD, POST"},
+		{"PUT", "/users", "GET, HEAD, POST"},
+		{"POST", "/users/" + uuid.NewString(), "DELETE, GET, HEAD, PATCH"},
+		{"PUT", "/users/" + uuid.NewString(), "DELETE, GET, HEAD, PATCH"},
+		{"POST", "/healthcheck", "GET, HEAD"},
+		{"GET", "/users/authenticate", "POST"},
+		{"PATCH", "/users/authenticate", "POST"},
+	}
+
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.url, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		us.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("%s %s: Unexpected error code. Got %d, %d expected.", request.method, request.url, resp.StatusCode, http.StatusMethodNotAllowed)
+		}
+
+		allow := resp.Header.Get("Allow")
+		if allow != request.allow {
+			t.Fatalf("%s %s: expected Allow header %q but got %q", request.method, request.url, request.allow, allow)
+		}
+	}
+}
+
+/*
+TestRoutesOverListener: Given the UserService is listening on a real
+socket when I call each of the /users methods then each request
+reaches its handler.
+*/
+func TestRoutesOverListener(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := httptest.NewServer(us)
+	defer server.Close()
+
+	data := map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
+	}
+
+	post_body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	post_resp, err := http.Post(server.URL+"/users", "application/json", bytes.NewReader(post_body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	post_resp.Body.Close()
+
+	if post_resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /users: Unexpected error code. Got %d, %d expected.", post_resp.StatusCode, http.StatusCreated)
+	}
+
+	list_resp, err := http.Get(server.URL + "/users")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list_body := userList{}
+
+	err = json.NewDecoder(list_resp.Body).Decode(&list_body)
+	list_resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	url := fmt.Sprintf("%s/users/%s", server.URL, list_body[0]["id"])
+
+	requests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{"GET", "", http.StatusOK},
+		{"PATCH", `{"nickname":"ken"}`, http.StatusNoContent},
+		{"DELETE", "", http.StatusNoContent},
+		{"GET", "", http.StatusNotFound},
+	}
+
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, url, strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != request.status {
+			t.Fatalf("%s /users/{id}: Unexpected error code. Got %d, %d expected.", request.method, resp.StatusCode, request.status)
+		}
+	}
+}
+
+/* POST a User to the UserService, failing the test unless it is created. */
+func postUser(t *testing.T, us *UserService, data map[string]string) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, err := http.NewRequest("POST", "/users", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	status := w.Result().StatusCode
+	if status != http.StatusCreated {
+		t.Fatalf("Unexpected error code creating user. Got %d, %d expected.", status, http.StatusCreated)
+	}
+}
+
+/*
+TestNoResponseContainsPassword: Given I have created a User when I
+call each of the endpoints then no response contains the password
+attribute, the password that was sent or the hash of it.
+*/
+func TestNoResponseContainsPassword(t *testing.T) {
+	us := newAdminService(t, WithTokenKey(writeSecret(t)))
+
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	data := map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   password,
+	}
+
+	post_body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	post_req, err := http.NewRequest("POST", "/users", bytes.NewReader(post_body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	post_resp := httptest.NewRecorder()
+	us.ServeHTTP(post_resp, post_req)
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	id := users[0].ID
+	hash := users[0].Password
+	access := logIn(t, us).AccessToken
+
+	expectNoPassword := func(request string, w *httptest.ResponseRecorder) {
+		body := w.Body.String()
+
+		for _, secret := range []string{`"password"`, password, hash} {
+			if strings.Contains(body, secret) {
+				t.Fatalf("%s: expected response not to contain %q but got %s", request, secret, body)
+			}
+		}
+	}
+
+	expectNoPassword("POST /users", post_resp)
+
+	requests := []struct {
+		method string
+		url    string
+		token  string
+		body   string
+	}{
+		{"GET", "/users", "", ""},
+		{"GET", "/users?nickname=AB123", "", ""},
+		{"GET", "/users?limit=1&page=0", "", ""},
+		{"GET", "/users/" + id, "", ""},
+		{"PATCH", "/users/" + id, access, `{"password":"` + password + `"}`},
+		{"PUT", "/users/" + id, "", ""},
+		{"POST", "/users/authenticate", "", `{"nickname":"AB123","password":"` + password + `"}`},
+		{"POST", "/users/authenticate", "", `{"nickname":"AB123","password":"wrong"}`},
+		{"POST", "/users/password-reset", "", `{"email":"alice@bob.com"}`},
+		{"POST", "/users/" + id + "/mfa/totp", access, ""},
+		{"POST", "/users/" + id + "/mfa/totp/confirm", access, `{"totp":"000000"}`},
+		{"GET", "/healthcheck", "", ""},
+		{"GET", "/users/export?format=ndjson", "", ""},
+		{"GET", "/users/export?format=csv", "", ""},
+		{"POST", "/users/import", importAdminToken, importLine("rob", "GB") + "\n" + importLine("AB123", "GB") + "\n" + importLine("robert", "XX")},
+		{"POST", "/users/import?dry_run=true", importAdminToken, importLine("ken", "GB")},
+		{"DELETE", "/users/" + id, access, ""},
+		{"GET", "/users/" + id, "", ""},
+	}
+
+	for _, request := range requests {
+		w := serveWithToken(t, us, request.method, request.url, request.token, request.body)
+
+		expectNoPassword(request.method+" "+request.url, w)
+	}
+}
+
+/*
+TestListenAndServeShutsDown: Given the UserService is serving when its
+context is cancelled then it stops taking requests and returns nil, so
+it can be closed.
+*/
+func TestListenAndServeShutsDown(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer us.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- us.ListenAndServe(ctx, addr)
+	}()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		res, err := http.Get("http://" + addr + "/healthcheck")
+		if err == nil {
+			res.Body.Close()
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected the service to come up but got %q", err.Error())
+		}
+	}
+
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("expected a shutdown to return nil but got %q", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the service to shut down")
+	}
+
+	_, err = http.Get("http://" + addr + "/healthcheck")
+	if err == nil {
+		t.Fatal("expected the service to stop taking requests")
+	}
+}
@@ -0,0 +1,533 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+/*
+Returned by Import when the users to import can't be read at all, such
+as a CSV without the right header row, rather than only some of them.
+*/
+var ErrInvalidImport = errors.New("import is not valid")
+
+/* The formats POST /users/import can read, and their content types. */
+var importFormats = map[string]string{
+	"csv":    "text/csv",
+	"ndjson": "application/x-ndjson",
+}
+
+const (
+	/* The longest line of NDJSON a user can be imported from, in bytes. */
+	maxImportLineLength = 64 * 1024
+
+	/*
+		The most bytes of the body of POST /users/import that are read,
+		a quarter of a million users or so. The import command reads
+		its file without a limit.
+	*/
+	maxImportBytes = 64 << 20
+
+	/*
+		How many passwords of an import are hashed at once. They still
+		wait for one of the hashSlots, like any other hash.
+	*/
+	importHashers = 4
+
+	/* The most errors a report has, the rest are only counted. */
+	maxImportErrors = 1000
+)
+
+/* How Import creates users. */
+type ImportOptions struct {
+	/* Only report which users would fail, without creating any. */
+	DryRun bool
+
+	/*
+		Send each user created an email verification, as POST /users
+		does. It's off unless asked for, as users seeded from another
+		service may not expect to hear from this one.
+	*/
+	Notify bool
+}
+
+/* What happened to the users of an import. */
+type ImportReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Read    int           `json:"read"`
+	Created int           `json:"created"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors"`
+}
+
+/* Why the user on a line of an import wasn't created. */
+type ImportError struct {
+	Line   int          `json:"line"`
+	Detail string       `json:"detail"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+/* Record that the user on line wasn't created. */
+func (ir *ImportReport) fail(line int, detail string, errs []fieldError) {
+	ir.Failed++
+
+	if len(ir.Errors) < maxImportErrors {
+		ir.Errors = append(ir.Errors, ImportError{Line: line, Detail: detail, Errors: errs})
+	}
+}
+
+/*
+A user read from an import, or why they couldn't be. line is where
+they start, counting from 1.
+*/
+type importRow struct {
+	data   map[string]string
+	detail string
+	line   int
+}
+
+/* Reads the rows of an import in order, returning io.EOF after the last. */
+type importReader interface {
+	next() (*importRow, error)
+}
+
+/* Get the reader of the users in r written in format. */
+func newImportReader(r io.Reader, format string) (importReader, error) {
+	switch format {
+	case "csv":
+		return newCSVImportReader(r)
+	case "ndjson":
+		return &ndjsonImportReader{r: bufio.NewReaderSize(r, maxImportLineLength)}, nil
+	}
+
+	return nil, fmt.Errorf("%w: format must be ndjson or csv", ErrInvalidImport)
+}
+
+/* Reads a user from each line of JSON, skipping blank lines. */
+type ndjsonImportReader struct {
+	line int
+	r    *bufio.Reader
+}
+
+func (nir *ndjsonImportReader) next() (*importRow, error) {
+	for {
+		raw, err := nir.r.ReadSlice('\n')
+		if len(raw) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+
+		nir.line++
+
+		if err == bufio.ErrBufferFull {
+			err = nir.skipLine()
+			if err != nil {
+				return nil, err
+			}
+
+			return &importRow{line: nir.line, detail: fmt.Sprintf("the line is longer than %d bytes", maxImportLineLength)}, nil
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 {
+			continue
+		}
+
+		data := map[string]string{}
+
+		err = json.Unmarshal(raw, &data)
+		if err != nil {
+			return &importRow{line: nir.line, detail: "the line is not a JSON object of strings"}, nil
+		}
+
+		return &importRow{line: nir.line, data: data}, nil
+	}
+}
+
+/* Discard the rest of a line that didn't fit in the buffer. */
+func (nir *ndjsonImportReader) skipLine() error {
+	for {
+		_, err := nir.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF {
+			return nil
+		}
+
+		return err
+	}
+}
+
+/*
+Reads a user from each row of CSV. The header row names the column of
+each writable attribute, in any order.
+*/
+type csvImportReader struct {
+	columns []string
+	r       *csv.Reader
+}
+
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	cr := csv.NewReader(r)
+
+	columns, err := cr.Read()
+	if err == io.EOF {
+		return &csvImportReader{r: cr}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: csv: unable to read the header row: %w", ErrInvalidImport, err)
+	}
+
+	for i, column := range columns {
+		if !slices.Contains(writableAttributes, column) {
+			return nil, fmt.Errorf("%w: csv: %q is not an attribute of users that can be imported", ErrInvalidImport, column)
+		}
+
+		if slices.Contains(columns[:i], column) {
+			return nil, fmt.Errorf("%w: csv: %q is a column more than once", ErrInvalidImport, column)
+		}
+	}
+
+	for _, attribute := range writableAttributes {
+		if !slices.Contains(columns, attribute) {
+			return nil, fmt.Errorf("%w: csv: there is no %q column", ErrInvalidImport, attribute)
+		}
+	}
+
+	return &csvImportReader{columns: columns, r: cr}, nil
+}
+
+func (cir *csvImportReader) next() (*importRow, error) {
+	if cir.columns == nil {
+		return nil, io.EOF
+	}
+
+	record, err := cir.r.Read()
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &importRow{line: parseErr.StartLine, detail: parseErr.Err.Error()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	line, _ := cir.r.FieldPos(0)
+
+	data := map[string]string{}
+	for i, column := range cir.columns {
+		data[column] = record[i]
+	}
+
+	return &importRow{line: line, data: data}, nil
+}
+
+/*
+A row of an import waiting its turn. If it's valid and it isn't a dry
+run its password is hashed in the background and done is closed once
+it has been, otherwise done is closed straight away.
+*/
+type importJob struct {
+	*importRow
+	done     chan struct{}
+	err      error
+	errs     []fieldError
+	password string
+}
+
+/*
+Create a user from each row of r, which is written in format, with
+the same validation as POST /users, and report why any weren't. With
+options.DryRun no users are created, though the report is as it would have
+been, including users that have the same email or nickname as another.
+
+Passwords are hashed importHashers at a time, but users are created in
+the order they are read, so if two have the same email or nickname
+it's always the first that's created. The error is only returned when
+the import couldn't be finished, and the report is of the users before
+then.
+*/
+func (us *UserService) Import(ctx context.Context, r io.Reader, format string, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun, Errors: []ImportError{}}
+
+	reader, err := newImportReader(r, format)
+	if err != nil {
+		return report, err
+	}
+
+	var taken map[string]map[string]bool
+	if options.DryRun {
+		taken, err = us.takenAttributes(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	pending := []*importJob{}
+	defer func() {
+		for _, job := range pending {
+			<-job.done
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+
+		report.Read++
+
+		job := &importJob{importRow: row, done: make(chan struct{})}
+		if job.detail == "" {
+			job.errs = validateUser(job.data, false)
+			if len(job.errs) > 0 {
+				job.detail = "one or more attributes are not valid, see errors"
+			}
+		}
+
+		if job.detail != "" || options.DryRun {
+			close(job.done)
+		} else {
+			go func() {
+				defer close(job.done)
+
+				job.password, job.err = hashPassword(job.data["password"])
+			}()
+		}
+
+		pending = append(pending, job)
+		if len(pending) < importHashers {
+			continue
+		}
+
+		err = us.importUser(report, pending[0], taken, options.Notify)
+		pending = pending[1:]
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for len(pending) > 0 {
+		err = us.importUser(report, pending[0], taken, options.Notify)
+		pending = pending[1:]
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+/*
+Create the user of job once their password has been hashed, or report
+why they can't be, and if notify send them an email verification. With
+a dry run it's only reported whether they would have been, using the
+emails and nicknames that are taken.
+*/
+func (us *UserService) importUser(report *ImportReport, job *importJob, taken map[string]map[string]bool, notify bool) error {
+	<-job.done
+
+	if job.detail != "" {
+		report.fail(job.line, job.detail, job.errs)
+		return nil
+	} else if report.DryRun {
+		dryRunImport(report, job.importRow, taken)
+		return nil
+	} else if job.err != nil {
+		return fmt.Errorf("unable to hash the password on line %d: %w", job.line, job.err)
+	}
+
+	id := uuid.NewString()
+	now := us.clock()
+
+	user, token, err := newUser(id, job.data, job.password, now)
+	if err != nil {
+		return fmt.Errorf("unable to make an email verification on line %d: %w", job.line, err)
+	}
+
+	var conflict *conflictError
+
+	err = us.store.Create(user)
+	if errors.As(err, &conflict) {
+		report.fail(job.line, "another user already has this "+conflict.Field, []fieldError{{conflict.Field, "is already taken"}})
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to add the user on line %d: %w", job.line, err)
+	}
+
+	report.Created++
+
+	if notify {
+		us.sendEmailVerification(id, user.Email, token, now)
+	}
+
+	return nil
+}
+
+/*
+Get the unique attributes of every user, by the keys they're indexed
+by, so a dry run can tell which users would conflict.
+*/
+func (us *UserService) takenAttributes(ctx context.Context) (map[string]map[string]bool, error) {
+	taken := map[string]map[string]bool{"email": {}, "nickname": {}}
+
+	err := us.store.Walk(ctx, nil, func(user *user) error {
+		taken["email"][uniqueKey(user.Email)] = true
+		taken["nickname"][uniqueKey(user.Nickname)] = true
+
+		return nil
+	})
+
+	return taken, err
+}
+
+/*
+Report whether the user of row would be created, and if so take their
+email and nickname from the users after them.
+*/
+func dryRunImport(report *ImportReport, row *importRow, taken map[string]map[string]bool) {
+	for _, field := range []string{"email", "nickname"} {
+		if taken[field][uniqueKey(row.data[field])] {
+			report.fail(row.line, "another user already has this "+field, []fieldError{{field, "is already taken"}})
+			return
+		}
+	}
+
+	taken["email"][uniqueKey(row.data["email"])] = true
+	taken["nickname"][uniqueKey(row.data["nickname"])] = true
+
+	report.Created++
+}
+
+/*
+Get the format of an import from the format query parameter, or else
+the Content-Type of the request. Without either it's NDJSON.
+*/
+func importFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format != "" {
+		if _, ok := importFormats[format]; !ok {
+			return "", fmt.Errorf("format must be ndjson or csv")
+		}
+
+		return format, nil
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return "ndjson", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("Content-Type %q is not valid", contentType)
+	}
+
+	for format, importType := range importFormats {
+		if mediaType == importType {
+			return format, nil
+		}
+	}
+
+	return "", fmt.Errorf("Content-Type must be %s or %s", importFormats["ndjson"], importFormats["csv"])
+}
+
+/* Get the query parameter name of r as true or false, false if it wasn't sent. */
+func importFlag(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value != "" && value != "true" && value != "false" {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+
+	return value == "true", nil
+}
+
+/*
+Create a user from each line of the request body, and respond with a
+report of which lines failed and why. Users created before the import
+fails are kept.
+*/
+func (us *UserService) importUsers(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	format, err := importFormat(r)
+	if err != nil {
+		log.Printf("[%s] POST /users/import: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun, err := importFlag(r, "dry_run")
+	if err != nil {
+		log.Printf("[%s] POST /users/import: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	notify, err := importFlag(r, "notify")
+	if err != nil {
+		log.Printf("[%s] POST /users/import: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[%s] POST /users/import: attempting to import users from %s", sender, format)
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	report, err := us.Import(r.Context(), body, format, ImportOptions{DryRun: dryRun, Notify: notify})
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("[%s] POST /users/import: the body is larger than %d bytes after %d users were created", sender, tooLarge.Limit, report.Created)
+
+		us.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("the import is larger than %d bytes, %d users were created before it was stopped", tooLarge.Limit, report.Created))
+		return
+	} else if errors.Is(err, ErrInvalidImport) {
+		log.Printf("[%s] POST /users/import: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	} else if r.Context().Err() != nil {
+		log.Printf("[%s] POST /users/import: gone after %d users were created", sender, report.Created)
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/import: unable to import users after %d were created %q", sender, report.Created, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, fmt.Sprintf("unable to import users, %d were created before the import failed", report.Created))
+		return
+	}
+
+	log.Printf("[%s] POST /users/import: read %d users, created %d and %d failed", sender, report.Read, report.Created, report.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	us.hc.increment(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("[%s] POST /users/import: unable to write the report %q", sender, err.Error())
+	}
+}
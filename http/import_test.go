@@ -0,0 +1,329 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const importAdminToken = "an admin token that is at least 32 bytes long"
+
+/* Create a UserService with the admin endpoints enabled. */
+func newAdminService(t *testing.T, options ...Option) *UserService {
+	path := filepath.Join(t.TempDir(), "admin.token")
+
+	err := os.WriteFile(path, []byte(importAdminToken+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us, err := NewUserService(append(options, WithAdminToken(path))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return us
+}
+
+/* POST body to url as the admin with contentType, if there is one. */
+func postImport(t *testing.T, us *UserService, url string, contentType string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req.Header.Set("Authorization", "Bearer "+importAdminToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	return w
+}
+
+/* Get the report of an import, failing the test unless it's 200 OK. */
+func decodeReport(t *testing.T, w *httptest.ResponseRecorder) *ImportReport {
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK but got %d: %s", w.Code, w.Body.String())
+	}
+
+	report := &ImportReport{}
+
+	err := json.NewDecoder(w.Body).Decode(report)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return report
+}
+
+/* Get the line and the fields or detail of each error of report. */
+func reportErrors(report *ImportReport) []string {
+	errs := []string{}
+	for _, err := range report.Errors {
+		fields := []string{}
+		for _, fieldErr := range err.Errors {
+			fields = append(fields, fieldErr.Field)
+		}
+
+		if len(fields) == 0 {
+			fields = append(fields, err.Detail)
+		}
+
+		errs = append(errs, fmt.Sprintf("%d:%s", err.Line, strings.Join(fields, ",")))
+	}
+
+	return errs
+}
+
+/* Get a line of NDJSON for the user nickname, with an email of nickname@bob.com. */
+func importLine(nickname string, country string) string {
+	raw, _ := json.Marshal(map[string]string{
+		"country":    country,
+		"email":      nickname + "@bob.com",
+		"first_name": "Rob",
+		"last_name":  "Bob",
+		"nickname":   nickname,
+		"password":   alicePassword,
+	})
+
+	return string(raw)
+}
+
+/*
+TestUsersImportNDJSON: Given an admin POSTs lines of JSON to
+/users/import then a User is created from each line that POST /users
+would have created, in order, none are sent an email verification, and
+the report has the line of each that wasn't and why, with the memory
+store and the SQL store. With dry_run the report is the same but no
+Users are created.
+*/
+func TestUsersImportNDJSON(t *testing.T) {
+	body := strings.Join([]string{
+		importLine("rob", "GB"),
+		importLine("robert", "XX"),
+		"",
+		`{"nickname": 42}`,
+		importLine("ROB", "GB"),
+		importLine("AB123", "GB"),
+		importLine("roberta", "FR"),
+		importLine("robin", "DE"),
+	}, "\n")
+
+	expected := []string{"2:country", "4:the line is not a JSON object of strings", "5:email", "6:nickname"}
+
+	for name, options := range map[string][]Option{
+		"memory": {},
+		"sql":    {WithDatabase(filepath.Join(t.TempDir(), "users.db"))},
+	} {
+		notifier := &recordingNotifier{}
+
+		us := newAdminService(t, append(options, WithNotifier(notifier))...)
+		postAlice(t, us)
+
+		dryRun := decodeReport(t, postImport(t, us, "/users/import?dry_run=true", "", body))
+		if got := getNicknames(t, us, "/users"); got != "AB123" {
+			t.Fatalf("%s: expected a dry run to create no users but got %s", name, got)
+		}
+
+		report := decodeReport(t, postImport(t, us, "/users/import", "application/x-ndjson", body))
+
+		for _, test := range []struct {
+			report *ImportReport
+			dryRun bool
+		}{
+			{dryRun, true},
+			{report, false},
+		} {
+			if test.report.DryRun != test.dryRun || test.report.Read != 7 || test.report.Created != 3 || test.report.Failed != 4 {
+				t.Fatalf("%s: expected 7 read, 3 created and 4 failed but got %+v", name, test.report)
+			}
+
+			if errs := reportErrors(test.report); !slices.Equal(errs, expected) {
+				t.Fatalf("%s: expected the errors %v but got %v", name, expected, errs)
+			}
+		}
+
+		if got := getNicknames(t, us, "/users?sort=created_at"); got != "AB123,rob,roberta,robin" {
+			t.Fatalf("%s: expected the users to be created in order but got %s", name, got)
+		}
+
+		if len(notifier.messages) != 1 || notifier.messages[0].To != "alice@bob.com" {
+			t.Fatalf("%s: expected no email verifications for the imported users but got %+v", name, notifier.messages)
+		}
+
+		us.Close()
+	}
+}
+
+/*
+TestUsersImportNotify: Given an admin POSTs lines of JSON to
+/users/import with notify=true then each User created is sent an email
+verification, but not with a dry run.
+*/
+func TestUsersImportNotify(t *testing.T) {
+	notifier := &recordingNotifier{}
+
+	us := newAdminService(t, WithNotifier(notifier))
+
+	body := importLine("rob", "GB") + "\n" + importLine("robin", "DE")
+
+	decodeReport(t, postImport(t, us, "/users/import?dry_run=true&notify=true", "", body))
+	if len(notifier.messages) != 0 {
+		t.Fatalf("expected a dry run to send nothing but got %+v", notifier.messages)
+	}
+
+	decodeReport(t, postImport(t, us, "/users/import?notify=true", "", body))
+
+	to := []string{}
+	for _, message := range notifier.messages {
+		to = append(to, message.To)
+	}
+
+	if expected := []string{"rob@bob.com", "robin@bob.com"}; !slices.Equal(to, expected) {
+		t.Fatalf("expected email verifications to %v but got %v", expected, to)
+	}
+}
+
+/*
+TestUsersImportCSV: Given an admin POSTs CSV to /users/import with a
+header row of the writable attributes in any order then a User is
+created from each row that's valid, and the report has the line each
+that wasn't starts on.
+*/
+func TestUsersImportCSV(t *testing.T) {
+	us := newAdminService(t)
+
+	body := strings.Join([]string{
+		"password,nickname,email,first_name,last_name,country",
+		alicePassword + ",rob,rob@bob.com,Rob,Bob,GB",
+		alicePassword + ",robert,robert@bob.com,Robert,Bob",
+		`"a password
+across two lines","roberta","roberta@bob.com","Roberta","Bob, Jr",FR`,
+		alicePassword + ",ro,robin@bob.com,Robin,Bob,DE",
+		alicePassword + ",robin,robin@bob.com,Robin,Bob,DE",
+	}, "\n")
+
+	for _, url := range []string{"/users/import?format=csv", "/users/import"} {
+		report := decodeReport(t, postImport(t, us, url, "text/csv; charset=utf-8", body))
+
+		expected := []string{"3:wrong number of fields", "6:nickname"}
+		if url == "/users/import" {
+			expected = []string{"2:email", "3:wrong number of fields", "4:email", "6:nickname", "7:email"}
+		}
+
+		if errs := reportErrors(report); !slices.Equal(errs, expected) {
+			t.Fatalf("%s: expected the errors %v but got %v", url, expected, errs)
+		}
+	}
+
+	if got := getNicknames(t, us, "/users?sort=created_at"); got != "rob,roberta,robin" {
+		t.Fatalf("expected rob, roberta and robin but got %s", got)
+	}
+
+	users := getUsers(t, us, "/users?nickname=roberta")
+	if len(users) != 1 || users[0]["last_name"] != "Bob, Jr" {
+		t.Fatalf("expected the last name Bob, Jr but got %v", users)
+	}
+}
+
+/*
+TestUsersImportFailures: Given POST /users/import is called without
+the admin token then the HTTP status code will be 401 Unauthorized,
+with a format, dry_run or CSV header that isn't valid it will be 400
+Bad Request, and if the store fails it will be 500 Internal Server
+Error. Without an admin token configured there's no POST method.
+*/
+func TestUsersImportFailures(t *testing.T) {
+	us := newAdminService(t)
+
+	w := serveWithToken(t, us, "POST", "/users/import", "wrong", importLine("rob", "GB"))
+
+	expectProblem(t, w, http.StatusUnauthorized, "unauthorized", "/users/import")
+
+	for _, test := range []struct {
+		url         string
+		contentType string
+		body        string
+	}{
+		{"/users/import?format=xml", "", ""},
+		{"/users/import", "application/json", ""},
+		{"/users/import", "text/csv;;", ""},
+		{"/users/import?dry_run=yes", "", ""},
+		{"/users/import?notify=yes", "", ""},
+		{"/users/import?format=csv", "", "nickname,email"},
+		{"/users/import?format=csv", "", "password,nickname,email,first_name,last_name,country,id"},
+		{"/users/import?format=csv", "", "password,nickname,email,first_name,last_name,country,email"},
+		{"/users/import?format=csv", "", `"password`},
+	} {
+		w := postImport(t, us, test.url, test.contentType, test.body)
+
+		expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users/import")
+	}
+
+	broken := newAdminService(t, WithStore(brokenStore{}))
+
+	w = postImport(t, broken, "/users/import", "", importLine("rob", "GB"))
+
+	expectProblem(t, w, http.StatusInternalServerError, "internal-server-error", "/users/import")
+
+	w = postImport(t, broken, "/users/import?dry_run=true", "", importLine("rob", "GB"))
+
+	expectProblem(t, w, http.StatusInternalServerError, "internal-server-error", "/users/import")
+
+	unadministered, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w = postImport(t, unadministered, "/users/import", "", importLine("rob", "GB"))
+
+	expectProblem(t, w, http.StatusMethodNotAllowed, "method-not-allowed", "/users/import")
+}
+
+/*
+TestImportLongLine: Given a line of NDJSON that's longer than
+maxImportLineLength then it fails and the lines after it are still
+imported.
+*/
+func TestImportLongLine(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	body := strings.Repeat("x", 3*maxImportLineLength) + "\n" + importLine("rob", "GB") + "\n"
+
+	report, err := us.Import(context.Background(), strings.NewReader(body), "ndjson", ImportOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []string{fmt.Sprintf("1:the line is longer than %d bytes", maxImportLineLength)}
+	if errs := reportErrors(report); !slices.Equal(errs, expected) || report.Created != 1 {
+		t.Fatalf("expected the errors %v and 1 user created but got %+v", expected, report)
+	}
+}
+
+/*
+TestImportTooLarge: Given an admin POSTs an import larger than
+maxImportBytes then it's stopped once that much has been read and the
+response is a 413 Request Entity Too Large problem.
+*/
+func TestImportTooLarge(t *testing.T) {
+	us := newAdminService(t)
+
+	body := importLine("rob", "GB") + strings.Repeat("\n", maxImportBytes)
+
+	w := postImport(t, us, "/users/import", "", body)
+	expectProblem(t, w, http.StatusRequestEntityTooLarge, "request-entity-too-large", "/users/import")
+}
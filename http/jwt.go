@@ -0,0 +1,182 @@
+package http
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	/* How long an access token can be used for. */
+	accessTokenTTL = 15 * time.Minute
+
+	/* Issuer of the access tokens. */
+	tokenIssuerName = "user-service"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+/*
+tokenSigner signs and verifies JWT access tokens with either an
+HMAC-SHA256 secret (HS256) or an Ed25519 key (EdDSA).
+*/
+type tokenSigner struct {
+	alg     string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	secret  []byte
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+/* The claims of an access token; sub is the id of the user. */
+type jwtClaims struct {
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+}
+
+/*
+Load the key tokens are signed with from the file at path. A PEM
+encoded PKCS #8 Ed25519 private key signs with EdDSA, anything else is
+taken as an HS256 secret, which must be at least 32 bytes.
+*/
+func loadTokenSigner(path string) (*tokenSigner, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: only Ed25519 private keys are supported", path)
+		}
+
+		return &tokenSigner{
+			alg:     "EdDSA",
+			private: private,
+			public:  private.Public().(ed25519.PublicKey),
+		}, nil
+	}
+
+	secret := bytes.TrimSpace(raw)
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("%s: HS256 secret must be at least 32 bytes", path)
+	}
+
+	return &tokenSigner{alg: "HS256", secret: secret}, nil
+}
+
+func (ts *tokenSigner) signature(input []byte) []byte {
+	if ts.alg == "EdDSA" {
+		return ed25519.Sign(ts.private, input)
+	}
+
+	mac := hmac.New(sha256.New, ts.secret)
+	mac.Write(input)
+
+	return mac.Sum(nil)
+}
+
+/* Make an access token for the user with id, issued at now. */
+func (ts *tokenSigner) sign(id string, now time.Time) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Alg: ts.alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(&jwtClaims{
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		Issuer:    tokenIssuerName,
+		Subject:   id,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	return input + "." + enc.EncodeToString(ts.signature([]byte(input))), nil
+}
+
+/*
+Check an access token was signed by us and hasn't expired at now,
+returning its claims. The algorithm in the header must be the one we
+sign with, so a token can't choose how it is verified.
+*/
+func (ts *tokenSigner) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	enc := base64.RawURLEncoding
+
+	raw, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	header := jwtHeader{}
+
+	err = json.Unmarshal(raw, &header)
+	if err != nil || header.Alg != ts.alg {
+		return nil, errInvalidToken
+	}
+
+	signature, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+
+	if ts.alg == "EdDSA" {
+		if !ed25519.Verify(ts.public, input, signature) {
+			return nil, errInvalidToken
+		}
+	} else if !hmac.Equal(ts.signature(input), signature) {
+		return nil, errInvalidToken
+	}
+
+	raw, err = enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	claims := &jwtClaims{}
+
+	err = json.Unmarshal(raw, claims)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if claims.Issuer != tokenIssuerName || claims.Subject == "" || now.Unix() >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+
+	return claims, nil
+}
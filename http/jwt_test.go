@@ -0,0 +1,153 @@
+package http
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Write an HS256 secret to a file, returning its path. */
+func writeSecret(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "token.key")
+
+	err := os.WriteFile(path, []byte("a secret that is at least 32 bytes long\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return path
+}
+
+/* Write a PEM encoded Ed25519 private key to a file, returning its path. */
+func writeEd25519Key(t *testing.T) string {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	path := filepath.Join(t.TempDir(), "token.pem")
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return path
+}
+
+/* Load a tokenSigner from path, failing the test if it can't be. */
+func openSigner(t *testing.T, path string) *tokenSigner {
+	signer, err := loadTokenSigner(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return signer
+}
+
+/*
+TestTokenSignerRoundTrip: Given a signing key of either kind when I
+sign an access token then it verifies until it expires, with the id
+of the user as its subject.
+*/
+func TestTokenSignerRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	for alg, path := range map[string]string{
+		"EdDSA": writeEd25519Key(t),
+		"HS256": writeSecret(t),
+	} {
+		signer := openSigner(t, path)
+		if signer.alg != alg {
+			t.Fatalf("expected %s signer but got %s", alg, signer.alg)
+		}
+
+		token, err := signer.sign("alice", now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		claims, err := signer.verify(token, now.Add(accessTokenTTL-time.Second))
+		if err != nil {
+			t.Fatalf("%s: expected token to verify but got %s", alg, err.Error())
+		}
+
+		if claims.Subject != "alice" {
+			t.Fatalf("%s: expected subject %q but got %q", alg, "alice", claims.Subject)
+		}
+
+		_, err = signer.verify(token, now.Add(accessTokenTTL))
+		if !errors.Is(err, errInvalidToken) {
+			t.Fatalf("%s: expected expired token to be invalid but got %v", alg, err)
+		}
+	}
+}
+
+/*
+TestTokenSignerRejectsForgeries: Given an access token when it is
+tampered with, signed by another key or claims another algorithm then
+it doesn't verify.
+*/
+func TestTokenSignerRejectsForgeries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	signer := openSigner(t, writeSecret(t))
+
+	token, err := signer.sign("alice", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	parts := strings.Split(token, ".")
+	enc := base64.RawURLEncoding
+
+	other, err := openSigner(t, writeEd25519Key(t)).sign("alice", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	forgeries := map[string]string{
+		"another subject": parts[0] + "." + enc.EncodeToString([]byte(`{"exp":1800000000,"iat":1700000000,"iss":"user-service","sub":"bob"}`)) + "." + parts[2],
+		"another key":     other,
+		"no algorithm":    enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + ".",
+		"not a token":     "alice",
+	}
+
+	for name, forgery := range forgeries {
+		_, err = signer.verify(forgery, now)
+		if !errors.Is(err, errInvalidToken) {
+			t.Fatalf("%s: expected errInvalidToken but got %v", name, err)
+		}
+	}
+}
+
+/*
+TestTokenSignerRejectsShortSecrets: Given a file with a secret shorter
+than 32 bytes when I load it then it is refused.
+*/
+func TestTokenSignerRejectsShortSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.key")
+
+	err := os.WriteFile(path, []byte("short"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = loadTokenSigner(path)
+	if err == nil {
+		t.Fatal("expected short secret to be refused")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+Take an exclusive lock on the lock file of dir, so only one process at
+a time uses it. The lock is held until the file is closed or the
+process exits, and ErrLocked is returned straight away if another
+process holds it.
+*/
+func lockDir(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package http
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/* Open the lock file of dir. Without flock it isn't locked. */
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0o600)
+}
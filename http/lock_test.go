@@ -0,0 +1,53 @@
+//go:build unix
+
+package http
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+TestDataDirIsLocked: Given a durable store has a data directory open
+when another store opens it then ErrLocked is returned straight away,
+and once the first is closed it can be opened. A store that fails to
+open doesn't keep the directory locked.
+*/
+func TestDataDirIsLocked(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+	ids := createUsers(t, ms, "rob")
+
+	_, err := NewDurableMemoryStore(dir, 0)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked but got %v", err)
+	}
+
+	ms.Close()
+
+	ms = openDurable(t, dir)
+	expectUsers(t, ms, ids)
+	ms.Close()
+
+	corrupt := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(corrupt, walName), []byte("not a record\nnor this\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = NewDurableMemoryStore(corrupt, 0)
+	if err == nil {
+		t.Fatal("expected a corrupt wal to be refused")
+	}
+
+	lock, err := lockDir(corrupt)
+	if err != nil {
+		t.Fatalf("expected the directory to be unlocked after failing to open but got %v", err)
+	}
+
+	lock.Close()
+}
@@ -0,0 +1,275 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+lockoutPolicy is how failed authentications are punished. Once there
+have been threshold failures in a row every further failure locks for
+base, doubling with each failure up to max.
+*/
+type lockoutPolicy struct {
+	base      time.Duration
+	max       time.Duration
+	threshold int
+}
+
+/* The policy for failures against a single account. */
+var accountLockout = lockoutPolicy{
+	base:      time.Minute,
+	max:       time.Hour,
+	threshold: 5,
+}
+
+/*
+The policy for failures from a single address, which is more lenient
+as many users can share an address.
+*/
+var addressLockout = lockoutPolicy{
+	base:      time.Minute,
+	max:       time.Hour,
+	threshold: 20,
+}
+
+/* How long an address is remembered after its last failure. */
+const addressMemory = 24 * time.Hour
+
+/* How long to lock for after failures failed authentications in a row. */
+func (p lockoutPolicy) duration(failures int) time.Duration {
+	if failures < p.threshold {
+		return 0
+	}
+
+	d := p.base
+	for i := p.threshold; i < failures && d < p.max; i++ {
+		d *= 2
+	}
+
+	return min(d, p.max)
+}
+
+/* The failed authentications of an address. */
+type addressAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+/*
+addressThrottle tracks failed authentications by the address they came
+from. It is kept in memory only, and uses the same serialization
+pattern as the healthchecker.
+*/
+type addressThrottle struct {
+	addresses map[string]*addressAttempts
+	callback  chan func()
+}
+
+func newAddressThrottle() *addressThrottle {
+	at := &addressThrottle{
+		addresses: make(map[string]*addressAttempts),
+		callback:  make(chan func()),
+	}
+
+	go func() {
+		for {
+			(<-at.callback)()
+		}
+	}()
+
+	return at
+}
+
+/* How long until address may try to authenticate again, 0 if it may now. */
+func (at *addressThrottle) retryAfter(address string, now time.Time) time.Duration {
+	ch := make(chan time.Duration)
+
+	at.callback <- func() {
+		attempts, ok := at.addresses[address]
+		if !ok {
+			ch <- 0
+			return
+		}
+
+		ch <- max(attempts.lockedUntil.Sub(now), 0)
+	}
+
+	return <-ch
+}
+
+/*
+Record a failed authentication from address, returning how long it
+is now locked for. Addresses not seen for a while are forgotten.
+*/
+func (at *addressThrottle) fail(address string, now time.Time) time.Duration {
+	ch := make(chan time.Duration)
+
+	at.callback <- func() {
+		for key, attempts := range at.addresses {
+			if now.Sub(attempts.lastFailure) > addressMemory {
+				delete(at.addresses, key)
+			}
+		}
+
+		attempts, ok := at.addresses[address]
+		if !ok {
+			attempts = &addressAttempts{}
+			at.addresses[address] = attempts
+		}
+
+		attempts.failures++
+		attempts.lastFailure = now
+
+		d := addressLockout.duration(attempts.failures)
+		if d > 0 {
+			attempts.lockedUntil = now.Add(d)
+		}
+
+		ch <- d
+	}
+
+	return <-ch
+}
+
+/* Forget the failures of address after it authenticated. */
+func (at *addressThrottle) succeed(address string) {
+	at.callback <- func() {
+		delete(at.addresses, address)
+	}
+}
+
+/* Count the addresses locked at now. */
+func (at *addressThrottle) locked(now time.Time) int {
+	ch := make(chan int)
+
+	at.callback <- func() {
+		count := 0
+		for _, attempts := range at.addresses {
+			if now.Before(attempts.lockedUntil) {
+				count++
+			}
+		}
+
+		ch <- count
+	}
+
+	return <-ch
+}
+
+/* The address a request came from, without its port. */
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+/* How long until the account may try to authenticate again, 0 if it may now. */
+func (a *authState) retryAfter(now time.Time) time.Duration {
+	if a.LockedUntil == nil {
+		return 0
+	}
+
+	return max(a.LockedUntil.Sub(now), 0)
+}
+
+/*
+Record a failed authentication against the user with id, returning
+how long it is now locked for.
+*/
+func (us *UserService) failAccount(id string, now time.Time) (time.Duration, error) {
+	var d time.Duration
+
+	_, err := us.store.Update(id, func(user *user) error {
+		user.Auth.FailedAttempts++
+
+		d = accountLockout.duration(user.Auth.FailedAttempts)
+		if d > 0 {
+			lockedUntil := now.Add(d)
+			user.Auth.LockedUntil = &lockedUntil
+
+			log.Printf("locked %q for %s after %d failed authentications", id, d, user.Auth.FailedAttempts)
+		}
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+
+	return d, err
+}
+
+/* Clear the failed authentications and any lock of the user with id. */
+func (us *UserService) unlockAccount(id string) (*user, error) {
+	return us.store.Update(id, func(user *user) error {
+		user.Auth.FailedAttempts = 0
+		user.Auth.LockedUntil = nil
+
+		return nil
+	})
+}
+
+/* Count the accounts locked now. */
+func (us *UserService) lockedAccounts() (int, error) {
+	return us.store.CountLocked(us.clock())
+}
+
+/* Count the addresses locked now. */
+func (us *UserService) lockedAddresses() (int, error) {
+	return us.throttle.locked(us.clock()), nil
+}
+
+/* Respond 429 Too Many Requests, telling the client when to try again. */
+func (us *UserService) tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	us.hc.increment("authenticate.locked")
+	us.fail(w, r, http.StatusTooManyRequests, fmt.Sprintf("too many failed authentications, try again in %d seconds", seconds))
+}
+
+func (us *UserService) unlock(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	id := r.PathValue("id")
+
+	log.Printf("[%s] POST /users/{id}/unlock: attempting to unlock user %q", sender, id)
+
+	err := uuid.Validate(id)
+	if err != nil {
+		log.Printf("[%s] POST /users/{id}/unlock: %q is not a valid user id", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	}
+
+	_, err = us.unlockAccount(id)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("[%s] POST /users/{id}/unlock: %q is not a user", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/{id}/unlock: unable to unlock %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to unlock the user")
+		return
+	}
+
+	log.Printf("[%s] POST /users/{id}/unlock: unlocked %q", sender, id)
+
+	us.hc.increment(http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* POST a body to /users/authenticate from address and get the response. */
+func postAuthenticateFrom(t *testing.T, us *UserService, address string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/users/authenticate", strings.NewReader(body))
+	req.RemoteAddr = address
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	return w
+}
+
+/* Fail to authenticate as AB123 count times, expecting each to be 401 Unauthorized. */
+func failAuthenticate(t *testing.T, us *UserService, count int) {
+	for i := 0; i < count; i++ {
+		status := postAuthenticate(t, us, `{"nickname":"AB123","password":"wrong"}`).Result().StatusCode
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Unexpected error code on failure %d. Got %d, %d expected.", i+1, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+/* Create the User AB123 with the UserService. */
+func postAlice(t *testing.T, us *UserService) {
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   alicePassword,
+	})
+}
+
+/*
+TestLockoutDurationBacksOff: Given a lockout policy when the failures
+reach its threshold then each further failure doubles the lockout, up
+to its maximum.
+*/
+func TestLockoutDurationBacksOff(t *testing.T) {
+	policy := lockoutPolicy{base: time.Minute, max: 10 * time.Minute, threshold: 3}
+
+	for failures, expected := range map[int]time.Duration{
+		2: 0,
+		3: time.Minute,
+		4: 2 * time.Minute,
+		5: 4 * time.Minute,
+		6: 8 * time.Minute,
+		7: 10 * time.Minute,
+		9: 10 * time.Minute,
+	} {
+		got := policy.duration(failures)
+		if got != expected {
+			t.Fatalf("expected %d failures to lock for %s but got %s", failures, expected, got)
+		}
+	}
+}
+
+/*
+TestAccountLocksAfterFailures: Given I have created a User when their
+password is wrong too many times then the HTTP status code will be
+429 Too Many Requests with a Retry-After header, even with the right
+password, until the lockout has passed.
+*/
+func TestAccountLocksAfterFailures(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	failAuthenticate(t, us, accountLockout.threshold-1)
+
+	w := postAuthenticate(t, us, `{"nickname":"AB123","password":"wrong"}`)
+
+	status := w.Result().StatusCode
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusTooManyRequests)
+	}
+
+	if w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected Retry-After %q but got %q", "60", w.Header().Get("Retry-After"))
+	}
+
+	right := `{"nickname":"AB123","password":"` + alicePassword + `"}`
+
+	status = postAuthenticate(t, us, right).Result().StatusCode
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusTooManyRequests)
+	}
+
+	if healthcheckCount(t, us, "locked.accounts") != 1 {
+		t.Fatal("expected the healthcheck to count 1 locked account")
+	}
+
+	us.clock = func() time.Time { return time.Now().Add(accountLockout.base) }
+
+	status = postAuthenticate(t, us, right).Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if users[0].Auth.FailedAttempts != 0 || users[0].Auth.LockedUntil != nil {
+		t.Fatalf("expected authenticating to clear the lockout but got %+v", users[0].Auth)
+	}
+}
+
+/*
+TestAccountLockoutSurvivesRestart: Given a User has been locked out
+when the UserService is restarted then they are still locked out.
+*/
+func TestAccountLockoutSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	us, err := NewUserService(WithDataDir(dir, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+	failAuthenticate(t, us, accountLockout.threshold-1)
+	postAuthenticate(t, us, `{"nickname":"AB123","password":"wrong"}`)
+	us.Close()
+
+	us, err = NewUserService(WithDataDir(dir, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer us.Close()
+
+	status := postAuthenticate(t, us, `{"nickname":"AB123","password":"`+alicePassword+`"}`).Result().StatusCode
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusTooManyRequests)
+	}
+}
+
+/*
+TestAddressLocksAfterFailures: Given an address has failed to
+authenticate too many times when it tries again then the HTTP status
+code will be 429 Too Many Requests, while other addresses can still
+try.
+*/
+func TestAddressLocksAfterFailures(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	body := `{"nickname":"nobody","password":"wrong"}`
+
+	for i := 1; i < addressLockout.threshold; i++ {
+		status := postAuthenticateFrom(t, us, "192.0.2.1:1234", body).Result().StatusCode
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Unexpected error code on failure %d. Got %d, %d expected.", i, status, http.StatusUnauthorized)
+		}
+	}
+
+	for _, address := range []string{"192.0.2.1:1234", "192.0.2.1:5678"} {
+		status := postAuthenticateFrom(t, us, address, body).Result().StatusCode
+		if status != http.StatusTooManyRequests {
+			t.Fatalf("Unexpected error code from %q. Got %d, %d expected.", address, status, http.StatusTooManyRequests)
+		}
+	}
+
+	status := postAuthenticateFrom(t, us, "192.0.2.2:1234", body).Result().StatusCode
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+
+	if healthcheckCount(t, us, "locked.addresses") != 1 {
+		t.Fatal("expected the healthcheck to count 1 locked address")
+	}
+}
+
+/*
+TestAdminUnlocksAccount: Given a User has been locked out when an
+admin calls POST /users/{id}/unlock then they can authenticate again,
+and without the admin token the HTTP status code will be 401
+Unauthorized.
+*/
+func TestAdminUnlocksAccount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.token")
+
+	admin := "an admin token that is at least 32 bytes long"
+
+	err := os.WriteFile(path, []byte(admin+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us, err := NewUserService(WithAdminToken(path))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+	failAuthenticate(t, us, accountLockout.threshold-1)
+	postAuthenticate(t, us, `{"nickname":"AB123","password":"wrong"}`)
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	url := "/users/" + users[0].ID + "/unlock"
+
+	for token, expected := range map[string]int{
+		"":      http.StatusUnauthorized,
+		"wrong": http.StatusUnauthorized,
+		admin:   http.StatusNoContent,
+	} {
+		status := serveWithToken(t, us, "POST", url, token, "").Result().StatusCode
+		if status != expected {
+			t.Fatalf("Unexpected error code with token %q. Got %d, %d expected.", token, status, expected)
+		}
+	}
+
+	status := postAuthenticate(t, us, `{"nickname":"AB123","password":"`+alicePassword+`"}`).Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+}
@@ -0,0 +1,84 @@
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/* A Message sent to a user, such as a password reset token. */
+type Message struct {
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+	Subject string    `json:"subject"`
+	To      string    `json:"to"`
+}
+
+/*
+Notifier delivers messages to users. The UserService doesn't care
+how, so it could be email, SMS or, for local runs, a file.
+*/
+type Notifier interface {
+	Notify(message *Message) error
+}
+
+/*
+logNotifier is the Notifier used when none is given. It only logs
+that a message was sent, not what was in it, as messages contain
+secrets.
+*/
+type logNotifier struct{}
+
+func (logNotifier) Notify(message *Message) error {
+	log.Printf("no notifier, dropped %q to %q", message.Subject, message.To)
+
+	return nil
+}
+
+/*
+outboxNotifier appends each message as a line of JSON to a file, for
+running the service locally without sending anything.
+*/
+type outboxNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+/* Create a Notifier that appends messages to the file at path. */
+func NewOutboxNotifier(path string) Notifier {
+	return &outboxNotifier{path: path}
+}
+
+func (on *outboxNotifier) Notify(message *Message) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	on.mu.Lock()
+	defer on.mu.Unlock()
+
+	file, err := os.OpenFile(on.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+/* Set how the UserService delivers messages to users. */
+func WithNotifier(notifier Notifier) Option {
+	return func(us *UserService) error {
+		us.notifier = notifier
+
+		return nil
+	}
+}
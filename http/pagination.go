@@ -0,0 +1,208 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	/* How many users are on a page of GET /users when the client doesn't say. */
+	defaultLimit = 100
+
+	/* The most users that can be on a page of GET /users. */
+	maxLimit = 1000
+)
+
+/*
+A page of the users of GET /users, and where it is among the rest.
+Next and Prev are the URLs of the pages either side, if there are any.
+Page is only set when the page was asked for by number rather than
+cursor, and NextCursor is the cursor of the next page. Users are as
+returned by user.project.
+*/
+type usersPage struct {
+	Users      []any  `json:"users"`
+	Total      int    `json:"total"`
+	Page       *int   `json:"page,omitempty"`
+	Limit      int    `json:"limit"`
+	Next       string `json:"next,omitempty"`
+	Prev       string `json:"prev,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+/* Which page of GET /users the client asked for, by number or cursor. */
+type pageRequest struct {
+	cursor string
+	limit  int
+	page   int
+}
+
+/*
+Parse the query parameter key as a count, i.e. a whole number that
+isn't negative, or get fallback if it isn't set.
+*/
+func parseCount(query url.Values, key string, fallback int) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("%s must be a whole number that isn't negative, not %q", key, value)
+	}
+
+	return count, nil
+}
+
+/*
+Parse the page, cursor and limit query parameters. A limit of 0, or
+none, is the default limit and a limit over the maximum is the
+maximum. A page can be asked for by number or cursor, not both.
+*/
+func parsePagination(query url.Values) (*pageRequest, error) {
+	page, err := parseCount(query, "page", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := parseCount(query, "limit", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit == 0 {
+		limit = defaultLimit
+	}
+
+	cursor := query.Get("cursor")
+	if cursor != "" && query.Has("page") {
+		return nil, errors.New("only one of cursor and page can be used")
+	}
+
+	return &pageRequest{cursor: cursor, limit: min(limit, maxLimit), page: page}, nil
+}
+
+/* The index of the last page of total users, limit to a page. */
+func lastPage(total int, limit int) int {
+	return max(total-1, 0) / limit
+}
+
+/* Get the URL of page of the request r, keeping its filters and sort. */
+func pageURL(r *http.Request, page int, limit int) string {
+	query := r.URL.Query()
+	query.Del("cursor")
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("page", strconv.Itoa(page))
+
+	return r.URL.Path + "?" + query.Encode()
+}
+
+/* Get the URL of the page after cursor of the request r, keeping its filters and sort. */
+func cursorURL(r *http.Request, cursor string, limit int) string {
+	query := r.URL.Query()
+	query.Del("page")
+	query.Set("cursor", cursor)
+	query.Set("limit", strconv.Itoa(limit))
+
+	return r.URL.Path + "?" + query.Encode()
+}
+
+/*
+Get the page of users, which are sorted by keys, that the request r
+asked for, with only the attributes in fields.
+
+A page by number counts from 0, and one past the end has no users
+rather than being an error. A page by cursor starts with the first
+user after the position of the cursor. As the position is a user's
+sort attributes rather than an index, users added or deleted before
+it don't move the page, so walking the users by cursor never skips or
+repeats one.
+*/
+func (us *UserService) paginate(r *http.Request, users []*user, keys []sortKey, req *pageRequest, fields fieldset) (*usersPage, error) {
+	p := &usersPage{
+		Users: []any{},
+		Total: len(users),
+		Limit: req.limit,
+	}
+
+	start := 0
+
+	if req.cursor != "" {
+		after, err := us.cursors.decode(req.cursor, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		i, found := slices.BinarySearchFunc(users, after, func(u *user, after *user) int {
+			return compareUsers(u, after, keys)
+		})
+		if found {
+			i++
+		}
+
+		start = i
+	} else {
+		p.Page = &req.page
+
+		start = len(users)
+		if req.page <= lastPage(len(users), req.limit) {
+			start = req.page * req.limit
+		}
+
+		/* the page before one past the end is the last */
+		if req.page > 0 {
+			p.Prev = pageURL(r, min(req.page-1, lastPage(len(users), req.limit)), req.limit)
+		}
+	}
+
+	end := min(start+req.limit, len(users))
+
+	for _, user := range users[start:end] {
+		p.Users = append(p.Users, user.project(fields))
+	}
+
+	if end < len(users) {
+		cursor, err := us.cursors.encode(keys, users[end-1])
+		if err != nil {
+			return nil, err
+		}
+
+		p.NextCursor = cursor
+
+		if req.cursor != "" {
+			p.Next = cursorURL(r, cursor, req.limit)
+		} else {
+			p.Next = pageURL(r, req.page+1, req.limit)
+		}
+	}
+
+	return p, nil
+}
+
+/*
+Set the RFC 8288 Link header to the first, previous, next and last
+pages of p. A page by cursor only links to the first and next pages.
+*/
+func setPageLinks(w http.ResponseWriter, r *http.Request, p *usersPage) {
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(r, 0, p.Limit))}
+
+	if p.Prev != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, p.Prev))
+	}
+
+	if p.Next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, p.Next))
+	}
+
+	if p.Page != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL(r, lastPage(p.Total, p.Limit), p.Limit)))
+	}
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+/*
+The users in the body of GET /users, which are decoded from its users
+attribute.
+*/
+type userList []map[string]string
+
+func (ul *userList) UnmarshalJSON(raw []byte) error {
+	body := struct {
+		Users []map[string]string `json:"users"`
+	}{}
+
+	err := json.Unmarshal(raw, &body)
+	if err != nil {
+		return err
+	}
+
+	*ul = body.Users
+
+	return nil
+}
+
+/* Post count Users with the nicknames user_0, user_1 and so on. */
+func postNumberedUsers(t *testing.T, us *UserService, count int) {
+	for i := 0; i < count; i++ {
+		postUser(t, us, map[string]string{
+			"country":    "GB",
+			"email":      fmt.Sprintf("user_%d@bob.com", i),
+			"first_name": "User",
+			"last_name":  fmt.Sprintf("%d", i),
+			"nickname":   fmt.Sprintf("user_%d", i),
+			"password":   alicePassword,
+		})
+	}
+}
+
+/*
+TestUsersGetPages: Given I have created Users when I call GET /users
+with a page and limit then the body has the page of Users, the total
+and links to the pages either side, which are in the Link header too.
+*/
+func TestUsersGetPages(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postNumberedUsers(t, us, 5)
+
+	for _, request := range []struct {
+		url    string
+		status int
+		users  int
+		page   int
+		limit  int
+		next   string
+		prev   string
+		link   string
+	}{
+		{
+			"/users", http.StatusOK, 5, 0, defaultLimit, "", "",
+			`</users?limit=100&page=0>; rel="first", </users?limit=100&page=0>; rel="last"`,
+		},
+		{
+			"/users?limit=2", http.StatusOK, 2, 0, 2, "/users?limit=2&page=1", "",
+			`</users?limit=2&page=0>; rel="first", </users?limit=2&page=1>; rel="next", </users?limit=2&page=2>; rel="last"`,
+		},
+		{
+			"/users?limit=2&page=1&sort=-nickname", http.StatusOK, 2, 1, 2, "/users?limit=2&page=2&sort=-nickname", "/users?limit=2&page=0&sort=-nickname",
+			`</users?limit=2&page=0&sort=-nickname>; rel="first", </users?limit=2&page=0&sort=-nickname>; rel="prev", </users?limit=2&page=2&sort=-nickname>; rel="next", </users?limit=2&page=2&sort=-nickname>; rel="last"`,
+		},
+		{
+			"/users?limit=2&page=2", http.StatusOK, 1, 2, 2, "", "/users?limit=2&page=1",
+			`</users?limit=2&page=0>; rel="first", </users?limit=2&page=1>; rel="prev", </users?limit=2&page=2>; rel="last"`,
+		},
+		{
+			"/users?limit=2&page=9", http.StatusNoContent, 0, 9, 2, "", "/users?limit=2&page=2",
+			`</users?limit=2&page=0>; rel="first", </users?limit=2&page=2>; rel="prev", </users?limit=2&page=2>; rel="last"`,
+		},
+		{
+			"/users?limit=5000", http.StatusOK, 5, 0, maxLimit, "", "",
+			`</users?limit=1000&page=0>; rel="first", </users?limit=1000&page=0>; rel="last"`,
+		},
+	} {
+		w := serveWithToken(t, us, "GET", request.url, "", "")
+
+		status := w.Result().StatusCode
+		if status != request.status {
+			t.Fatalf("%s: Got %d, %d expected.", request.url, status, request.status)
+		}
+
+		link := w.Header().Get("Link")
+		if link != request.link {
+			t.Fatalf("%s: expected Link %s but got %s", request.url, request.link, link)
+		}
+
+		if status == http.StatusNoContent {
+			continue
+		}
+
+		page := struct {
+			usersPage
+			Users []map[string]string `json:"users"`
+		}{}
+
+		err = json.NewDecoder(w.Body).Decode(&page)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if page.Page == nil {
+			t.Fatalf("%s: expected the page number", request.url)
+		}
+
+		if len(page.Users) != request.users || page.Total != 5 || *page.Page != request.page || page.Limit != request.limit {
+			t.Fatalf("%s: expected %d users of 5 on page %d of %d but got %d of %d on page %d of %d", request.url, request.users, request.page, request.limit, len(page.Users), page.Total, *page.Page, page.Limit)
+		}
+
+		if page.Next != request.next || page.Prev != request.prev || (page.NextCursor == "") != (page.Next == "") {
+			t.Fatalf("%s: expected next %q and prev %q but got %q and %q", request.url, request.next, request.prev, page.Next, page.Prev)
+		}
+	}
+}
+
+/*
+TestUsersGetRefusesBadPages: Given I call GET /users with a page or
+limit that isn't a whole number then the HTTP status code will be 400
+Bad Request.
+*/
+func TestUsersGetRefusesBadPages(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, url := range []string{"/users?page=-1", "/users?limit=-5", "/users?limit=ten", "/users?page=1.5"} {
+		w := serveWithToken(t, us, "GET", url, "", "")
+
+		expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+	}
+}
@@ -0,0 +1,219 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* Parameters of the argon2id key derivation function. */
+type argon2Params struct {
+	keyLength  uint32
+	memory     uint32
+	saltLength uint32
+	threads    uint8
+	time       uint32
+}
+
+/*
+The parameters passwords are hashed with, the second recommended
+option of RFC 9106. Hashes made with anything else are rehashed the
+next time the password is verified.
+*/
+var passwordParams = argon2Params{
+	keyLength:  32,
+	memory:     64 * 1024,
+	saltLength: 16,
+	threads:    4,
+	time:       3,
+}
+
+var errMalformedHash = errors.New("malformed password hash")
+
+/*
+Returned to stop an update when the password has been changed since
+the hash being replaced was read.
+*/
+var errPasswordChanged = errors.New("password changed since it was read")
+
+/*
+How many argon2id keys are derived at once, across every request. Each
+takes the memory of its parameters, 64 MiB, so without a limit enough
+logins at once could take all of the memory. Any more wait their turn.
+*/
+const maxConcurrentHashes = 4
+
+var hashSlots = make(chan struct{}, maxConcurrentHashes)
+
+/* Derive an argon2id key once there's a free slot for it. */
+func argon2Key(password string, salt []byte, p argon2Params) []byte {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+
+	return argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLength)
+}
+
+/*
+Hash a password with argon2id. The result is in the PHC string format,
+i.e. `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`, so the algorithm
+and parameters are stored alongside the hash.
+*/
+func hashPassword(password string) (string, error) {
+	p := passwordParams
+
+	salt := make([]byte, p.saltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2Key(password, salt, p)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.memory,
+		p.time,
+		p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+/*
+Is the stored password from before the service hashed passwords
+itself, i.e. exactly what the client sent?
+*/
+func isLegacyPassword(hash string) bool {
+	return !strings.HasPrefix(hash, "$")
+}
+
+/*
+Check password against the stored hash in constant time. rehash is
+true if the password matched but the hash should be replaced with one
+from hashPassword, as it is legacy, bcrypt or made with old parameters.
+*/
+func verifyPassword(hash string, password string) (ok bool, rehash bool, err error) {
+	switch {
+	case isLegacyPassword(hash):
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+
+		return ok, ok, nil
+	case strings.HasPrefix(hash, "$2"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+
+		return true, true, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	}
+
+	return false, false, errMalformedHash
+}
+
+func verifyArgon2id(hash string, password string) (bool, bool, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return false, false, errMalformedHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, errMalformedHash
+	}
+
+	p := argon2Params{}
+
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return false, false, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, false, errMalformedHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return false, false, errMalformedHash
+	}
+
+	p.saltLength = uint32(len(salt))
+	p.keyLength = uint32(len(expected))
+
+	key := argon2Key(password, salt, p)
+
+	if subtle.ConstantTimeCompare(key, expected) != 1 {
+		return false, false, nil
+	}
+
+	return true, p != passwordParams, nil
+}
+
+/*
+Check password against the user's stored hash. If the hash is due to
+be replaced it is rehashed now we know the password, which is how
+legacy and outdated hashes are upgraded on login.
+*/
+func (us *UserService) checkPassword(user *user, password string) (bool, error) {
+	ok, rehash, err := verifyPassword(user.Password, password)
+	if err != nil || !ok || !rehash {
+		return ok, err
+	}
+
+	err = us.replacePassword(user.ID, user.Password, password)
+	if err != nil {
+		log.Printf("unable to rehash password of %q: %s", user.ID, err.Error())
+	}
+
+	return true, nil
+}
+
+/*
+Replace the stored hash of the user with id with a fresh hash of
+password, unless the hash has been changed since it was stale. Then
+nothing is hashed or written, as the new password is already hashed.
+*/
+func (us *UserService) replacePassword(id string, stale string, password string) error {
+	current, err := us.store.Get(id)
+	if err != nil {
+		return err
+	} else if current.Password != stale {
+		return nil
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = us.store.Update(id, func(user *user) error {
+		if user.Password != stale {
+			return errPasswordChanged
+		}
+
+		user.Password = hash
+
+		return nil
+	})
+	if errors.Is(err, errPasswordChanged) {
+		return nil
+	}
+
+	return err
+}
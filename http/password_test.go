@@ -0,0 +1,346 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Hash passwords with cheap parameters while testing, as some tests
+create thousands of users.
+*/
+func TestMain(m *testing.M) {
+	passwordParams = argon2Params{
+		keyLength:  32,
+		memory:     64,
+		saltLength: 16,
+		threads:    1,
+		time:       1,
+	}
+
+	os.Exit(m.Run())
+}
+
+/*
+Does the attribute got from a User match what was sent? Passwords are
+hashed by the service, so they match if what was sent verifies
+against the hash.
+*/
+func sameAttribute(key string, sent string, got string) bool {
+	if key != "password" {
+		return sent == got
+	}
+
+	ok, _, err := verifyPassword(got, sent)
+
+	return err == nil && ok
+}
+
+/*
+TestHashPasswordVerifies: Given I have hashed a password when I verify
+the same and a different password against the hash then only the same
+password matches and neither needs rehashing.
+*/
+func TestHashPasswordVerifies(t *testing.T) {
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$") || strings.Contains(hash, password) {
+		t.Fatalf("expected an argon2id hash but got %q", hash)
+	}
+
+	ok, rehash, err := verifyPassword(hash, password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !ok || rehash {
+		t.Fatalf("expected password to match without rehash but got ok=%t rehash=%t", ok, rehash)
+	}
+
+	ok, _, err = verifyPassword(hash, "wrong")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if ok {
+		t.Fatal("expected a different password not to match")
+	}
+
+	other, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if other == hash {
+		t.Fatal("expected hashes of the same password to be salted differently")
+	}
+}
+
+/*
+TestVerifyPasswordRehash: Given a password is stored as a legacy
+value, a bcrypt hash or an argon2id hash with old parameters when I
+verify the right password then it matches and needs rehashing.
+*/
+func TestVerifyPasswordRehash(t *testing.T) {
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	current := passwordParams
+	passwordParams.time++
+
+	outdated, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	passwordParams = current
+
+	for name, hash := range map[string]string{
+		"legacy":   password,
+		"bcrypt":   string(bcrypted),
+		"outdated": outdated,
+	} {
+		ok, rehash, err := verifyPassword(hash, password)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		if !ok || !rehash {
+			t.Fatalf("%s: expected password to match with rehash but got ok=%t rehash=%t", name, ok, rehash)
+		}
+
+		ok, _, err = verifyPassword(hash, "wrong")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		if ok {
+			t.Fatalf("%s: expected a different password not to match", name)
+		}
+	}
+}
+
+/*
+TestCheckPasswordUpgradesHash: Given a User's password is stored as a
+legacy value when the password is checked then the stored value is
+replaced with an argon2id hash that still matches.
+*/
+func TestCheckPasswordUpgradesHash(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	legacy := &user{ID: "legacy", Password: password}
+
+	err = us.store.Create(legacy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ok, err := us.checkPassword(legacy, password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !ok {
+		t.Fatal("expected legacy password to match")
+	}
+
+	upgraded, err := us.store.Get("legacy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if isLegacyPassword(upgraded.Password) {
+		t.Fatalf("expected password to be upgraded but got %q", upgraded.Password)
+	}
+
+	ok, rehash, err := verifyPassword(upgraded.Password, password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !ok || rehash {
+		t.Fatalf("expected upgraded password to match without rehash but got ok=%t rehash=%t", ok, rehash)
+	}
+}
+
+/*
+TestLegacyPasswordsUpgradedOnLogin: Given a Store holds a User with a
+legacy password when a UserService is created with it then the password
+is left as it is until the User authenticates, when it's replaced with
+an argon2id hash.
+*/
+func TestLegacyPasswordsUpgradedOnLogin(t *testing.T) {
+	store := NewMemoryStore()
+
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	err := store.Create(&user{ID: "legacy", Email: "alice@bob.com", Nickname: "AB123", Password: password})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us, err := NewUserService(WithStore(store))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	untouched, err := store.Get("legacy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if untouched.Password != password {
+		t.Fatalf("expected the password not to be upgraded before login but got %q", untouched.Password)
+	}
+
+	w := postAuthenticate(t, us, `{"nickname":"AB123","password":"`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", w.Code, http.StatusOK)
+	}
+
+	upgraded, err := store.Get("legacy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ok, _, err := verifyPassword(upgraded.Password, password)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if isLegacyPassword(upgraded.Password) || !ok {
+		t.Fatalf("expected password to be upgraded to a matching hash but got %q", upgraded.Password)
+	}
+}
+
+/* A Store that counts the updates made through it. */
+type countingStore struct {
+	Store
+	updates int
+}
+
+func (cs *countingStore) Update(id string, modify func(user *user) error) (*user, error) {
+	cs.updates++
+
+	return cs.Store.Update(id, modify)
+}
+
+/*
+TestReplaceStalePassword: Given a User's password has been changed
+since the hash being replaced was read when it's replaced then the new
+password is kept and the Store isn't updated.
+*/
+func TestReplaceStalePassword(t *testing.T) {
+	store := &countingStore{Store: NewMemoryStore()}
+
+	us, err := NewUserService(WithStore(store))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	current, err := hashPassword("new password")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = store.Create(&user{ID: "changed", Password: current})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = us.replacePassword("changed", "old password", "old password")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kept, err := store.Get("changed")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if kept.Password != current || store.updates != 0 {
+		t.Fatalf("expected the password to be kept without an update but got %q after %d updates", kept.Password, store.updates)
+	}
+}
+
+/*
+TestPostStoresHashedPassword: Given I have created a User when I get
+it from the Store then the password is not stored as it was sent.
+*/
+func TestPostStoresHashedPassword(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	password := "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   password,
+	})
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if isLegacyPassword(users[0].Password) || strings.Contains(users[0].Password, password) {
+		t.Fatalf("expected password to be hashed but got %q", users[0].Password)
+	}
+}
+
+/*
+TestHashesWaitForSlot: Given maxConcurrentHashes hashes are already
+being derived when a password is hashed then it waits until one of
+them finishes.
+*/
+func TestHashesWaitForSlot(t *testing.T) {
+	for i := 0; i < maxConcurrentHashes; i++ {
+		hashSlots <- struct{}{}
+	}
+
+	done := make(chan string)
+	go func() {
+		hash, _ := hashPassword(alicePassword)
+		done <- hash
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected the password to wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < maxConcurrentHashes; i++ {
+		<-hashSlots
+	}
+
+	ok, _, err := verifyPassword(<-done, alicePassword)
+	if err != nil || !ok {
+		t.Fatalf("expected the password to be hashed once there was a slot but got %v", err)
+	}
+}
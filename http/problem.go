@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+/*
+Where the types of problem are documented. Each type is an anchor in
+the page, e.g. PROBLEMS.md#not-found.
+*/
+const problemTypes = "https://github.com/ploe/user-service/blob/main/docs/PROBLEMS.md#"
+
+/* The longest X-Request-Id accepted from a client. */
+const maxRequestIDLength = 128
+
+/*
+The most bytes of a JSON request body that are read. The bodies of
+every endpoint but an import are a handful of short attributes, so
+anything near this is a client sending too much.
+*/
+const maxBodyBytes = 64 << 10
+
+/* The key the request id is kept under in the context of a request. */
+type requestIDKey struct{}
+
+/*
+An RFC 7807 problem, the body of every response that isn't a success.
+Errors is only set when attributes sent by the client are invalid.
+*/
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+/*
+Make a problem for status. Its type is named after the status, e.g.
+404 Not Found is not-found.
+*/
+func newProblem(status int, detail string) *problem {
+	title := http.StatusText(status)
+
+	return &problem{
+		Type:   problemTypes + strings.ReplaceAll(strings.ToLower(title), " ", "-"),
+		Title:  title,
+		Status: status,
+		Detail: detail,
+	}
+}
+
+/*
+Give the request an id, so its problems can be matched up with the
+logs. A client can pick the id with the header X-Request-Id, otherwise
+one is made up, and either way it's sent back in the same header.
+*/
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-Id")
+	if len(id) == 0 || len(id) > maxRequestIDLength || strings.IndexFunc(id, isNotPrintable) >= 0 {
+		id = uuid.NewString()
+	}
+
+	w.Header().Set("X-Request-Id", id)
+
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+/* Is c outside of printable ASCII? */
+func isNotPrintable(c rune) bool {
+	return c < ' ' || c > '~'
+}
+
+/* Get the id withRequestID gave the request. */
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+
+	return id
+}
+
+/* Respond with the problem p as application/problem+json. */
+func writeProblem(w http.ResponseWriter, r *http.Request, p *problem) {
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r)
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("[%s] %s %s: unable to marshal problem %q", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+/* Count the status of p in the healthcheck and respond with it. */
+func (us *UserService) problem(w http.ResponseWriter, r *http.Request, p *problem) {
+	us.hc.increment(p.Status)
+	writeProblem(w, r, p)
+}
+
+/* Respond with a problem of status, where detail explains what went wrong. */
+func (us *UserService) fail(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	us.problem(w, r, newProblem(status, detail))
+}
+
+/*
+Decode the JSON body of r in to v, reading no more than maxBodyBytes of
+it. If there's more the error is a *http.MaxBytesError, see tooLarge.
+*/
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(v)
+}
+
+/*
+Respond 413 Request Entity Too Large if err is from reading more of the
+body than its limit, and say whether it was.
+*/
+func (us *UserService) tooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+
+	log.Printf("[%s] %s %s: the body is larger than %d bytes", r.RemoteAddr, r.Method, r.URL.Path, tooLarge.Limit)
+
+	us.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("the request body is larger than %d bytes", tooLarge.Limit))
+	return true
+}
+
+/* Respond 404 Not Found to a path that no endpoint is routed to. */
+func (us *UserService) notFound(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s %s: no such endpoint", r.RemoteAddr, r.Method, r.URL.Path)
+
+	us.fail(w, r, http.StatusNotFound, "there is no endpoint at this path")
+}
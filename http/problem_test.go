@@ -0,0 +1,173 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+Check w is the problem of kind with status, as application/problem+json
+with the request id and path of the request.
+*/
+func expectProblem(t *testing.T, w *httptest.ResponseRecorder, status int, kind string, path string) *problem {
+	if w.Result().StatusCode != status {
+		t.Fatalf("%s: Got %d, %d expected.", path, w.Result().StatusCode, status)
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	if contentType != "application/problem+json" {
+		t.Fatalf("%s: expected Content-Type application/problem+json but got %q", path, contentType)
+	}
+
+	p := &problem{}
+
+	err := json.NewDecoder(w.Body).Decode(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if p.Type != problemTypes+kind || p.Status != status || p.Title == "" || p.Detail == "" {
+		t.Fatalf("%s: expected a %d %s problem but got %+v", path, status, kind, p)
+	}
+
+	if p.Instance != path {
+		t.Fatalf("expected instance %q but got %q", path, p.Instance)
+	}
+
+	if p.RequestID == "" || p.RequestID != w.Header().Get("X-Request-Id") {
+		t.Fatalf("%s: expected request_id %q but got %q", path, w.Header().Get("X-Request-Id"), p.RequestID)
+	}
+
+	return p
+}
+
+/*
+TestFailuresAreProblems: Given a failing request for each status the
+service responds with when I send it then the body is a problem of that
+status.
+*/
+func TestFailuresAreProblems(t *testing.T) {
+	us, id := newSessionService(t)
+
+	access := logIn(t, us).AccessToken
+	other := "00000000-0000-0000-0000-000000000000"
+
+	for _, request := range []struct {
+		method string
+		url    string
+		token  string
+		body   string
+		status int
+		kind   string
+	}{
+		{"POST", "/users", "", "not json", http.StatusBadRequest, "bad-request"},
+		{"GET", "/users?email_verified=yes", "", "", http.StatusBadRequest, "bad-request"},
+		{"POST", "/users", "", `{"country":"UK"}`, http.StatusBadRequest, "invalid-attributes"},
+		{"POST", "/users/authenticate", "", `{"nickname":"AB123","password":"wrong"}`, http.StatusUnauthorized, "unauthorized"},
+		{"PATCH", "/users/" + id, "", `{"nickname":"alice"}`, http.StatusUnauthorized, "unauthorized"},
+		{"DELETE", "/users/" + other, access, "", http.StatusForbidden, "forbidden"},
+		{"GET", "/users/" + other, "", "", http.StatusNotFound, "not-found"},
+		{"GET", "/users/not-an-id", "", "", http.StatusNotFound, "not-found"},
+		{"GET", "/nowhere", "", "", http.StatusNotFound, "not-found"},
+		{"PUT", "/users", "", "", http.StatusMethodNotAllowed, "method-not-allowed"},
+		{"POST", "/healthcheck", "", "", http.StatusMethodNotAllowed, "method-not-allowed"},
+	} {
+		w := serveWithToken(t, us, request.method, request.url, request.token, request.body)
+
+		expectProblem(t, w, request.status, request.kind, strings.Split(request.url, "?")[0])
+	}
+
+	w := serveWithToken(t, us, "POST", "/users/"+id+"/mfa/totp/confirm", access, `{"totp":"123456"}`)
+	expectProblem(t, w, http.StatusConflict, "conflict", "/users/"+id+"/mfa/totp/confirm")
+
+	failAuthenticate(t, us, accountLockout.threshold-2)
+
+	w = postAuthenticate(t, us, `{"nickname":"AB123","password":"wrong"}`)
+	expectProblem(t, w, http.StatusTooManyRequests, "too-many-requests", "/users/authenticate")
+}
+
+/*
+TestLargeBodyIsProblem: Given a body larger than maxBodyBytes when I
+send it to each endpoint that decodes one then it isn't read and the
+response is a 413 Request Entity Too Large problem.
+*/
+func TestLargeBodyIsProblem(t *testing.T) {
+	us, id := newSessionService(t)
+
+	access := logIn(t, us).AccessToken
+	body := `{"nickname":"` + strings.Repeat("a", maxBodyBytes) + `"}`
+
+	for _, request := range []struct {
+		method string
+		url    string
+		token  string
+	}{
+		{"POST", "/users", ""},
+		{"PATCH", "/users/" + id, access},
+		{"POST", "/users/authenticate", ""},
+		{"POST", "/users/verify-email", ""},
+		{"POST", "/users/password-reset", ""},
+		{"POST", "/users/password-reset/confirm", ""},
+		{"POST", "/users/token/refresh", ""},
+		{"POST", "/users/token/revoke", ""},
+		{"POST", "/users/" + id + "/mfa/totp/confirm", access},
+	} {
+		w := serveWithToken(t, us, request.method, request.url, request.token, body)
+
+		expectProblem(t, w, http.StatusRequestEntityTooLarge, "request-entity-too-large", request.url)
+	}
+
+	w := serveWithToken(t, us, "POST", "/users", "", body[:maxBodyBytes-len(`"}`)]+`"}`)
+	expectProblem(t, w, http.StatusBadRequest, "invalid-attributes", "/users")
+}
+
+/*
+TestBrokenStoreIsProblem: Given the UserService's Store is failing when
+I call GET /users then the body is a 500 Internal Server Error problem,
+which doesn't give away why the Store failed.
+*/
+func TestBrokenStoreIsProblem(t *testing.T) {
+	us, err := NewUserService(WithStore(brokenStore{}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := serveWithToken(t, us, "GET", "/users", "", "")
+
+	p := expectProblem(t, w, http.StatusInternalServerError, "internal-server-error", "/users")
+	if p.Detail != "unable to get users" {
+		t.Fatalf("expected the detail not to include the error but got %q", p.Detail)
+	}
+}
+
+/*
+TestRequestIDIsKept: Given I send a request with an X-Request-Id when
+it fails then the problem has my request id, unless it isn't printable.
+*/
+func TestRequestIDIsKept(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for sent, kept := range map[string]bool{
+		"my-request-1":           true,
+		"not\nprintable":         false,
+		strings.Repeat("a", 129): false,
+		strings.Repeat("a", 128): true,
+	} {
+		req := httptest.NewRequest("GET", "/users/not-an-id", nil)
+		req.Header.Set("X-Request-Id", sent)
+
+		w := httptest.NewRecorder()
+		us.ServeHTTP(w, req)
+
+		p := expectProblem(t, w, http.StatusNotFound, "not-found", "/users/not-an-id")
+		if (p.RequestID == sent) != kept {
+			t.Fatalf("expected %q kept to be %t but got %q", sent, kept, p.RequestID)
+		}
+	}
+}
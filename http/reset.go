@@ -0,0 +1,205 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* How long a password reset token can be used for. */
+const passwordResetTTL = time.Hour
+
+/*
+A token that can be used once before it expires, e.g. to reset a
+password. Only the hash of the token is kept.
+*/
+type oneTimeToken struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Hash      string    `json:"hash"`
+}
+
+/* Is presented the token, and has it not expired at now? */
+func (ott *oneTimeToken) accepts(presented string, now time.Time) bool {
+	if ott == nil || !now.Before(ott.ExpiresAt) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(ott.Hash), []byte(hashOpaqueToken(presented))) == 1
+}
+
+/*
+Make a new password reset token for the user with id and send it to
+them. Any token they were sent before can no longer be used.
+*/
+func (us *UserService) requestPasswordReset(id string) error {
+	token, hash, err := newOpaqueToken(id)
+	if err != nil {
+		return err
+	}
+
+	now := us.clock()
+
+	user, err := us.store.Update(id, func(user *user) error {
+		user.Auth.PasswordReset = &oneTimeToken{
+			ExpiresAt: now.Add(passwordResetTTL),
+			Hash:      hash,
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return us.notifier.Notify(&Message{
+		Body:    fmt.Sprintf("Use this token to reset your password, it expires in %s:\n\n%s\n", passwordResetTTL, token),
+		SentAt:  now,
+		Subject: "Reset your password",
+		To:      user.Email,
+	})
+}
+
+/*
+Set the password of the user the reset token belongs to. The token is
+used up, and as whoever had the old password may have been an
+attacker, the user's sessions and any lockout are cleared too.
+
+The token is checked before the password is hashed, so a stream of
+made up tokens can't keep the hashSlots busy, and again when the
+password is set in case it was used in the meantime.
+*/
+func (us *UserService) confirmPasswordReset(presented string, password string) error {
+	id, ok := opaqueTokenUser(presented)
+	if !ok {
+		return errInvalidToken
+	}
+
+	now := us.clock()
+
+	current, err := us.store.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return errInvalidToken
+	} else if err != nil {
+		return err
+	}
+
+	if !current.Auth.PasswordReset.accepts(presented, now) {
+		return errInvalidToken
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = us.store.Update(id, func(user *user) error {
+		if !user.Auth.PasswordReset.accepts(presented, now) {
+			return errInvalidToken
+		}
+
+		user.Password = hash
+		user.UpdatedAt.tm = now
+		user.Auth.FailedAttempts = 0
+		user.Auth.LockedUntil = nil
+		user.Auth.PasswordReset = nil
+		user.Auth.RefreshTokens = nil
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return errInvalidToken
+	}
+
+	return err
+}
+
+func (us *UserService) passwordReset(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/password-reset: attempting to request password reset", sender)
+
+	data := map[string]string{}
+
+	err := decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || data["email"] == "" {
+		log.Printf("[%s] POST /users/password-reset: expected email", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected email")
+		return
+	}
+
+	users, err := us.store.List([]*filter{belongsTo("email", data["email"])})
+	if err != nil {
+		log.Printf("[%s] POST /users/password-reset: unable to get users: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to get users")
+		return
+	}
+
+	for _, user := range users {
+		err = us.requestPasswordReset(user.ID)
+		if err != nil {
+			log.Printf("[%s] POST /users/password-reset: unable to reset password of %q: %s", sender, user.ID, err.Error())
+
+			us.fail(w, r, http.StatusInternalServerError, "unable to reset the password")
+			return
+		}
+
+		log.Printf("[%s] POST /users/password-reset: sent password reset to %q", sender, user.ID)
+	}
+
+	/* accepted whether or not anyone has the email, so it doesn't give away who does */
+	us.hc.increment(http.StatusAccepted)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (us *UserService) passwordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/password-reset/confirm: attempting to reset password", sender)
+
+	data := map[string]string{}
+
+	err := decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || data["token"] == "" || data["password"] == "" {
+		log.Printf("[%s] POST /users/password-reset/confirm: expected token and password", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected token and password")
+		return
+	}
+
+	message := validatePassword(data["password"])
+	if message != "" {
+		us.invalid(w, r, []fieldError{{"password", message}})
+		return
+	}
+
+	err = us.confirmPasswordReset(data["token"], data["password"])
+	if errors.Is(err, errInvalidToken) {
+		log.Printf("[%s] POST /users/password-reset/confirm: token is not valid", sender)
+
+		us.fail(w, r, http.StatusUnauthorized, "the token is not valid")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/password-reset/confirm: unable to reset password: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to reset the password")
+		return
+	}
+
+	log.Printf("[%s] POST /users/password-reset/confirm: reset password", sender)
+
+	us.hc.increment(http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,280 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* recordingNotifier is a Notifier that keeps the messages it is sent. */
+type recordingNotifier struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (rn *recordingNotifier) Notify(message *Message) error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.messages = append(rn.messages, message)
+
+	return nil
+}
+
+/* Get the token at the end of the last message sent, failing the test if none was. */
+func (rn *recordingNotifier) lastToken(t *testing.T) string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if len(rn.messages) == 0 {
+		t.Fatal("expected a message to have been sent")
+	}
+
+	fields := strings.Fields(rn.messages[len(rn.messages)-1].Body)
+
+	return fields[len(fields)-1]
+}
+
+/* Create a UserService that records its messages, with the User AB123 in it. */
+func newNotifyingService(t *testing.T, options ...Option) (*UserService, *recordingNotifier) {
+	notifier := &recordingNotifier{}
+
+	us, err := NewUserService(append(options, WithNotifier(notifier))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	return us, notifier
+}
+
+/* POST a body to path and get the status code. */
+func postStatus(t *testing.T, us *UserService, path string, body string) int {
+	return serveWithToken(t, us, "POST", path, "", body).Result().StatusCode
+}
+
+/*
+TestPasswordResetSetsPassword: Given I have requested a password reset
+when I confirm it with the token I was sent then the HTTP status code
+will be 204 No Content and I can authenticate with the new password
+but not the old one.
+*/
+func TestPasswordResetSetsPassword(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	status := postStatus(t, us, "/users/password-reset", `{"email":"alice@bob.com"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusAccepted)
+	}
+
+	if notifier.messages[0].To != "alice@bob.com" {
+		t.Fatalf("expected message to %q but got %q", "alice@bob.com", notifier.messages[0].To)
+	}
+
+	token := notifier.lastToken(t)
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if users[0].Auth.PasswordReset == nil || users[0].Auth.PasswordReset.Hash == token {
+		t.Fatalf("expected the hash of the token to be stored but got %+v", users[0].Auth.PasswordReset)
+	}
+
+	status = postStatus(t, us, "/users/password-reset/confirm", `{"token":"`+token+`","password":"new password"}`)
+	if status != http.StatusNoContent {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusNoContent)
+	}
+
+	for password, expected := range map[string]int{
+		alicePassword:  http.StatusUnauthorized,
+		"new password": http.StatusOK,
+	} {
+		status = postAuthenticate(t, us, `{"nickname":"AB123","password":"`+password+`"}`).Result().StatusCode
+		if status != expected {
+			t.Fatalf("Unexpected error code for %q. Got %d, %d expected.", password, status, expected)
+		}
+	}
+}
+
+/*
+TestPasswordResetIgnoresCase: Given I have created a User when I
+request a password reset with their email in another case then the
+token is sent to the email they have.
+*/
+func TestPasswordResetIgnoresCase(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	sent := len(notifier.messages)
+
+	status := postStatus(t, us, "/users/password-reset", `{"email":"ALICE@bob.com"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusAccepted)
+	}
+
+	if len(notifier.messages) != sent+1 || notifier.messages[sent].To != "alice@bob.com" {
+		t.Fatalf("expected a password reset to be sent to alice@bob.com but got %d messages", len(notifier.messages)-sent)
+	}
+}
+
+/*
+TestPasswordResetTokenIsSingleUse: Given I have reset my password with
+a token when I use the token again then the HTTP status code will be
+401 Unauthorized.
+*/
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	postStatus(t, us, "/users/password-reset", `{"email":"alice@bob.com"}`)
+	token := notifier.lastToken(t)
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusUnauthorized} {
+		status := postStatus(t, us, "/users/password-reset/confirm", `{"token":"`+token+`","password":"new password"}`)
+		if status != expected {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, expected)
+		}
+	}
+}
+
+/*
+TestPasswordResetTokenExpires: Given I have requested a password reset
+when I confirm it after the token expired, or with an earlier token,
+then the HTTP status code will be 401 Unauthorized.
+*/
+func TestPasswordResetTokenExpires(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	postStatus(t, us, "/users/password-reset", `{"email":"alice@bob.com"}`)
+	earlier := notifier.lastToken(t)
+
+	postStatus(t, us, "/users/password-reset", `{"email":"alice@bob.com"}`)
+	token := notifier.lastToken(t)
+
+	status := postStatus(t, us, "/users/password-reset/confirm", `{"token":"`+earlier+`","password":"new password"}`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+
+	us.clock = func() time.Time { return time.Now().Add(passwordResetTTL) }
+
+	status = postStatus(t, us, "/users/password-reset/confirm", `{"token":"`+token+`","password":"new password"}`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+}
+
+/*
+TestPasswordResetChecksTokenBeforeHashing: Given every hash slot is
+taken when a password reset is confirmed with a token that isn't valid
+then the HTTP status code will be 401 Unauthorized without waiting for
+a slot.
+*/
+func TestPasswordResetChecksTokenBeforeHashing(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	postStatus(t, us, "/users/password-reset", `{"email":"alice@bob.com"}`)
+	token := notifier.lastToken(t)
+	id, _ := opaqueTokenUser(token)
+
+	for i := 0; i < maxConcurrentHashes; i++ {
+		hashSlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < maxConcurrentHashes; i++ {
+			<-hashSlots
+		}
+	}()
+
+	for _, presented := range []string{token + "x", id + ".made-up", "00000000-0000-0000-0000-000000000000.made-up"} {
+		done := make(chan int)
+		go func() {
+			done <- postStatus(t, us, "/users/password-reset/confirm", `{"token":"`+presented+`","password":"new password"}`)
+		}()
+
+		select {
+		case status := <-done:
+			if status != http.StatusUnauthorized {
+				t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to be refused without hashing the password", presented)
+		}
+	}
+}
+
+/*
+TestPasswordResetOfUnknownEmailIsAccepted: Given nobody has an email
+when a password reset is requested for it then the HTTP status code
+will be 202 Accepted, the same as for an email somebody has, but
+nothing is sent. Malformed requests are 400 Bad Request.
+*/
+func TestPasswordResetOfUnknownEmailIsAccepted(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	sent := len(notifier.messages)
+
+	for body, expected := range map[string]int{
+		`{"email":"nobody@bob.com"}`:             http.StatusAccepted,
+		`{"nickname":"AB123"}`:                   http.StatusBadRequest,
+		`not json`:                               http.StatusBadRequest,
+		`{"token":"","password":"new password"}`: http.StatusBadRequest,
+	} {
+		status := postStatus(t, us, "/users/password-reset", body)
+		if status != expected {
+			t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", body, status, expected)
+		}
+	}
+
+	if len(notifier.messages) != sent {
+		t.Fatalf("expected no messages but got %d", len(notifier.messages)-sent)
+	}
+}
+
+/*
+TestOutboxNotifierAppendsMessages: Given an outbox notifier when it is
+sent messages then each is appended to its file as a line of JSON.
+*/
+func TestOutboxNotifierAppendsMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.ndjson")
+
+	notifier := NewOutboxNotifier(path)
+
+	for _, to := range []string{"alice@bob.com", "ken@bob.com"} {
+		err := notifier.Notify(&Message{Body: "hello", Subject: "hi", To: to})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+
+	got := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		message := Message{}
+
+		err = json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		got = append(got, message.To)
+	}
+
+	if strings.Join(got, ",") != "alice@bob.com,ken@bob.com" {
+		t.Fatalf("expected messages to both users but got %q", got)
+	}
+}
@@ -0,0 +1,311 @@
+package http
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* The attributes of users that the q parameter of GET /users searches. */
+var searchAttributes = []string{"email", "first_name", "last_name", "nickname"}
+
+/*
+searchIndex is an inverted index of the tokens of the searchAttributes
+of users, from each token to the set of ids of the users that have it.
+sorted is every token in the index in order, so the tokens with a
+prefix are next to each other and can be found by a binary search. A
+new token is inserted in to it, unless the index is loading, when
+sorted is only made once every user is in. tokens are those of each
+user, so a user can be removed by id alone.
+*/
+type searchIndex struct {
+	loading  bool
+	postings map[string]idSet
+	sorted   []string
+	tokens   map[string][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]idSet),
+		tokens:   make(map[string][]string),
+	}
+}
+
+/*
+Split text in to lower case tokens at anything that isn't a letter or
+digit, so alice.bob@example.com is alice, bob, example and com.
+*/
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+/* Get the distinct tokens of the searchAttributes of u. */
+func searchTokens(u *user) []string {
+	tokens := []string{}
+	for _, attribute := range searchAttributes {
+		tokens = append(tokens, tokenize(u.attribute(attribute))...)
+	}
+
+	slices.Sort(tokens)
+
+	return slices.Compact(tokens)
+}
+
+/*
+How many edits a term can be from a token and still match it. Short
+terms have to be spelled right, as one edit would match most tokens.
+*/
+func fuzziness(term string) int {
+	switch length := utf8.RuneCountInString(term); {
+	case length < 3:
+		return 0
+	case length < 6:
+		return 1
+	}
+
+	return 2
+}
+
+/*
+Does the term match the token, by being a prefix of it or a few edits
+from it? A misspelt term still has to start with the same letter as
+the token, so a lookup only compares it with the tokens that do.
+*/
+func termMatches(term string, token string) bool {
+	if strings.HasPrefix(token, term) {
+		return true
+	}
+
+	limit := fuzziness(term)
+
+	return limit > 0 && strings.HasPrefix(token, firstRune(term)) && editDistance(term, token, limit) <= limit
+}
+
+/* Get the first rune of s as a string. */
+func firstRune(s string) string {
+	_, size := utf8.DecodeRuneInString(s)
+
+	return s[:size]
+}
+
+/*
+Get how many insertions, deletions, substitutions and transpositions
+of adjacent runes it takes to turn a in to b, or limit+1 as soon as
+it's known to be more than limit.
+*/
+func editDistance(a string, b string, limit int) int {
+	/* strings of very different lengths can be told apart without the matrix */
+	difference := utf8.RuneCountInString(a) - utf8.RuneCountInString(b)
+	if difference > limit || -difference > limit {
+		return limit + 1
+	}
+
+	s, t := []rune(a), []rune(b)
+
+	/* the rows of the matrix for the last two runes of s and this one */
+	before := make([]int, len(t)+1)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		smallest := i
+
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				current[j] = min(current[j], before[j-2]+1)
+			}
+
+			smallest = min(smallest, current[j])
+		}
+
+		/* no later row can be less than the smallest of this one */
+		if smallest > limit {
+			return limit + 1
+		}
+
+		before, previous, current = previous, current, before
+	}
+
+	return min(previous[len(t)], limit+1)
+}
+
+/* Does u have a token that matches each of the terms? */
+func searchMatches(u *user, terms []string) bool {
+	tokens := searchTokens(u)
+
+	for _, term := range terms {
+		matched := slices.ContainsFunc(tokens, func(token string) bool {
+			return termMatches(term, token)
+		})
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Add u to the index, replacing the tokens it had before if it was already in it. */
+func (si *searchIndex) add(u *user) {
+	si.remove(u.ID)
+
+	tokens := searchTokens(u)
+	for _, token := range tokens {
+		ids, ok := si.postings[token]
+		if !ok {
+			ids = make(idSet)
+			si.postings[token] = ids
+
+			if !si.loading {
+				i, _ := slices.BinarySearch(si.sorted, token)
+				si.sorted = slices.Insert(si.sorted, i, token)
+			}
+		}
+
+		ids[u.ID] = struct{}{}
+	}
+
+	si.tokens[u.ID] = tokens
+}
+
+/* Remove the user with id from the index. */
+func (si *searchIndex) remove(id string) {
+	for _, token := range si.tokens[id] {
+		ids := si.postings[token]
+		delete(ids, id)
+
+		if len(ids) > 0 {
+			continue
+		}
+
+		delete(si.postings, token)
+
+		i, ok := slices.BinarySearch(si.sorted, token)
+		if ok && !si.loading {
+			si.sorted = slices.Delete(si.sorted, i, i+1)
+		}
+	}
+
+	delete(si.tokens, id)
+}
+
+/*
+Start loading every user in to the index. Until loaded is called new
+tokens aren't inserted in to sorted, as inserting each of them would
+take quadratic time.
+*/
+func (si *searchIndex) load() {
+	si.loading = true
+}
+
+/* Finish loading the index by sorting all of its tokens at once. */
+func (si *searchIndex) loaded() {
+	si.sorted = make([]string, 0, len(si.postings))
+	for token := range si.postings {
+		si.sorted = append(si.sorted, token)
+	}
+
+	slices.Sort(si.sorted)
+
+	si.loading = false
+}
+
+/* Get the tokens in the index that start with prefix, in order. */
+func (si *searchIndex) withPrefix(prefix string) []string {
+	start, _ := slices.BinarySearch(si.sorted, prefix)
+	rest := si.sorted[start:]
+
+	end := sort.Search(len(rest), func(i int) bool {
+		return !strings.HasPrefix(rest[i], prefix)
+	})
+
+	return rest[:end]
+}
+
+/*
+Get the tokens in the index a term could match. A term too short to
+be misspelt only matches the tokens it's a prefix of, and any other
+term only the tokens that start with its first letter.
+*/
+func (si *searchIndex) candidates(term string) []string {
+	if fuzziness(term) == 0 {
+		return si.withPrefix(term)
+	}
+
+	return si.withPrefix(firstRune(term))
+}
+
+/*
+Get the ids of the users with a token that matches each of the terms.
+Each term is only compared with the candidates, the tokens that start
+with the term or its first letter, which are found by a binary search
+of the sorted tokens. There can still be as many tokens as users, as
+most emails have one nobody else has, but only a slice of them go
+through the edit distance. Only the ids of the term that matches the
+fewest users are copied, and the others are checked against them.
+*/
+func (si *searchIndex) lookup(terms []string) idSet {
+	matches := make([][]idSet, len(terms))
+	sizes := make([]int, len(terms))
+
+	for i, term := range terms {
+		for _, token := range si.candidates(term) {
+			if termMatches(term, token) {
+				posting := si.postings[token]
+
+				matches[i] = append(matches[i], posting)
+				sizes[i] += len(posting)
+			}
+		}
+
+		if sizes[i] == 0 {
+			return idSet{}
+		}
+	}
+
+	smallest := 0
+	for i := range terms {
+		if sizes[i] < sizes[smallest] {
+			smallest = i
+		}
+	}
+
+	found := make(idSet, sizes[smallest])
+	for _, posting := range matches[smallest] {
+		maps.Copy(found, posting)
+	}
+
+	for i, postings := range matches {
+		if i == smallest {
+			continue
+		}
+
+		maps.DeleteFunc(found, func(id string, _ struct{}) bool {
+			return !slices.ContainsFunc(postings, func(posting idSet) bool {
+				_, ok := posting[id]
+				return ok
+			})
+		})
+	}
+
+	return found
+}
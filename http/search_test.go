@@ -0,0 +1,237 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+TestEditDistance: Given two strings when the edit distance between them
+is found then insertions, deletions, substitutions and transpositions
+each count as one, and anything over the limit is the limit plus one.
+*/
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		limit    int
+		distance int
+	}{
+		{"robert", "robert", 2, 0},
+		{"robrt", "robert", 2, 1},
+		{"roberto", "robert", 2, 1},
+		{"robart", "robert", 2, 1},
+		{"rboert", "robert", 2, 1},
+		{"rbeort", "robert", 2, 2},
+		{"alice", "robert", 2, 3},
+		{"al", "robert", 2, 3},
+		{"zoë", "zoe", 1, 1},
+		{"", "bob", 3, 3},
+	} {
+		distance := editDistance(test.a, test.b, test.limit)
+		if distance != test.distance {
+			t.Fatalf("expected %q to be %d from %q but got %d", test.a, test.distance, test.b, distance)
+		}
+	}
+}
+
+/*
+TestSearchIndexLookup: Given a search index of users when they are
+added, modified and removed then a lookup finds only the users that
+have a token matching each term now, a misspelt term only matching
+tokens with the same first letter, and the tokens stay sorted.
+*/
+func TestSearchIndexLookup(t *testing.T) {
+	si := newSearchIndex()
+
+	si.add(&user{ID: "1", FirstName: "Robert", LastName: "Smith", Nickname: "bobby", Email: "rob@smith.com"})
+	si.add(&user{ID: "2", FirstName: "Alice", LastName: "Jones", Nickname: "AJ", Email: "alice@jones.com"})
+
+	for _, test := range []struct {
+		terms []string
+		ids   []string
+	}{
+		{[]string{"smiht"}, []string{"1"}},
+		{[]string{"rob", "smith"}, []string{"1"}},
+		{[]string{"com"}, []string{"1", "2"}},
+		{[]string{"alice", "smith"}, []string{}},
+		{[]string{"lice"}, []string{}},
+		{[]string{"jnoes"}, []string{"2"}},
+	} {
+		ids := []string{}
+		for id := range si.lookup(test.terms) {
+			ids = append(ids, id)
+		}
+
+		slices.Sort(ids)
+		if !slices.Equal(ids, test.ids) {
+			t.Fatalf("%v: expected %v but got %v", test.terms, test.ids, ids)
+		}
+	}
+
+	si.add(&user{ID: "1", FirstName: "Robert", LastName: "Jones", Nickname: "bobby", Email: "rob@jones.com"})
+	si.remove("2")
+
+	if len(si.lookup([]string{"smith"})) != 0 || len(si.lookup([]string{"alice"})) != 0 {
+		t.Fatal("expected the old tokens to be gone")
+	}
+
+	if _, ok := si.lookup([]string{"jones"})["1"]; !ok {
+		t.Fatal("expected the new tokens to be found")
+	}
+
+	if _, ok := si.postings["alice"]; ok {
+		t.Fatal("expected tokens nobody has to be removed")
+	}
+
+	expected := []string{"bobby", "com", "jones", "rob", "robert"}
+	if !slices.Equal(si.sorted, expected) {
+		t.Fatalf("expected the sorted tokens %v but got %v", expected, si.sorted)
+	}
+}
+
+/*
+TestUsersGetSearches: Given I have created Users when I call GET /users
+with q then the Users with a name, nickname or email matching each
+word, by prefix or a spelling mistake or two, are returned, and the
+search keeps up with PATCH and DELETE, with the memory store and the
+SQL store.
+*/
+func TestUsersGetSearches(t *testing.T) {
+	for name, options := range map[string][]Option{
+		"memory": {},
+		"sql":    {WithDatabase(filepath.Join(t.TempDir(), "users.db"))},
+	} {
+		now := time.Unix(1700000000, 0)
+
+		us, err := NewUserService(append(options, WithClock(func() time.Time { return now }))...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		postSortableUsers(t, us, &now, [][2]string{
+			{"Rob", "Smith"},
+			{"robert", "smith"},
+			{"alice", "Jones"},
+			{"bobby", "Brown"},
+		})
+
+		for q, expected := range map[string]string{
+			"robert":      "robert",
+			"robrt":       "robert",
+			"ROBE":        "Rob,robert",
+			"alic":        "alice",
+			"smiht":       "Rob,robert",
+			"rob smith":   "Rob,robert",
+			"bobby":       "bobby",
+			"jnoes alice": "alice",
+			"bob":         "Rob,robert,alice,bobby",
+		} {
+			got := getNicknames(t, us, "/users?q="+url.QueryEscape(q))
+			if got != expected {
+				t.Fatalf("%s: %s: expected %s but got %s", name, q, expected, got)
+			}
+		}
+
+		if got := getNicknames(t, us, "/users?q=smith&country=GB&nickname[not_eq]=Rob"); got != "robert" {
+			t.Fatalf("%s: expected a search to combine with filters but got %s", name, got)
+		}
+
+		ids := map[string]string{}
+		for _, user := range getUsers(t, us, "/users") {
+			ids[user["nickname"]] = user["id"]
+		}
+
+		serveWithToken(t, us, "PATCH", "/users/"+ids["alice"], "", `{"last_name":"Smithers"}`)
+		serveWithToken(t, us, "DELETE", "/users/"+ids["Rob"], "", "")
+
+		if got := getNicknames(t, us, "/users?q=smith"); got != "robert,alice" {
+			t.Fatalf("%s: expected the search to follow PATCH and DELETE but got %s", name, got)
+		}
+
+		w := serveWithToken(t, us, "GET", "/users?q=jones", "", "")
+		if w.Result().StatusCode != http.StatusNoContent {
+			t.Fatalf("%s: expected nobody to be called jones now but got %d", name, w.Result().StatusCode)
+		}
+	}
+}
+
+/*
+TestUsersGetRefusesEmptySearch: Given I call GET /users with a q that
+has no letters or digits then the HTTP status code will be 400 Bad
+Request.
+*/
+func TestUsersGetRefusesEmptySearch(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := serveWithToken(t, us, "GET", "/users?q=%40%2E", "", "")
+
+	expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+}
+
+/*
+TestSearchIndexLoad: Given a search index loaded with users when more
+are added and removed then its tokens stay sorted and lookups find
+the users loaded and added.
+*/
+func TestSearchIndexLoad(t *testing.T) {
+	si := newSearchIndex()
+
+	si.load()
+	si.add(&user{ID: "1", FirstName: "Robert", LastName: "Smith"})
+	si.add(&user{ID: "2", FirstName: "Alice", LastName: "Jones"})
+	si.add(&user{ID: "1", FirstName: "Rob", LastName: "Smith"})
+	si.loaded()
+
+	si.add(&user{ID: "3", FirstName: "Bobby", LastName: "Brown"})
+	si.remove("2")
+
+	expected := []string{"bobby", "brown", "rob", "smith"}
+	if !slices.Equal(si.sorted, expected) {
+		t.Fatalf("expected the sorted tokens %v but got %v", expected, si.sorted)
+	}
+
+	for term, id := range map[string]string{"smith": "1", "brwn": "3"} {
+		if _, ok := si.lookup([]string{term})[id]; !ok {
+			t.Fatalf("expected %s to find %s", term, id)
+		}
+	}
+}
+
+/*
+BenchmarkSearchIndexLoad: load a search index with users that each
+have tokens nobody else has, as most emails do, which is the most
+tokens the index can have to sort.
+*/
+func BenchmarkSearchIndexLoad(b *testing.B) {
+	for _, count := range []int{10000, 80000, 400000} {
+		users := make([]*user, count)
+		for i := range users {
+			id := uuid.NewString()
+
+			users[i] = &user{ID: id, FirstName: "Rob", LastName: "Bob", Nickname: id[:8], Email: id[9:] + "@bob.com"}
+		}
+
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				si := newSearchIndex()
+				si.load()
+
+				for _, u := range users {
+					si.add(u)
+				}
+
+				si.loaded()
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+/* How long a refresh token can be used for. */
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+/*
+authState is what a user needs to log in besides their password. It
+is persisted with the user but never returned to clients.
+*/
+type authState struct {
+	EmailVerification *oneTimeToken  `json:"email_verification,omitempty"`
+	FailedAttempts    int            `json:"failed_attempts,omitempty"`
+	LockedUntil       *time.Time     `json:"locked_until,omitempty"`
+	PasswordReset     *oneTimeToken  `json:"password_reset,omitempty"`
+	RefreshTokens     []refreshToken `json:"refresh_tokens,omitempty"`
+	TOTP              *totpState     `json:"totp,omitempty"`
+}
+
+/*
+A session of a user, which only keeps the hash of its latest refresh
+token. Every refresh token of the session names its family, so one
+that's presented with the family of a session but isn't the latest has
+been used before.
+*/
+type refreshToken struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Family    string    `json:"family"`
+	Hash      string    `json:"hash"`
+}
+
+/* The access and refresh tokens returned when a session starts or is refreshed. */
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+}
+
+/* Make a copy of the auth state that can be modified independently. */
+func (a authState) clone() authState {
+	a.EmailVerification = clonePointer(a.EmailVerification)
+	a.LockedUntil = clonePointer(a.LockedUntil)
+	a.PasswordReset = clonePointer(a.PasswordReset)
+	a.RefreshTokens = slices.Clone(a.RefreshTokens)
+
+	a.TOTP = clonePointer(a.TOTP)
+	if a.TOTP != nil {
+		a.TOTP.RecoveryCodes = slices.Clone(a.TOTP.RecoveryCodes)
+	}
+
+	return a
+}
+
+/* Copy what p points at, so the copy can be modified independently. */
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+
+	c := *p
+
+	return &c
+}
+
+/*
+Drop the refresh tokens that have expired at now, and any from before
+sessions had families, which can't be used.
+*/
+func (a *authState) pruneRefreshTokens(now time.Time) {
+	a.RefreshTokens = slices.DeleteFunc(a.RefreshTokens, func(token refreshToken) bool {
+		return !now.Before(token.ExpiresAt) || token.Family == ""
+	})
+}
+
+/*
+Make a new opaque token for the user with id, returning the token and
+the hash of it to store. The id is part of the token so the user it
+belongs to can be found without storing the token anywhere else.
+*/
+func newOpaqueToken(id string) (string, string, error) {
+	secret := make([]byte, 32)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := id + "." + base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, hashOpaqueToken(token), nil
+}
+
+/*
+Hash an opaque token for storage. The tokens are random, so unlike a
+password a fast hash is enough.
+*/
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Make a new refresh token for the session family of the user with id,
+returning the token and the hash of it to store. The token is the id,
+the family and then the secret, each separated by a dot.
+*/
+func newRefreshToken(id string, family string) (string, string, error) {
+	return newOpaqueToken(id + "." + family)
+}
+
+/* Make the id of a new session. */
+func newRefreshFamily() (string, error) {
+	family := make([]byte, 16)
+
+	_, err := rand.Read(family)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(family), nil
+}
+
+/* Get the session family a refresh token belongs to, false if it names none. */
+func refreshTokenFamily(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+/* Find the session of the family a refresh token belongs to. */
+func (a *authState) refreshSession(family string) int {
+	return slices.IndexFunc(a.RefreshTokens, func(token refreshToken) bool {
+		return token.Family == family
+	})
+}
+
+/* Get the id of the user an opaque token belongs to. */
+func opaqueTokenUser(token string) (string, bool) {
+	id, _, ok := strings.Cut(token, ".")
+
+	return id, ok && id != ""
+}
+
+/*
+Load the key access tokens are signed with from the file at path,
+which enables sessions. With sessions enabled a user can only PATCH
+or DELETE themselves.
+*/
+func WithTokenKey(path string) Option {
+	return func(us *UserService) error {
+		signer, err := loadTokenSigner(path)
+		if err != nil {
+			return err
+		}
+
+		us.tokens = signer
+
+		return nil
+	}
+}
+
+/* Start a session for the user with id, returning its tokens. */
+func (us *UserService) issueTokens(id string) (*tokenPair, error) {
+	now := us.clock()
+
+	family, err := newRefreshFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, hash, err := newRefreshToken(id, family)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = us.store.Update(id, func(user *user) error {
+		user.Auth.pruneRefreshTokens(now)
+		user.Auth.RefreshTokens = append(user.Auth.RefreshTokens, refreshToken{
+			ExpiresAt: now.Add(refreshTokenTTL),
+			Family:    family,
+			Hash:      hash,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return us.tokenPair(id, refresh, now)
+}
+
+func (us *UserService) tokenPair(id string, refresh string, now time.Time) (*tokenPair, error) {
+	access, err := us.tokens.sign(id, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		AccessToken:  access,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+	}, nil
+}
+
+/*
+Swap a refresh token for a new pair of tokens. The new refresh token
+replaces it as the latest of its session, and if a token of the
+session other than the latest is presented it has been stolen by
+someone, so every refresh token of the user is revoked.
+*/
+func (us *UserService) rotateRefreshToken(presented string) (*tokenPair, error) {
+	id, ok := opaqueTokenUser(presented)
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	family, ok := refreshTokenFamily(presented)
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	now := us.clock()
+	hash := hashOpaqueToken(presented)
+
+	refresh, freshHash, err := newRefreshToken(id, family)
+	if err != nil {
+		return nil, err
+	}
+
+	reused := false
+
+	_, err = us.store.Update(id, func(user *user) error {
+		user.Auth.pruneRefreshTokens(now)
+
+		i := user.Auth.refreshSession(family)
+		if i < 0 {
+			return errInvalidToken
+		}
+
+		session := user.Auth.RefreshTokens[i]
+		if subtle.ConstantTimeCompare([]byte(session.Hash), []byte(hash)) != 1 {
+			reused = true
+			user.Auth.RefreshTokens = nil
+
+			return nil
+		}
+
+		user.Auth.RefreshTokens[i] = refreshToken{
+			ExpiresAt: now.Add(refreshTokenTTL),
+			Family:    family,
+			Hash:      freshHash,
+		}
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if reused {
+		log.Printf("refresh token of %q was used twice, revoked all of its refresh tokens", id)
+
+		return nil, errInvalidToken
+	}
+
+	return us.tokenPair(id, refresh, now)
+}
+
+/* Revoke the session of a refresh token, if it exists. */
+func (us *UserService) revokeRefreshToken(presented string) error {
+	id, ok := opaqueTokenUser(presented)
+	if !ok {
+		return nil
+	}
+
+	family, ok := refreshTokenFamily(presented)
+	if !ok {
+		return nil
+	}
+
+	_, err := us.store.Update(id, func(user *user) error {
+		i := user.Auth.refreshSession(family)
+		if i >= 0 {
+			user.Auth.RefreshTokens = slices.Delete(user.Auth.RefreshTokens, i, i+1)
+		}
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+/*
+Wrap a handler of /users/{id} so that, when sessions are enabled, it
+can only be called with an access token belonging to the user with id.
+*/
+func (us *UserService) requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if us.tokens == nil {
+			next(w, r)
+			return
+		}
+
+		sender := r.RemoteAddr
+		id := r.PathValue("id")
+
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+		claims, err := us.tokens.verify(token, us.clock())
+		if !strings.EqualFold(scheme, "Bearer") || err != nil {
+			log.Printf("[%s] %s /users/{id}: no valid access token for %q", sender, r.Method, id)
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+
+			us.fail(w, r, http.StatusUnauthorized, "a valid access token is required")
+			return
+		}
+
+		if claims.Subject != id {
+			log.Printf("[%s] %s /users/{id}: %q may not modify %q", sender, r.Method, claims.Subject, id)
+
+			us.fail(w, r, http.StatusForbidden, "the access token belongs to another user")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+/* Decode the refresh_token of a request body, which is empty if it wasn't sent. */
+func decodeRefreshToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	data := map[string]string{}
+
+	err := decodeBody(w, r, &data)
+
+	return data["refresh_token"], err
+}
+
+func (us *UserService) refresh(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/token/refresh: attempting to refresh session", sender)
+
+	token, err := decodeRefreshToken(w, r)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || token == "" {
+		log.Printf("[%s] POST /users/token/refresh: no refresh_token sent", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected refresh_token")
+		return
+	}
+
+	pair, err := us.rotateRefreshToken(token)
+	if errors.Is(err, errInvalidToken) {
+		log.Printf("[%s] POST /users/token/refresh: refresh_token is not valid", sender)
+
+		us.fail(w, r, http.StatusUnauthorized, "the refresh token is not valid")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/token/refresh: unable to refresh session: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to refresh the session")
+		return
+	}
+
+	body, err := json.Marshal(pair)
+	if err != nil {
+		log.Printf("[%s] POST /users/token/refresh: unable to marshal tokens %q", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to marshal the tokens")
+		return
+	}
+
+	log.Printf("[%s] POST /users/token/refresh: refreshed session", sender)
+
+	us.hc.increment(http.StatusOK)
+	w.Write(body)
+}
+
+func (us *UserService) revoke(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/token/revoke: attempting to revoke refresh token", sender)
+
+	token, err := decodeRefreshToken(w, r)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || token == "" {
+		log.Printf("[%s] POST /users/token/revoke: no refresh_token sent", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected refresh_token")
+		return
+	}
+
+	err = us.revokeRefreshToken(token)
+	if err != nil {
+		log.Printf("[%s] POST /users/token/revoke: unable to revoke refresh token: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to revoke the refresh token")
+		return
+	}
+
+	log.Printf("[%s] POST /users/token/revoke: revoked refresh token", sender)
+
+	us.hc.increment(http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
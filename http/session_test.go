@@ -0,0 +1,354 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const alicePassword = "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d"
+
+/* Create a UserService with sessions enabled and a User in it, returning the User's id. */
+func newSessionService(t *testing.T) (*UserService, string) {
+	us, err := NewUserService(WithTokenKey(writeSecret(t)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   alicePassword,
+	})
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return us, users[0].ID
+}
+
+/* Log in as the User created by newSessionService, returning the tokens. */
+func logIn(t *testing.T, us *UserService) *tokenPair {
+	w := postAuthenticate(t, us, `{"nickname":"AB123","password":"`+alicePassword+`"}`)
+
+	status := w.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	resp := authenticated{tokenPair: &tokenPair{}}
+
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Fatal("expected tokens in the response")
+	}
+
+	return resp.tokenPair
+}
+
+/* Send a request with an optional bearer token and get the response. */
+func serveWithToken(t *testing.T, us *UserService, method string, url string, token string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, req)
+
+	return w
+}
+
+/* POST a refresh token to /users/token/refresh and get the response. */
+func postRefresh(t *testing.T, us *UserService, refresh string) *httptest.ResponseRecorder {
+	return serveWithToken(t, us, "POST", "/users/token/refresh", "", `{"refresh_token":"`+refresh+`"}`)
+}
+
+/*
+TestAuthenticateIssuesTokens: Given sessions are enabled when I
+authenticate then the response contains an access token for my id and
+a refresh token.
+*/
+func TestAuthenticateIssuesTokens(t *testing.T) {
+	us, id := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	if pair.TokenType != "Bearer" || pair.ExpiresIn != int(accessTokenTTL.Seconds()) {
+		t.Fatalf("unexpected token type %q or expiry %d", pair.TokenType, pair.ExpiresIn)
+	}
+
+	claims, err := us.tokens.verify(pair.AccessToken, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if claims.Subject != id {
+		t.Fatalf("expected subject %q but got %q", id, claims.Subject)
+	}
+
+	user, err := us.store.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(user.Auth.RefreshTokens) != 1 || user.Auth.RefreshTokens[0].Hash == pair.RefreshToken {
+		t.Fatalf("expected one hashed refresh token but got %v", user.Auth.RefreshTokens)
+	}
+}
+
+/*
+TestRefreshRotatesTokens: Given I have a refresh token when I refresh
+then I get a new pair of tokens, and the old refresh token can't be
+used again.
+*/
+func TestRefreshRotatesTokens(t *testing.T) {
+	us, _ := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	w := postRefresh(t, us, pair.RefreshToken)
+
+	status := w.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	fresh := tokenPair{}
+
+	err := json.NewDecoder(w.Body).Decode(&fresh)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if fresh.RefreshToken == "" || fresh.RefreshToken == pair.RefreshToken {
+		t.Fatalf("expected a new refresh token but got %q", fresh.RefreshToken)
+	}
+
+	status = postRefresh(t, us, "not a token").Result().StatusCode
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+}
+
+/*
+TestRefreshTokenReuseRevokesSession: Given I have refreshed with a
+refresh token when the old refresh token is used again then it is
+refused and the new refresh token is revoked too.
+*/
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	us, _ := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	fresh := tokenPair{}
+
+	err := json.NewDecoder(postRefresh(t, us, pair.RefreshToken).Body).Decode(&fresh)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, refresh := range []string{pair.RefreshToken, fresh.RefreshToken} {
+		status := postRefresh(t, us, refresh).Result().StatusCode
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+		}
+	}
+}
+
+/* Refresh with a refresh token, failing the test unless it's 200 OK. */
+func refreshTokens(t *testing.T, us *UserService, refresh string) *tokenPair {
+	w := postRefresh(t, us, refresh)
+
+	status := w.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	pair := &tokenPair{}
+
+	err := json.NewDecoder(w.Body).Decode(pair)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return pair
+}
+
+/*
+TestRefreshKeepsOneTokenPerSession: Given I have refreshed many times
+then only the latest refresh token of my session is kept, and using
+any of the earlier ones revokes it.
+*/
+func TestRefreshKeepsOneTokenPerSession(t *testing.T) {
+	us, id := newSessionService(t)
+	defer us.Close()
+
+	pairs := []*tokenPair{logIn(t, us)}
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, refreshTokens(t, us, pairs[len(pairs)-1].RefreshToken))
+	}
+
+	user, err := us.store.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(user.Auth.RefreshTokens) != 1 {
+		t.Fatalf("expected one refresh token for the session but got %d", len(user.Auth.RefreshTokens))
+	}
+
+	for _, refresh := range []string{pairs[50].RefreshToken, pairs[100].RefreshToken} {
+		status := postRefresh(t, us, refresh).Result().StatusCode
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+		}
+	}
+}
+
+/*
+TestRefreshTokenWithoutFamilyIsRefused: Given I have a refresh token
+from before sessions had families when I refresh then it is refused,
+and it is dropped from the User without revoking their sessions.
+*/
+func TestRefreshTokenWithoutFamilyIsRefused(t *testing.T) {
+	us, id := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	legacy, hash, err := newOpaqueToken(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = us.store.Update(id, func(user *user) error {
+		user.Auth.RefreshTokens = append(user.Auth.RefreshTokens, refreshToken{ExpiresAt: time.Now().Add(time.Hour), Hash: hash})
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	status := postRefresh(t, us, legacy).Result().StatusCode
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+
+	refreshTokens(t, us, pair.RefreshToken)
+
+	user, err := us.store.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(user.Auth.RefreshTokens) != 1 || user.Auth.RefreshTokens[0].Family == "" {
+		t.Fatalf("expected only the session with a family to be kept but got %+v", user.Auth.RefreshTokens)
+	}
+}
+
+/*
+TestRefreshTokenExpires: Given I have a refresh token when it is used
+after it has expired then it is refused.
+*/
+func TestRefreshTokenExpires(t *testing.T) {
+	us, _ := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	us.clock = func() time.Time { return time.Now().Add(refreshTokenTTL) }
+
+	status := postRefresh(t, us, pair.RefreshToken).Result().StatusCode
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+}
+
+/*
+TestRevokeEndsSession: Given I have a refresh token when I revoke it
+then the HTTP status code will be 204 No Content and it can no longer
+be used to refresh.
+*/
+func TestRevokeEndsSession(t *testing.T) {
+	us, _ := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	w := serveWithToken(t, us, "POST", "/users/token/revoke", "", `{"refresh_token":"`+pair.RefreshToken+`"}`)
+
+	status := w.Result().StatusCode
+	if status != http.StatusNoContent {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusNoContent)
+	}
+
+	status = postRefresh(t, us, pair.RefreshToken).Result().StatusCode
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+}
+
+/*
+TestModifyingRequiresOwnAccessToken: Given sessions are enabled when
+I PATCH or DELETE a User then without an access token the HTTP status
+code will be 401 Unauthorized, with another User's access token it
+will be 403 Forbidden, and with their own it succeeds.
+*/
+func TestModifyingRequiresOwnAccessToken(t *testing.T) {
+	us, id := newSessionService(t)
+	defer us.Close()
+
+	pair := logIn(t, us)
+
+	other, err := us.tokens.sign("00000000-0000-0000-0000-000000000000", time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, request := range []struct {
+		method   string
+		token    string
+		body     string
+		expected int
+	}{
+		{"PATCH", "", `{"nickname":"alice"}`, http.StatusUnauthorized},
+		{"PATCH", "garbage", `{"nickname":"alice"}`, http.StatusUnauthorized},
+		{"PATCH", other, `{"nickname":"alice"}`, http.StatusForbidden},
+		{"DELETE", "", "", http.StatusUnauthorized},
+		{"DELETE", other, "", http.StatusForbidden},
+		{"PATCH", pair.AccessToken, `{"nickname":"alice"}`, http.StatusNoContent},
+		{"DELETE", pair.AccessToken, "", http.StatusNoContent},
+	} {
+		w := serveWithToken(t, us, request.method, "/users/"+id, request.token, request.body)
+
+		status := w.Result().StatusCode
+		if status != request.expected {
+			t.Fatalf("%s with token %q: Got %d, %d expected.", request.method, request.token, status, request.expected)
+		}
+
+		if status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("expected WWW-Authenticate header on 401")
+		}
+	}
+}
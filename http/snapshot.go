@@ -0,0 +1,250 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Number of snapshots kept in a data directory. Keeping more than one
+means there is something to fall back on should the newest snapshot
+be unreadable, along with the wal segments written since.
+*/
+const snapshotsKept = 2
+
+/*
+The first line of a snapshot. seq is the last wal record the snapshot
+contains and count is the number of user lines that follow.
+*/
+type snapshotHeader struct {
+	Count int    `json:"count"`
+	Seq   uint64 `json:"seq"`
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("snapshot-%020d.snap", seq)
+}
+
+/* Name of a wal segment whose last record is seq. */
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("users-%020d.wal", seq)
+}
+
+/*
+Get the paths of the snapshots or wal segments in dir, oldest first.
+The zero padded sequence numbers in their names sort lexically.
+*/
+func snapshotFiles(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+}
+
+func segmentFiles(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "users-*.wal"))
+}
+
+/*
+Write a point-in-time copy of users to a snapshot in dir. The snapshot
+is written to a temporary file first so it only appears under its
+real name once it is complete and on disk.
+*/
+func writeSnapshot(dir string, seq uint64, users map[string]*user) error {
+	path := filepath.Join(dir, snapshotName(seq))
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = writeSnapshotTo(file, seq, users)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeSnapshotTo(w io.Writer, seq uint64, users map[string]*user) error {
+	bw := bufio.NewWriter(w)
+
+	line, err := encodeLine(&snapshotHeader{Count: len(users), Seq: seq})
+	if err != nil {
+		return err
+	}
+
+	_, err = bw.Write(line)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		line, err = encodeLine(user)
+		if err != nil {
+			return err
+		}
+
+		_, err = bw.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+/* Read a snapshot, checking every line of it is intact. */
+func readSnapshot(path string) (uint64, map[string]*user, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: unable to read header: %w", path, err)
+	}
+
+	header := snapshotHeader{}
+
+	err = decodeLine(line, &header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: bad header: %w", path, err)
+	}
+
+	users := make(map[string]*user, header.Count)
+	for i := 0; i < header.Count; i++ {
+		line, err = r.ReadBytes('\n')
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: unable to read user %d of %d: %w", path, i+1, header.Count, err)
+		}
+
+		user := &user{}
+
+		err = decodeLine(line, user)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: bad user %d of %d: %w", path, i+1, header.Count, err)
+		}
+
+		users[user.ID] = user
+	}
+
+	_, err = r.ReadByte()
+	if err != io.EOF {
+		return 0, nil, fmt.Errorf("%s: trailing data after %d users", path, header.Count)
+	}
+
+	return header.Seq, users, nil
+}
+
+/*
+Load the newest snapshot in dir that can be read. If there are no
+snapshots an empty map is returned, to be filled by the wal from its
+first record. If there are snapshots but none can be read that is an
+error, as the wal they contained is gone.
+*/
+func loadSnapshot(dir string) (uint64, map[string]*user, error) {
+	paths, err := snapshotFiles(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		seq, users, err := readSnapshot(paths[i])
+		if err != nil {
+			log.Printf("unable to load snapshot, trying an older one: %s", err.Error())
+			continue
+		}
+
+		return seq, users, nil
+	}
+
+	if len(paths) > 0 {
+		return 0, nil, fmt.Errorf("%s: none of the %d snapshots can be read", dir, len(paths))
+	}
+
+	return 0, make(map[string]*user), nil
+}
+
+/*
+Delete everything in dir that is no longer needed: snapshots beyond
+the newest snapshotsKept, the wal segments already contained in the
+oldest snapshot kept and any temporary files left behind by a crash.
+*/
+func compact(dir string) error {
+	snapshots, err := snapshotFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	oldest := max(len(snapshots)-snapshotsKept, 0)
+
+	name := filepath.Base(snapshots[oldest])
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "snapshot-"), ".snap")
+
+	seq, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	victims := snapshots[:oldest]
+
+	segments, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if filepath.Base(segment) <= segmentName(seq) {
+			victims = append(victims, segment)
+		}
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+
+	victims = append(victims, tmps...)
+
+	errs := []error{}
+	for _, victim := range victims {
+		err = os.Remove(victim)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
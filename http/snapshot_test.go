@@ -0,0 +1,295 @@
+package http
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+/* Take a snapshot of a durable memoryStore and wait for it to finish. */
+func snapshotNow(t *testing.T, ms *memoryStore) {
+	ch := make(chan error)
+
+	ms.callback <- func() {
+		ch <- ms.snapshot()
+	}
+
+	err := <-ch
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ms.snapshots.Wait()
+
+	/* wait for the goroutine to pick up the result */
+
+	busy := make(chan bool)
+	for {
+		ms.callback <- func() {
+			busy <- ms.snapshotting
+		}
+
+		if !<-busy {
+			break
+		}
+	}
+}
+
+/* Create users with the nicknames in a store, returning their ids. */
+func createUsers(t *testing.T, store Store, nicknames ...string) []string {
+	ids := []string{}
+	for _, nickname := range nicknames {
+		id := uuid.NewString()
+
+		err := store.Create(&user{ID: id, Email: nickname + "@bob.com", Nickname: nickname, CreatedAt: NewDatetime(), UpdatedAt: NewDatetime()})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+/* Open the durable store in dir, failing the test if it can't be. */
+func openDurable(t *testing.T, dir string) *memoryStore {
+	store, err := NewDurableMemoryStore(dir, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return store.(*memoryStore)
+}
+
+/* Check the store holds exactly the users with the ids. */
+func expectUsers(t *testing.T, store Store, ids []string) {
+	users, err := store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(users) != len(ids) {
+		t.Fatalf("expected %d users but got %d", len(ids), len(users))
+	}
+
+	for _, id := range ids {
+		_, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("expected user %q but got %q", id, err.Error())
+		}
+	}
+}
+
+/*
+TestSnapshotCompactsLog: Given I have created Users in a durable store
+when a snapshot is taken then the log written before the snapshot is
+deleted, and the Users created before and after the snapshot are there
+when the store is opened again.
+*/
+func TestSnapshotCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+
+	ids := createUsers(t, ms, "rob", "ken")
+
+	err := ms.Delete(ids[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids = ids[:1]
+
+	snapshotNow(t, ms)
+
+	segments, err := segmentFiles(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(segments) != 0 {
+		t.Fatalf("expected the log to be compacted but found %q", segments)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, walName))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if info.Size() != 0 {
+		t.Fatalf("expected an empty log after the snapshot but it is %d bytes", info.Size())
+	}
+
+	ids = append(ids, createUsers(t, ms, "griesemer")...)
+
+	ms.Close()
+
+	ms = openDurable(t, dir)
+	defer ms.Close()
+
+	expectUsers(t, ms, ids)
+}
+
+/*
+TestSnapshotFallsBackToOlder: Given I have taken two snapshots of a
+durable store and the newest has been corrupted when I open the store
+again then the older snapshot and the log written since are loaded.
+*/
+func TestSnapshotFallsBackToOlder(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+
+	ids := createUsers(t, ms, "rob")
+	snapshotNow(t, ms)
+
+	ids = append(ids, createUsers(t, ms, "ken")...)
+	snapshotNow(t, ms)
+
+	ids = append(ids, createUsers(t, ms, "griesemer")...)
+
+	ms.Close()
+
+	snapshots, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshots) != snapshotsKept {
+		t.Fatalf("expected %d snapshots but found %d", snapshotsKept, len(snapshots))
+	}
+
+	err = os.WriteFile(snapshots[len(snapshots)-1], []byte("garbage\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ms = openDurable(t, dir)
+	defer ms.Close()
+
+	expectUsers(t, ms, ids)
+}
+
+/*
+TestSnapshotUnreadableRefusesToOpen: Given I have taken a single
+snapshot of a durable store and it has been corrupted when I open the
+store again then an error is returned instead of starting without the
+users it contained.
+*/
+func TestSnapshotUnreadableRefusesToOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+
+	createUsers(t, ms, "rob")
+	snapshotNow(t, ms)
+
+	ms.Close()
+
+	snapshots, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = os.WriteFile(snapshots[0], []byte("garbage\n"), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = NewDurableMemoryStore(dir, 0)
+	if err == nil {
+		t.Fatal("expected an error opening a store with no readable snapshot")
+	}
+}
+
+/*
+TestSnapshotSkippedWhenUnchanged: Given I have taken a snapshot of a
+durable store when I take another without anything changing then no
+new snapshot is written.
+*/
+func TestSnapshotSkippedWhenUnchanged(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+	defer ms.Close()
+
+	createUsers(t, ms, "rob")
+	snapshotNow(t, ms)
+	snapshotNow(t, ms)
+
+	snapshots, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshots) != 1 {
+		t.Fatalf("expected 1 snapshot but found %d", len(snapshots))
+	}
+
+	_, users, err := readSnapshot(snapshots[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(users) != 1 {
+		t.Fatalf("expected 1 user in the snapshot but found %d", len(users))
+	}
+}
+
+/*
+TestSnapshotFailsWithoutLosingUsers: Given snapshots of a durable store
+keep failing when no Users are created between them then the log
+written before them isn't lost, and the Users are there once a
+snapshot succeeds and when the store is opened again.
+*/
+func TestSnapshotFailsWithoutLosingUsers(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+
+	ids := createUsers(t, ms, "rob", "ken", "griesemer")
+
+	/* a directory where the snapshot is written stops it being written */
+
+	blocker := filepath.Join(dir, snapshotName(3)+".tmp")
+
+	err := os.Mkdir(blocker, 0o700)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshotNow(t, ms)
+	snapshotNow(t, ms)
+
+	snapshots, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snapshots) != 0 {
+		t.Fatalf("expected the snapshots to fail but found %q", snapshots)
+	}
+
+	ms.Close()
+
+	ms = openDurable(t, dir)
+
+	expectUsers(t, ms, ids)
+
+	err = os.Remove(blocker)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshotNow(t, ms)
+
+	ms.Close()
+
+	ms = openDurable(t, dir)
+	defer ms.Close()
+
+	expectUsers(t, ms, ids)
+}
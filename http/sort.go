@@ -0,0 +1,113 @@
+package http
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/* A key users are sorted by, i.e. an attribute and its direction. */
+type sortKey struct {
+	attribute  string
+	descending bool
+}
+
+/* How the users of GET /users are sorted when the client doesn't say. */
+var defaultSort = []sortKey{{attribute: "created_at"}, {attribute: "id"}}
+
+/* Compare two users by each of the attributes they can be sorted by. */
+var sortAttributes = map[string]func(a, b *user) int{
+	"country": func(a, b *user) int {
+		return strings.Compare(a.Country, b.Country)
+	},
+	"created_at": func(a, b *user) int {
+		return a.CreatedAt.tm.Compare(b.CreatedAt.tm)
+	},
+	"email": func(a, b *user) int {
+		return strings.Compare(a.Email, b.Email)
+	},
+	"email_verified": func(a, b *user) int {
+		return strings.Compare(strconv.FormatBool(a.EmailVerified), strconv.FormatBool(b.EmailVerified))
+	},
+	"first_name": func(a, b *user) int {
+		return strings.Compare(a.FirstName, b.FirstName)
+	},
+	"id": func(a, b *user) int {
+		return strings.Compare(a.ID, b.ID)
+	},
+	"last_name": func(a, b *user) int {
+		return strings.Compare(a.LastName, b.LastName)
+	},
+	"nickname": func(a, b *user) int {
+		return strings.Compare(a.Nickname, b.Nickname)
+	},
+	"updated_at": func(a, b *user) int {
+		return a.UpdatedAt.tm.Compare(b.UpdatedAt.tm)
+	},
+}
+
+/*
+Parse the sort query parameter, a comma separated list of attributes
+where those prefixed with - are descending, e.g. "last_name,-created_at".
+Without one the default is used. The id is added as the last key if
+it isn't already one, so no two users are ever equal and the order is
+the same on every request.
+*/
+func parseSort(values []string) ([]sortKey, error) {
+	keys := []sortKey{}
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			key := sortKey{attribute: strings.TrimSpace(field)}
+			if key.attribute == "" {
+				continue
+			}
+
+			key.attribute, key.descending = strings.CutPrefix(key.attribute, "-")
+
+			_, ok := sortAttributes[key.attribute]
+			if !ok {
+				return nil, fmt.Errorf("unable to sort by %q", field)
+			}
+
+			if slices.ContainsFunc(keys, func(k sortKey) bool { return k.attribute == key.attribute }) {
+				return nil, fmt.Errorf("unable to sort by %q more than once", key.attribute)
+			}
+
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return defaultSort, nil
+	}
+
+	if !slices.ContainsFunc(keys, func(k sortKey) bool { return k.attribute == "id" }) {
+		keys = append(keys, sortKey{attribute: "id"})
+	}
+
+	return keys, nil
+}
+
+/* Compare two users by each of the keys in turn. */
+func compareUsers(a, b *user, keys []sortKey) int {
+	for _, key := range keys {
+		c := sortAttributes[key.attribute](a, b)
+		if key.descending {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+/* Sort users in place by keys. */
+func sortUsers(users []*user, keys []sortKey) {
+	slices.SortFunc(users, func(a, b *user) int {
+		return compareUsers(a, b, keys)
+	})
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestParseSort: Given a sort query parameter when it is parsed then
+each attribute is a key in order, descending when prefixed with -, with
+the id last if it isn't there already. Attributes that users can't be
+sorted by are refused.
+*/
+func TestParseSort(t *testing.T) {
+	for value, expected := range map[string][]sortKey{
+		"":                       defaultSort,
+		"last_name":              {{"last_name", false}, {"id", false}},
+		"last_name,-created_at":  {{"last_name", false}, {"created_at", true}, {"id", false}},
+		"-id,nickname":           {{"id", true}, {"nickname", false}},
+		" country , -first_name": {{"country", false}, {"first_name", true}, {"id", false}},
+	} {
+		keys, err := parseSort([]string{value})
+		if err != nil {
+			t.Fatalf("%q: %s", value, err.Error())
+		}
+
+		if !slices.Equal(keys, expected) {
+			t.Fatalf("%q: expected %v but got %v", value, expected, keys)
+		}
+	}
+
+	for _, value := range []string{"password", "auth", "+nickname", "nickname,-nickname"} {
+		_, err := parseSort([]string{value})
+		if err == nil {
+			t.Fatalf("expected %q to be refused", value)
+		}
+	}
+}
+
+/* Post Users with the nicknames and last names, a second apart, in the order given. */
+func postSortableUsers(t *testing.T, us *UserService, now *time.Time, users [][2]string) {
+	for _, names := range users {
+		postUser(t, us, map[string]string{
+			"country":    "GB",
+			"email":      names[0] + "@bob.com",
+			"first_name": "User",
+			"last_name":  names[1],
+			"nickname":   names[0],
+			"password":   alicePassword,
+		})
+
+		*now = now.Add(time.Second)
+	}
+}
+
+/* Get the nicknames of the Users returned by url, in order. */
+func getNicknames(t *testing.T, us *UserService, url string) string {
+	nicknames := []string{}
+	for _, user := range getUsers(t, us, url) {
+		nicknames = append(nicknames, user["nickname"])
+	}
+
+	return strings.Join(nicknames, ",")
+}
+
+/*
+TestUsersGetSorts: Given I have created Users when I call GET /users
+then they are in the order they were created, or sorted by the sort
+query parameter, and the pages of a sort are the same every time. An
+attribute that can't be sorted by is 400 Bad Request.
+*/
+func TestUsersGetSorts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	us, err := NewUserService(WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postSortableUsers(t, us, &now, [][2]string{
+		{"rob", "Pike"},
+		{"ken", "Thompson"},
+		{"robert", "Griesemer"},
+		{"russ", "Cox"},
+		{"ian", "Taylor"},
+	})
+
+	for url, expected := range map[string]string{
+		"/users":                                "rob,ken,robert,russ,ian",
+		"/users?sort=-created_at":               "ian,russ,robert,ken,rob",
+		"/users?sort=last_name":                 "russ,robert,rob,ian,ken",
+		"/users?sort=nickname":                  "ian,ken,rob,robert,russ",
+		"/users?sort=-nickname":                 "russ,robert,rob,ken,ian",
+		"/users?sort=first_name,-nickname":      "russ,robert,rob,ken,ian",
+		"/users?sort=-last_name&limit=2&page=1": "rob,robert",
+	} {
+		got := getNicknames(t, us, url)
+		if got != expected {
+			t.Fatalf("%s: expected %s but got %s", url, expected, got)
+		}
+	}
+
+	w := serveWithToken(t, us, "GET", "/users?sort=password", "", "")
+	expectProblem(t, w, http.StatusBadRequest, "bad-request", "/users")
+}
@@ -0,0 +1,718 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+Migrations applied to a SQL database, in order. The number of the
+last migration applied is kept in the database's user_version, so
+migrations must only ever be appended to this list.
+*/
+var migrations = [][]string{
+	{
+		`CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			country TEXT NOT NULL,
+			email TEXT NOT NULL,
+			first_name TEXT NOT NULL,
+			last_name TEXT NOT NULL,
+			nickname TEXT NOT NULL,
+			password TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+	},
+	{
+		`CREATE INDEX users_email ON users (email)`,
+		`CREATE INDEX users_nickname ON users (nickname)`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN auth TEXT NOT NULL DEFAULT '{}'`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN email_key TEXT`,
+		`ALTER TABLE users ADD COLUMN nickname_key TEXT`,
+		`CREATE UNIQUE INDEX users_email_key ON users (email_key)`,
+		`CREATE UNIQUE INDEX users_nickname_key ON users (nickname_key)`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN locked_until INTEGER`,
+		`UPDATE users SET locked_until = CAST(unixepoch(json_extract(auth, '$.locked_until'), 'subsec') * 1000000000 AS INTEGER)
+			WHERE json_extract(auth, '$.locked_until') IS NOT NULL`,
+		`CREATE INDEX users_locked_until ON users (locked_until)`,
+	},
+}
+
+/*
+The columns that keep the uniqueKey of the email and nickname of each
+user. They're made in Go rather than with lower() as SQLite only folds
+the case of ASCII.
+*/
+var sqlUniqueColumns = []struct {
+	column string
+	field  string
+	value  func(user *user) string
+}{
+	{"email_key", "email", func(user *user) string { return user.Email }},
+	{"nickname_key", "nickname", func(user *user) string { return user.Nickname }},
+}
+
+/* Columns of the users table that the filters of List may use. */
+var sqlFilterColumns = map[string]string{
+	"country":        "country",
+	"created_at":     "created_at",
+	"email":          "email",
+	"email_verified": "email_verified",
+	"first_name":     "first_name",
+	"last_name":      "last_name",
+	"nickname":       "nickname",
+	"updated_at":     "updated_at",
+}
+
+const sqlUserColumns = `id, country, email, first_name, last_name, nickname, password, created_at, updated_at, auth, email_verified`
+
+/*
+Get the locked_until column of user, which is when their account is
+locked until in Unix nanoseconds, or NULL if it isn't. It's only kept
+so CountLocked can use its index.
+*/
+func sqlLockedUntil(user *user) any {
+	if user.Auth.LockedUntil == nil {
+		return nil
+	}
+
+	return user.Auth.LockedUntil.UnixNano()
+}
+
+/*
+sqlStore is a Store backed by an embedded SQL database file.
+
+The database is only used through a single connection, which
+serializes access to it in the same way the goroutine of the
+memoryStore does.
+
+exports is a second pool of connections used only by Walk, so a long
+walk doesn't hold the connection writes need. In WAL mode the SELECT
+of a walk reads a snapshot of the database from when it started.
+
+search indexes the tokens of the names and emails of users for the q
+filter, as SQLite has nothing like it. It's built when the database is
+opened and kept up to date by each write, which holds mu from before
+its transaction until the index has the result, so the index is
+changed in the same order as the database.
+*/
+type sqlStore struct {
+	db      *sql.DB
+	exports *sql.DB
+	mu      sync.Mutex
+	search  *searchIndex
+}
+
+/*
+Create a new Store backed by the SQL database file at path, creating
+it if it doesn't exist and applying any migrations it is missing.
+*/
+func NewSQLStore(path string) (Store, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)", path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = indexUniqueKeys(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	search, err := indexSearch(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	exports, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, exports: exports, search: search}, nil
+}
+
+/* Apply each migration the database hasn't had yet. */
+func migrate(db *sql.DB) error {
+	var version int
+
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database is at version %d but only %d migrations are known", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range migrations[i] {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Fill in the unique keys of users that don't have them, i.e. those
+added before emails and nicknames were unique. If users share an email
+or nickname the oldest gets the key and the others are logged.
+*/
+func indexUniqueKeys(db *sql.DB) error {
+	for _, unique := range sqlUniqueColumns {
+		rows, err := db.Query(`SELECT ` + sqlUserColumns + ` FROM users WHERE ` + unique.column + ` IS NULL ORDER BY created_at, id`)
+		if err != nil {
+			return err
+		}
+
+		users := []*user{}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			users = append(users, user)
+		}
+
+		rows.Close()
+
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			result, err := db.Exec(
+				`UPDATE users SET `+unique.column+` = ?1 WHERE id = ?2 AND NOT EXISTS (SELECT 1 FROM users WHERE `+unique.column+` = ?1)`,
+				uniqueKey(unique.value(user)),
+				user.ID,
+			)
+			if err != nil {
+				return err
+			}
+
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			if updated == 0 {
+				log.Printf("%q was added before emails and nicknames were unique: %s is already taken", user.ID, unique.field)
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Build the search index of every user in the database. */
+func indexSearch(db *sql.DB) (*searchIndex, error) {
+	rows, err := db.Query(`SELECT ` + sqlUserColumns + ` FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	search := newSearchIndex()
+	search.load()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		search.add(user)
+	}
+
+	search.loaded()
+
+	return search, rows.Err()
+}
+
+/*
+Check no other user has the email or nickname of user. If user is a
+modification of current, only what has changed is checked.
+*/
+func uniqueInTx(tx *sql.Tx, user *user, current *user) error {
+	for _, unique := range sqlUniqueColumns {
+		if current != nil && uniqueKey(unique.value(user)) == uniqueKey(unique.value(current)) {
+			continue
+		}
+
+		var id string
+
+		err := tx.QueryRow(`SELECT id FROM users WHERE `+unique.column+` = ? AND id != ?`, uniqueKey(unique.value(user)), user.ID).Scan(&id)
+		if err == nil {
+			return &conflictError{Field: unique.field}
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Something a user can be scanned from, i.e. *sql.Row or *sql.Rows. */
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (*user, error) {
+	var createdAt, updatedAt int64
+	var auth string
+
+	user := &user{}
+
+	err := row.Scan(
+		&user.ID,
+		&user.Country,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Nickname,
+		&user.Password,
+		&createdAt,
+		&updatedAt,
+		&auth,
+		&user.EmailVerified,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(auth), &user.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth of %q: %w", user.ID, err)
+	}
+
+	user.CreatedAt.tm = time.Unix(0, createdAt)
+	user.UpdatedAt.tm = time.Unix(0, updatedAt)
+
+	return user, nil
+}
+
+func (ss *sqlStore) Close() error {
+	return errors.Join(ss.exports.Close(), ss.db.Close())
+}
+
+/* Count the users locked at now with the index of locked_until. */
+func (ss *sqlStore) CountLocked(now time.Time) (int, error) {
+	var count int
+
+	err := ss.db.QueryRow(`SELECT COUNT(*) FROM users WHERE locked_until > ?`, now.UnixNano()).Scan(&count)
+
+	return count, err
+}
+
+/* Add a new user to the database. */
+func (ss *sqlStore) Create(user *user) error {
+	auth, err := json.Marshal(&user.Auth)
+	if err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = uniqueInTx(tx, user, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO users (`+sqlUserColumns+`, email_key, nickname_key, locked_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID,
+		user.Country,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		user.Nickname,
+		user.Password,
+		user.CreatedAt.tm.UnixNano(),
+		user.UpdatedAt.tm.UnixNano(),
+		string(auth),
+		user.EmailVerified,
+		uniqueKey(user.Email),
+		uniqueKey(user.Nickname),
+		sqlLockedUntil(user),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	ss.search.add(user)
+
+	return nil
+}
+
+/* Delete a user from the database. */
+func (ss *sqlStore) Delete(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	result, err := ss.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	ss.search.remove(id)
+
+	return nil
+}
+
+/* Get a user from the database. */
+func (ss *sqlStore) Get(id string) (*user, error) {
+	user, err := scanUser(ss.db.QueryRow(`SELECT `+sqlUserColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return user, err
+}
+
+/*
+Get a filtered list of users from the database. Every user is checked
+against all of the filters after it's scanned, as not all of them are
+in the WHERE clause.
+*/
+func (ss *sqlStore) List(filters []*filter) ([]*user, error) {
+	where, args, err := ss.where(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ss.db.Query(`SELECT `+sqlUserColumns+` FROM users`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*user{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if !user.matches(filters) {
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+/*
+Get the WHERE clause of filters and its arguments. Each filter that
+SQL can answer exactly becomes a condition, so filters on indexed
+columns don't need a full scan of the table. A key filter uses the
+column of uniqueKeys of its attribute. A search is answered by the
+search index, and the ids it finds are passed to SQLite as a JSON
+array.
+*/
+func (ss *sqlStore) where(filters []*filter) (string, []any, error) {
+	conditions := []string{}
+	args := []any{}
+	for _, f := range filters {
+		if f.operator == "search" {
+			ss.mu.Lock()
+			found := ss.search.lookup(f.values)
+			ss.mu.Unlock()
+
+			ids := make([]string, 0, len(found))
+			for id := range found {
+				ids = append(ids, id)
+			}
+
+			raw, err := json.Marshal(ids)
+			if err != nil {
+				return "", nil, err
+			}
+
+			conditions = append(conditions, "id IN (SELECT value FROM json_each(?))")
+			args = append(args, string(raw))
+			continue
+		}
+
+		if f.operator == "key" {
+			for _, unique := range sqlUniqueColumns {
+				if unique.field == f.attribute {
+					conditions = append(conditions, unique.column+" = ?")
+					args = append(args, uniqueKey(f.values[0]))
+				}
+			}
+
+			continue
+		}
+
+		column, ok := sqlFilterColumns[f.attribute]
+		if !ok {
+			return "", nil, fmt.Errorf("unable to filter on %q", f.attribute)
+		}
+
+		condition, values := sqlFilterCondition(column, f)
+		if condition == "" {
+			continue
+		}
+
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if len(conditions) == 0 {
+		return "", args, nil
+	}
+
+	return ` WHERE ` + strings.Join(conditions, " AND "), args, nil
+}
+
+/*
+Get the condition on column of the filter f and its arguments, or ""
+if it ignores case, which SQLite's LOWER can't do beyond ASCII.
+*/
+func sqlFilterCondition(column string, f *filter) (string, []any) {
+	if f.caseless {
+		return "", nil
+	}
+
+	var condition string
+	args := []any{}
+
+	switch f.operator {
+	case "contains":
+		condition = "instr(" + column + ", ?) > 0"
+		args = append(args, f.values[0])
+	case "eq":
+		condition = column + " = ?"
+
+		/* booleans are stored as 0 or 1 */
+		if f.attribute == "email_verified" {
+			args = append(args, f.values[0] == "true")
+		} else {
+			args = append(args, f.values[0])
+		}
+	case "gt", "gte", "lt", "lte":
+		operators := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+		/* times are stored as nanoseconds */
+		condition = column + " " + operators[f.operator] + " ?"
+		args = append(args, f.tm.UnixNano())
+	case "in":
+		condition = column + " IN (?" + strings.Repeat(", ?", len(f.values)-1) + ")"
+		for _, value := range f.values {
+			args = append(args, value)
+		}
+	case "prefix":
+		condition = "substr(" + column + ", 1, length(?)) = ?"
+		args = append(args, f.values[0], f.values[0])
+	}
+
+	if f.negated {
+		condition = "NOT (" + condition + ")"
+	}
+
+	return condition, args
+}
+
+/* Modify a user in the database. */
+func (ss *sqlStore) Update(id string, modify func(user *user) error) (*user, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+sqlUserColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	current := user.clone()
+
+	err = modify(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = uniqueInTx(tx, user, current)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := json.Marshal(&user.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE users SET
+			country = ?,
+			email = ?,
+			first_name = ?,
+			last_name = ?,
+			nickname = ?,
+			password = ?,
+			updated_at = ?,
+			auth = ?,
+			email_verified = ?,
+			email_key = CASE WHEN ? THEN ? ELSE email_key END,
+			nickname_key = CASE WHEN ? THEN ? ELSE nickname_key END,
+			locked_until = ?
+		WHERE id = ?`,
+		user.Country,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		user.Nickname,
+		user.Password,
+		user.UpdatedAt.tm.UnixNano(),
+		string(auth),
+		user.EmailVerified,
+		uniqueKey(user.Email) != uniqueKey(current.Email),
+		uniqueKey(user.Email),
+		uniqueKey(user.Nickname) != uniqueKey(current.Nickname),
+		uniqueKey(user.Nickname),
+		sqlLockedUntil(user),
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	ss.search.add(user)
+
+	return user, nil
+}
+
+/*
+Walk the users in the database that match filters, oldest first, from
+the exports pool. The query is cancelled along with ctx.
+*/
+func (ss *sqlStore) Walk(ctx context.Context, filters []*filter, visit func(user *user) error) error {
+	where, args, err := ss.where(filters)
+	if err != nil {
+		return err
+	}
+
+	rows, err := ss.exports.QueryContext(ctx, `SELECT `+sqlUserColumns+` FROM users`+where+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		/* the driver can be a few rows behind ctx */
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+
+		if !user.matches(filters) {
+			continue
+		}
+
+		err = visit(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,330 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/* Open the SQL store at path, failing the test if it can't be. */
+func openSQL(t *testing.T, path string) *sqlStore {
+	store, err := NewSQLStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return store.(*sqlStore)
+}
+
+/*
+TestSQLStoreRoundTrip: Given I have created a User in the SQL store
+when I get, update and delete it then each operation will see the
+effects of the one before it.
+*/
+func TestSQLStoreRoundTrip(t *testing.T) {
+	ss := openSQL(t, filepath.Join(t.TempDir(), "users.db"))
+	defer ss.Close()
+
+	id := createUsers(t, ss, "AB123")[0]
+
+	got, err := ss.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if got.Nickname != "AB123" {
+		t.Fatalf("expected nickname %q but got %q", "AB123", got.Nickname)
+	}
+
+	_, err = ss.Update(id, func(user *user) error {
+		user.Nickname = "ken"
+
+		return errBroken
+	})
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expected errBroken but got %v", err)
+	}
+
+	updated, err := ss.Update(id, func(user *user) error {
+		if user.Nickname != "AB123" {
+			t.Fatalf("expected stored nickname %q but got %q", "AB123", user.Nickname)
+		}
+
+		user.Nickname = "ken"
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if updated.Nickname != "ken" {
+		t.Fatalf("expected nickname %q but got %q", "ken", updated.Nickname)
+	}
+
+	err = ss.Delete(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for name, err := range map[string]error{
+		"Delete": ss.Delete(id),
+		"Get": func() error {
+			_, err := ss.Get(id)
+			return err
+		}(),
+		"Update": func() error {
+			_, err := ss.Update(id, func(user *user) error { return nil })
+			return err
+		}(),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound from %s but got %v", name, err)
+		}
+	}
+}
+
+/*
+TestSQLStoreMigratesOnce: Given I have created a User in a SQL
+database when I open the database again then the migrations are not
+applied again and the User is still there.
+*/
+func TestSQLStoreMigratesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	ss := openSQL(t, path)
+	ids := createUsers(t, ss, "rob", "ken")
+	ss.Close()
+
+	ss = openSQL(t, path)
+	defer ss.Close()
+
+	var version int
+
+	err := ss.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if version != len(migrations) {
+		t.Fatalf("expected database at version %d but got %d", len(migrations), version)
+	}
+
+	expectUsers(t, ss, ids)
+}
+
+/*
+TestSQLStoreFiltersUseIndexes: Given a SQL store when I filter users
+by email or nickname then the query uses the index on that column
+rather than scanning the table.
+*/
+func TestSQLStoreFiltersUseIndexes(t *testing.T) {
+	ss := openSQL(t, filepath.Join(t.TempDir(), "users.db"))
+	defer ss.Close()
+
+	for column, index := range map[string]string{
+		"email":    "users_email",
+		"nickname": "users_nickname",
+	} {
+		rows, err := ss.db.Query(`EXPLAIN QUERY PLAN SELECT `+sqlUserColumns+` FROM users WHERE `+column+` = ?`, "rob")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		plan := []string{}
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+
+			err = rows.Scan(&id, &parent, &unused, &detail)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			plan = append(plan, detail)
+		}
+
+		rows.Close()
+
+		if !strings.Contains(strings.Join(plan, "\n"), index) {
+			t.Fatalf("expected filter on %q to use %q but the plan was %q", column, index, plan)
+		}
+	}
+}
+
+/*
+TestSQLStoreUsersGet: Given I have created multiple Users with a
+UserService using a SQL database when I call the GET method with a
+filter then only the Users matching the filter are returned with
+the values I created them with.
+*/
+func TestSQLStoreUsersGet(t *testing.T) {
+	us, err := NewUserService(WithDatabase(filepath.Join(t.TempDir(), "users.db")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer us.Close()
+
+	data := map[string](map[string]string){
+		"rob": {
+			"country":    "CA",
+			"email":      "rob@bob.com",
+			"first_name": "Rob",
+			"last_name":  "Pike",
+			"nickname":   "rob",
+			"password":   "f9c33006f81d188494d2b108a7977ec2710d9fe6c7d33b1b01792eac812d5069",
+		},
+		"ken": {
+			"country":    "US",
+			"email":      "ken@bob.com",
+			"first_name": "Ken",
+			"last_name":  "Thompson",
+			"nickname":   "ken",
+			"password":   "b3bb4cd67f11e1f6350a5792c8a0f91c2e7920ab93ccd7e964d97d79ad9f8270",
+		},
+	}
+
+	for _, datum := range data {
+		post_body, err := json.Marshal(datum)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		post_req, err := http.NewRequest("POST", "/users", bytes.NewReader(post_body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		us.ServeHTTP(httptest.NewRecorder(), post_req)
+	}
+
+	get, err := http.NewRequest("GET", "/users?nickname=ken", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	us.ServeHTTP(w, get)
+
+	resp_body := userList{}
+
+	err = json.NewDecoder(w.Body).Decode(&resp_body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(resp_body) != 1 {
+		t.Fatalf("expected 1 user but got %d", len(resp_body))
+	}
+
+	for key, expected := range data["ken"] {
+		/* passwords are never returned */
+
+		if key == "password" {
+			continue
+		}
+
+		got := resp_body[0][key]
+
+		if expected != got {
+			t.Fatalf("Expected attribute %q to be %q but got %q", key, expected, got)
+		}
+	}
+
+	err = uuid.Validate(resp_body[0]["id"])
+	if err != nil {
+		t.Fatalf("Expected 'id' to be a uuid but %q", err.Error())
+	}
+}
+
+/*
+TestSQLStoreKeepsLegacyDuplicates: Given a database with Users that
+shared an email before emails were unique when the SQL store opens
+then it still opens, the oldest User keeps the email and the others can
+still be updated.
+*/
+func TestSQLStoreKeepsLegacyDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	ss := openSQL(t, path)
+	ids := createUsers(t, ss, "rob", "ken")
+
+	_, err := ss.db.Exec(`UPDATE users SET email = 'rob@bob.com', email_key = NULL, nickname_key = NULL`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ss.Close()
+
+	ss = openSQL(t, path)
+	defer ss.Close()
+
+	_, err = ss.Update(ids[1], func(user *user) error {
+		user.FirstName = "Ken"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected a legacy duplicate to be updated but got %v", err)
+	}
+
+	err = ss.Create(&user{ID: uuid.NewString(), Email: "Rob@Bob.com", Nickname: "robert"})
+	expectConflict(t, err, "email")
+}
+
+/*
+TestSQLStoreCountsLegacyLocks: Given a database with a locked User from
+before locked_until was a column when the SQL store opens then the
+User is counted as locked.
+*/
+func TestSQLStoreCountsLegacyLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	ss := openSQL(t, path)
+	ids := createUsers(t, ss, "rob", "ken")
+
+	lockedUntil := time.Now().Add(time.Hour)
+
+	_, err := ss.Update(ids[1], func(user *user) error {
+		user.Auth.LockedUntil = &lockedUntil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, statement := range []string{
+		`DROP INDEX users_locked_until`,
+		`ALTER TABLE users DROP COLUMN locked_until`,
+		fmt.Sprintf(`PRAGMA user_version = %d`, len(migrations)-1),
+	} {
+		_, err = ss.db.Exec(statement)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	ss.Close()
+
+	ss = openSQL(t, path)
+	defer ss.Close()
+
+	for at, expected := range map[time.Time]int{time.Now(): 1, lockedUntil.Add(time.Millisecond): 0} {
+		count, err := ss.CountLocked(at)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if count != expected {
+			t.Fatalf("expected %d locked at %s but got %d", expected, at, count)
+		}
+	}
+}
@@ -0,0 +1,827 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Returned by a Store when there is no user with the requested id. */
+var ErrNotFound = errors.New("user not found")
+
+/*
+Returned by a Store when a user would have the same email or nickname
+as another user. The error is a *conflictError naming the attribute.
+*/
+var ErrConflict = errors.New("user conflicts with another user")
+
+/*
+Returned by NewDurableMemoryStore when another process is using the
+data directory, as neither would see the users the other writes.
+*/
+var ErrLocked = errors.New("data directory is locked by another process")
+
+/* The attribute a user had in common with another user. */
+type conflictError struct {
+	Field string
+}
+
+func (err *conflictError) Error() string {
+	return err.Field + " is already taken"
+}
+
+func (err *conflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+/*
+Get the key a unique attribute is indexed by. Emails and nicknames are
+unique regardless of case, so alice@bob.com and Alice@Bob.com are the
+same email.
+*/
+func uniqueKey(value string) string {
+	return strings.ToLower(value)
+}
+
+/*
+Store is the storage mechanism the UserService keeps its users in.
+
+Implementations must be safe for concurrent use and must not hand out
+pointers to the users they hold - every user passed in or returned is
+a copy owned by the caller.
+*/
+type Store interface {
+	/* Release anything held by the store, such as open files. */
+	Close() error
+
+	/*
+		Count the users whose account is locked at now. It's called by
+		every healthcheck, so it mustn't look at every user.
+	*/
+	CountLocked(now time.Time) (int, error)
+
+	/*
+		Add a new user to the store, or ErrConflict if another user
+		has its email or nickname.
+	*/
+	Create(user *user) error
+
+	/* Remove the user with id, or ErrNotFound if there isn't one. */
+	Delete(id string) error
+
+	/* Get the user with id, or ErrNotFound if there isn't one. */
+	Get(id string) (*user, error)
+
+	/*
+		Get every user that matches each of the filters, or every
+		user if there are none.
+	*/
+	List(filters []*filter) ([]*user, error)
+
+	/*
+		Call modify with the user with id and store the result, or
+		ErrNotFound if there isn't one. If modify returns an error
+		the user is left untouched and the error is returned, as is
+		ErrConflict if the result has another user's email or
+		nickname. modify must not call back in to the Store.
+	*/
+	Update(id string, modify func(user *user) error) (*user, error)
+
+	/*
+		Call visit with each user that matches each of the filters,
+		as they all were when Walk was called, oldest first. It stops
+		at the first error from visit or when ctx is done and returns
+		the error. visit must not call back in to the Store.
+	*/
+	Walk(ctx context.Context, filters []*filter, visit func(user *user) error) error
+}
+
+/*
+memoryStore is the in-memory Store. To prevent race conditions the
+users map is only touched by callbacks on its goroutine.
+
+If it has a log every mutation is written to it before being applied
+to the map, so the map can be rebuilt when the service restarts. The
+goroutine periodically writes a snapshot of the map so the log can be
+compacted.
+
+The users in the map are never modified, only replaced, which is what
+lets a snapshot be written from a copy of the map while the goroutine
+carries on.
+
+emails and nicknames index the ids of the users by uniqueKey, so the
+goroutine can refuse a user that would take another's email or
+nickname without a scan of the map. filters index the ids of the users
+by the value of each of the filterAttributes, so List only looks at
+the users that can match, and search indexes the tokens of their
+names and emails for the q filter. locked has when each user with a
+lockout is locked until, so CountLocked only looks at those users.
+*/
+type memoryStore struct {
+	callback  chan func()
+	closed    bool
+	dir       string
+	emails    map[string]string
+	filters   map[string]map[string]idSet
+	lock      *os.File
+	locked    map[string]time.Time
+	log       *wal
+	nicknames map[string]string
+	search    *searchIndex
+	users     map[string]*user
+
+	/* the newest snapshot and the one being written, if any */
+	snapshotSeq  uint64
+	snapshotting bool
+	snapshotted  chan snapshotResult
+	snapshots    sync.WaitGroup
+}
+
+type snapshotResult struct {
+	err error
+	seq uint64
+}
+
+/* A set of the ids of users. */
+type idSet map[string]struct{}
+
+/*
+The attributes the memoryStore keeps an index of for the filters of
+List. email_verified isn't one as half of the users have each value,
+so an index wouldn't narrow them down much.
+*/
+var filterAttributes = []string{"country", "email", "first_name", "last_name", "nickname"}
+
+/* Name of the write-ahead log in the directory of a durable store. */
+const walName = "users.wal"
+
+/* Name of the file a durable store locks so no other process uses its directory. */
+const lockName = "LOCK"
+
+/* Create a new in-memory Store. */
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+/*
+Create a new in-memory Store that persists its users to the directory
+dir, loading the newest snapshot and replaying the log written since.
+A snapshot is taken every interval, or never if interval is 0. The
+directory is locked until the store is closed, and ErrLocked is
+returned if another process has it.
+*/
+func NewDurableMemoryStore(dir string, interval time.Duration) (Store, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := loadDurableMemoryStore(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	ms.lock = lock
+	ms.start(interval)
+
+	return ms, nil
+}
+
+/* Load the users in dir from its newest snapshot and the wal after it. */
+func loadDurableMemoryStore(dir string) (*memoryStore, error) {
+	seq, users, err := loadSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &memoryStore{
+		callback:    make(chan func()),
+		dir:         dir,
+		snapshotSeq: seq,
+		snapshotted: make(chan snapshotResult, 1),
+		users:       users,
+	}
+
+	segments, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range segments {
+		l, err := openWAL(segment, seq, ms.replay)
+		if err != nil {
+			return nil, err
+		}
+
+		seq = l.seq
+		l.close()
+	}
+
+	ms.log, err = openWAL(filepath.Join(dir, walName), seq, ms.replay)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.reindex()
+
+	return ms, nil
+}
+
+func newMemoryStore() *memoryStore {
+	ms := &memoryStore{
+		callback:  make(chan func()),
+		emails:    make(map[string]string),
+		filters:   newFilterIndexes(),
+		locked:    make(map[string]time.Time),
+		nicknames: make(map[string]string),
+		search:    newSearchIndex(),
+		users:     make(map[string]*user),
+	}
+
+	ms.start(0)
+
+	return ms
+}
+
+/* Start the goroutine that owns the map. */
+func (ms *memoryStore) start(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	go func() {
+		for {
+			select {
+			case callback := <-ms.callback:
+				callback()
+			case <-tick:
+				err := ms.snapshot()
+				if err != nil {
+					log.Printf("unable to start snapshot: %s", err.Error())
+				}
+			case result := <-ms.snapshotted:
+				ms.snapshotting = false
+
+				if result.err != nil {
+					log.Printf("unable to write snapshot %d: %s", result.seq, result.err.Error())
+					continue
+				}
+
+				ms.snapshotSeq = result.seq
+			}
+		}
+	}()
+}
+
+/*
+Start writing a snapshot of the map, unless one is already being
+written or nothing has changed since the last one. Called on the
+goroutine.
+
+The log is rotated so the records up to the snapshot can be deleted
+once the snapshot is on disk, then the snapshot is written from a copy
+of the map in the background. If the last snapshot failed and nothing
+has been written since, the log was already rotated and is empty, so
+it's left as it is.
+*/
+func (ms *memoryStore) snapshot() error {
+	if ms.log == nil || ms.closed || ms.snapshotting || ms.log.seq == ms.snapshotSeq {
+		return nil
+	}
+
+	seq := ms.log.seq
+
+	err := ms.log.rotate(filepath.Join(ms.dir, segmentName(seq)))
+	if err != nil {
+		return err
+	}
+
+	users := maps.Clone(ms.users)
+
+	ms.snapshotting = true
+	ms.snapshots.Add(1)
+
+	go func() {
+		defer ms.snapshots.Done()
+
+		err := writeSnapshot(ms.dir, seq, users)
+		if err == nil {
+			err = compact(ms.dir)
+		}
+
+		ms.snapshotted <- snapshotResult{err: err, seq: seq}
+	}()
+
+	return nil
+}
+
+/*
+Apply a record from the write-ahead log to the map. Only called
+before the store is handed out, so the goroutine isn't needed.
+*/
+func (ms *memoryStore) replay(record *walRecord) error {
+	switch record.Op {
+	case walDelete:
+		delete(ms.users, record.ID)
+	case walPut:
+		if record.User == nil || record.User.ID != record.ID {
+			return fmt.Errorf("put record %d has no user %q", record.Seq, record.ID)
+		}
+
+		ms.users[record.ID] = record.User
+	default:
+		return fmt.Errorf("record %d has unknown op %q", record.Seq, record.Op)
+	}
+
+	return nil
+}
+
+/* Make an empty index for each of the filterAttributes. */
+func newFilterIndexes() map[string]map[string]idSet {
+	filters := make(map[string]map[string]idSet, len(filterAttributes))
+	for _, key := range filterAttributes {
+		filters[key] = make(map[string]idSet)
+	}
+
+	return filters
+}
+
+/*
+Build the indexes of emails, nicknames and filters from the map. Only
+called before the store is handed out.
+
+Users added before emails and nicknames were unique may share them,
+in which case the oldest user keeps the email or nickname in the index
+and the others are logged.
+*/
+func (ms *memoryStore) reindex() {
+	users := make([]*user, 0, len(ms.users))
+	for _, user := range ms.users {
+		users = append(users, user)
+	}
+
+	slices.SortFunc(users, func(a, b *user) int {
+		if c := a.CreatedAt.tm.Compare(b.CreatedAt.tm); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	ms.emails = make(map[string]string)
+	ms.filters = newFilterIndexes()
+	ms.locked = make(map[string]time.Time)
+	ms.nicknames = make(map[string]string)
+	ms.search = newSearchIndex()
+	ms.search.load()
+
+	for _, user := range users {
+		err := ms.unique(user, nil)
+		if err != nil {
+			log.Printf("%q was added before emails and nicknames were unique: %s", user.ID, err.Error())
+		}
+
+		ms.index(user)
+	}
+
+	ms.search.loaded()
+}
+
+/*
+Check no other user has the email or nickname of user. If user is a
+modification of current, only what has changed is checked, so users
+who shared an email or nickname before they were unique can still be
+modified. Called on the goroutine.
+*/
+func (ms *memoryStore) unique(user *user, current *user) error {
+	email := uniqueKey(user.Email)
+	if current == nil || email != uniqueKey(current.Email) {
+		id, ok := ms.emails[email]
+		if ok && id != user.ID {
+			return &conflictError{Field: "email"}
+		}
+	}
+
+	nickname := uniqueKey(user.Nickname)
+	if current == nil || nickname != uniqueKey(current.Nickname) {
+		id, ok := ms.nicknames[nickname]
+		if ok && id != user.ID {
+			return &conflictError{Field: "nickname"}
+		}
+	}
+
+	return nil
+}
+
+/*
+Add user to the indexes. Their email and nickname are only added if
+they don't already belong to another user. Called on the goroutine.
+*/
+func (ms *memoryStore) index(user *user) {
+	for key, index := range ms.filters {
+		value := user.attribute(key)
+
+		ids, ok := index[value]
+		if !ok {
+			ids = make(idSet)
+			index[value] = ids
+		}
+
+		ids[user.ID] = struct{}{}
+	}
+
+	email := uniqueKey(user.Email)
+	if _, ok := ms.emails[email]; !ok {
+		ms.emails[email] = user.ID
+	}
+
+	nickname := uniqueKey(user.Nickname)
+	if _, ok := ms.nicknames[nickname]; !ok {
+		ms.nicknames[nickname] = user.ID
+	}
+
+	if user.Auth.LockedUntil != nil {
+		ms.locked[user.ID] = *user.Auth.LockedUntil
+	}
+
+	ms.search.add(user)
+}
+
+/* Remove user from the indexes. Called on the goroutine. */
+func (ms *memoryStore) unindex(user *user) {
+	for key, index := range ms.filters {
+		value := user.attribute(key)
+
+		ids := index[value]
+		delete(ids, user.ID)
+
+		if len(ids) == 0 {
+			delete(index, value)
+		}
+	}
+
+	email := uniqueKey(user.Email)
+	if ms.emails[email] == user.ID {
+		delete(ms.emails, email)
+	}
+
+	nickname := uniqueKey(user.Nickname)
+	if ms.nicknames[nickname] == user.ID {
+		delete(ms.nicknames, nickname)
+	}
+
+	delete(ms.locked, user.ID)
+
+	ms.search.remove(user.ID)
+}
+
+/* Write a mutation to the log, if the store has one. */
+func (ms *memoryStore) persist(op string, id string, user *user) error {
+	if ms.log == nil {
+		return nil
+	}
+
+	return ms.log.append(op, id, user)
+}
+
+/*
+Close the log, if the store has one, once any snapshot being written
+has finished.
+*/
+func (ms *memoryStore) Close() error {
+	ch := make(chan error)
+
+	ms.callback <- func() {
+		ms.closed = true
+
+		ch <- nil
+	}
+
+	<-ch
+
+	ms.snapshots.Wait()
+
+	ms.callback <- func() {
+		if ms.log == nil {
+			ch <- nil
+			return
+		}
+
+		err := ms.log.close()
+
+		/* the directory is only unlocked once nothing more will be written to it */
+		lockErr := ms.lock.Close()
+		if err == nil {
+			err = lockErr
+		}
+
+		ch <- err
+	}
+
+	return <-ch
+}
+
+/* Count the users locked at now from the locked index. */
+func (ms *memoryStore) CountLocked(now time.Time) (int, error) {
+	ch := make(chan int)
+
+	ms.callback <- func() {
+		count := 0
+		for _, until := range ms.locked {
+			if now.Before(until) {
+				count++
+			}
+		}
+
+		ch <- count
+	}
+
+	return <-ch, nil
+}
+
+/* Add a new user to the in-memory storage mechanism. */
+func (ms *memoryStore) Create(user *user) error {
+	ch := make(chan error)
+
+	ms.callback <- func() {
+		err := ms.unique(user, nil)
+		if err != nil {
+			ch <- err
+			return
+		}
+
+		err = ms.persist(walPut, user.ID, user)
+		if err != nil {
+			ch <- err
+			return
+		}
+
+		ms.users[user.ID] = user.clone()
+		ms.index(user)
+
+		ch <- nil
+	}
+
+	return <-ch
+}
+
+/* Delete a user from the in-memory storage mechanism. */
+func (ms *memoryStore) Delete(id string) error {
+	ch := make(chan error)
+
+	ms.callback <- func() {
+		user, ok := ms.users[id]
+		if !ok {
+			ch <- ErrNotFound
+			return
+		}
+
+		err := ms.persist(walDelete, id, nil)
+		if err != nil {
+			ch <- err
+			return
+		}
+
+		delete(ms.users, id)
+		ms.unindex(user)
+
+		ch <- nil
+	}
+
+	return <-ch
+}
+
+/* Get a user from the in-memory storage mechanism. */
+func (ms *memoryStore) Get(id string) (*user, error) {
+	ch := make(chan *user)
+
+	ms.callback <- func() {
+		user, ok := ms.users[id]
+		if !ok {
+			ch <- nil
+			return
+		}
+
+		ch <- user.clone()
+	}
+
+	user := <-ch
+	if user == nil {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
+}
+
+/*
+Get a filtered list of the Users from the in-memory storage
+mechanism.
+*/
+func (ms *memoryStore) List(filters []*filter) ([]*user, error) {
+	ch := make(chan []*user)
+
+	ms.callback <- func() {
+		users := []*user{}
+		for _, user := range ms.candidates(filters) {
+			if !user.matches(filters) {
+				continue
+			}
+
+			users = append(users, user.clone())
+		}
+
+		ch <- users
+	}
+
+	return <-ch, nil
+}
+
+/*
+Get the users that could match filters, from the intersection of the
+indexes of the attributes with exact filters, of the emails and
+nicknames and of the search. An in filter is the union of the ids of
+each of its values. If none of the filters can use an index every user
+could match. Called on the goroutine.
+*/
+func (ms *memoryStore) candidates(filters []*filter) map[string]*user {
+	sets := []idSet{}
+	for _, f := range filters {
+		if f.operator == "search" {
+			ids := ms.search.lookup(f.values)
+			if len(ids) == 0 {
+				return nil
+			}
+
+			sets = append(sets, ids)
+			continue
+		}
+
+		if f.operator == "key" {
+			keys := ms.emails
+			if f.attribute == "nickname" {
+				keys = ms.nicknames
+			}
+
+			id, ok := keys[uniqueKey(f.values[0])]
+			if !ok {
+				return nil
+			}
+
+			sets = append(sets, idSet{id: {}})
+			continue
+		}
+
+		index, ok := ms.filters[f.attribute]
+		if !ok || !f.exact() {
+			continue
+		}
+
+		ids := index[f.values[0]]
+		if len(f.values) > 1 {
+			ids = idSet{}
+			for _, value := range f.values {
+				maps.Copy(ids, index[value])
+			}
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		sets = append(sets, ids)
+	}
+
+	if len(sets) == 0 {
+		return ms.users
+	}
+
+	/* only the smallest set has to be walked */
+	slices.SortFunc(sets, func(a, b idSet) int {
+		return len(a) - len(b)
+	})
+
+	users := make(map[string]*user, len(sets[0]))
+
+	for id := range sets[0] {
+		if !inAll(id, sets[1:]) {
+			continue
+		}
+
+		users[id] = ms.users[id]
+	}
+
+	return users
+}
+
+/* Is id in each of the sets? */
+func inAll(id string, sets []idSet) bool {
+	for _, ids := range sets {
+		if _, ok := ids[id]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Modify a user from the in-memory storage mechanism. */
+func (ms *memoryStore) Update(id string, modify func(user *user) error) (*user, error) {
+	type result struct {
+		user *user
+		err  error
+	}
+
+	ch := make(chan result)
+
+	ms.callback <- func() {
+		current, ok := ms.users[id]
+		if !ok {
+			ch <- result{err: ErrNotFound}
+			return
+		}
+
+		user := current.clone()
+
+		err := modify(user)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+
+		err = ms.unique(user, current)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+
+		err = ms.persist(walPut, id, user)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+
+		ms.users[id] = user
+		ms.unindex(current)
+		ms.index(user)
+
+		ch <- result{user: user.clone()}
+	}
+
+	r := <-ch
+
+	return r.user, r.err
+}
+
+/*
+Walk the users in the in-memory storage mechanism that match filters.
+Only pointers to them are taken on the goroutine, as the users in the
+map are never modified, and they're sorted and visited after, so a
+long walk doesn't hold up anything else.
+*/
+func (ms *memoryStore) Walk(ctx context.Context, filters []*filter, visit func(user *user) error) error {
+	ch := make(chan []*user)
+
+	ms.callback <- func() {
+		users := []*user{}
+		for _, user := range ms.candidates(filters) {
+			if user.matches(filters) {
+				users = append(users, user)
+			}
+		}
+
+		ch <- users
+	}
+
+	users := <-ch
+
+	sortUsers(users, defaultSort)
+
+	for _, user := range users {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = visit(user.clone())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,597 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/* brokenStore is a Store that fails everything it is asked to do. */
+type brokenStore struct{}
+
+var errBroken = errors.New("store is broken")
+
+func (brokenStore) Close() error {
+	return nil
+}
+
+func (brokenStore) CountLocked(now time.Time) (int, error) {
+	return 0, errBroken
+}
+
+func (brokenStore) Create(user *user) error {
+	return errBroken
+}
+
+func (brokenStore) Delete(id string) error {
+	return errBroken
+}
+
+func (brokenStore) Get(id string) (*user, error) {
+	return nil, errBroken
+}
+
+func (brokenStore) List(filters []*filter) ([]*user, error) {
+	return nil, errBroken
+}
+
+func (brokenStore) Update(id string, modify func(user *user) error) (*user, error) {
+	return nil, errBroken
+}
+
+func (brokenStore) Walk(ctx context.Context, filters []*filter, visit func(user *user) error) error {
+	return errBroken
+}
+
+/*
+TestMemoryStoreRoundTrip: Given I have created a User in the memory
+store when I get, update and delete it then each operation will see
+the effects of the one before it.
+*/
+func TestMemoryStoreRoundTrip(t *testing.T) {
+	store := NewMemoryStore()
+
+	id := uuid.NewString()
+	err := store.Create(&user{ID: id, Nickname: "AB123"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if got.Nickname != "AB123" {
+		t.Fatalf("expected nickname %q but got %q", "AB123", got.Nickname)
+	}
+
+	/* modifying what we got must not modify what is stored */
+
+	got.Nickname = "stale"
+
+	updated, err := store.Update(id, func(user *user) error {
+		if user.Nickname != "AB123" {
+			t.Fatalf("expected stored nickname %q but got %q", "AB123", user.Nickname)
+		}
+
+		user.Nickname = "ken"
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if updated.Nickname != "ken" {
+		t.Fatalf("expected nickname %q but got %q", "ken", updated.Nickname)
+	}
+
+	err = store.Delete(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = store.Get(id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
+
+/*
+TestMemoryStoreUpdateError: Given I have created a User in the memory
+store when the modify function of an update returns an error then the
+error is returned and the User is left untouched.
+*/
+func TestMemoryStoreUpdateError(t *testing.T) {
+	store := NewMemoryStore()
+
+	id := uuid.NewString()
+	err := store.Create(&user{ID: id, Nickname: "AB123"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = store.Update(id, func(user *user) error {
+		user.Nickname = "ken"
+
+		return errBroken
+	})
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expected errBroken but got %v", err)
+	}
+
+	got, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if got.Nickname != "AB123" {
+		t.Fatalf("expected nickname %q but got %q", "AB123", got.Nickname)
+	}
+}
+
+/*
+TestMemoryStoreNotFound: Given I have not created a User in the
+memory store when I delete, get or update it then ErrNotFound is
+returned.
+*/
+func TestMemoryStoreNotFound(t *testing.T) {
+	store := NewMemoryStore()
+
+	id := uuid.NewString()
+
+	err := store.Delete(id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from Delete but got %v", err)
+	}
+
+	_, err = store.Get(id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from Get but got %v", err)
+	}
+
+	_, err = store.Update(id, func(user *user) error { return nil })
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from Update but got %v", err)
+	}
+}
+
+/*
+TestBrokenStoreStatusIsInternalServerError: Given the UserService's
+Store is failing when I call any of the /users methods then the HTTP
+status code will be 500 Internal Server Error.
+*/
+func TestBrokenStoreStatusIsInternalServerError(t *testing.T) {
+	us, err := NewUserService(WithStore(brokenStore{}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data := map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   "f6b7e19e0d867de6c0391879050e8297165728d89d7c4e9e8839972b356c4d9d",
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	url := "/users/" + uuid.NewString()
+
+	requests := []struct {
+		method string
+		url    string
+		body   []byte
+	}{
+		{"DELETE", url, nil},
+		{"GET", "/users", nil},
+		{"PATCH", url, []byte("{}")},
+		{"POST", "/users", body},
+	}
+
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, request.url, bytes.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		us.ServeHTTP(w, req)
+
+		status := w.Result().StatusCode
+		if status != http.StatusInternalServerError {
+			t.Fatalf("%s %s: Unexpected error code. Got %d, %d expected.", request.method, request.url, status, http.StatusInternalServerError)
+		}
+	}
+}
+
+/* Expect err to be a conflict on field. */
+func expectConflict(t *testing.T, err error, field string) {
+	var conflict *conflictError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || conflict.Field != field {
+		t.Fatalf("expected a conflict on %s but got %v", field, err)
+	}
+}
+
+/*
+TestStoresRefuseDuplicates: Given a User has been created in a Store
+when another User is created or updated with their email or nickname,
+in any case, then ErrConflict is returned, until the first User is
+deleted. Each Store keeps refusing duplicates after a restart.
+*/
+func TestStoresRefuseDuplicates(t *testing.T) {
+	dataDir := t.TempDir()
+	database := filepath.Join(t.TempDir(), "users.db")
+
+	for name, open := range map[string]func() Store{
+		"durable": func() Store { return openDurable(t, dataDir) },
+		"sql":     func() Store { return openSQL(t, database) },
+	} {
+		store := open()
+		ids := createUsers(t, store, "rob", "ken")
+		store.Close()
+
+		store = open()
+
+		err := store.Create(&user{ID: uuid.NewString(), Email: "ROB@Bob.com", Nickname: "robert"})
+		expectConflict(t, err, "email")
+
+		err = store.Create(&user{ID: uuid.NewString(), Email: "robert@bob.com", Nickname: "Rob"})
+		expectConflict(t, err, "nickname")
+
+		_, err = store.Update(ids[1], func(user *user) error {
+			user.Email = "Rob@bob.com"
+			return nil
+		})
+		expectConflict(t, err, "email")
+
+		_, err = store.Update(ids[0], func(user *user) error {
+			user.Email = "Rob@Bob.com"
+			user.Nickname = "ROB"
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: expected a user to be able to change the case of their own email but got %v", name, err)
+		}
+
+		err = store.Delete(ids[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		err = store.Create(&user{ID: uuid.NewString(), Email: "rob@bob.com", Nickname: "rob"})
+		if err != nil {
+			t.Fatalf("%s: expected a deleted user's email and nickname to be free but got %v", name, err)
+		}
+
+		store.Close()
+	}
+}
+
+/*
+TestStoresRefuseConcurrentDuplicates: Given many Users with the same
+nickname are created at once in a Store then only one of them is
+added.
+*/
+func TestStoresRefuseConcurrentDuplicates(t *testing.T) {
+	for name, store := range map[string]Store{
+		"memory": NewMemoryStore(),
+		"sql":    openSQL(t, filepath.Join(t.TempDir(), "users.db")),
+	} {
+		errs := make(chan error)
+
+		for i := 0; i < 20; i++ {
+			go func() {
+				errs <- store.Create(&user{ID: uuid.NewString(), Email: uuid.NewString() + "@bob.com", Nickname: "rob"})
+			}()
+		}
+
+		created := 0
+		for i := 0; i < 20; i++ {
+			err := <-errs
+			if err == nil {
+				created++
+			} else if !errors.Is(err, ErrConflict) {
+				t.Fatal(err.Error())
+			}
+		}
+
+		if created != 1 {
+			t.Fatalf("%s: expected 1 user to be created but got %d", name, created)
+		}
+
+		store.Close()
+	}
+}
+
+/*
+TestDuplicateStatusIsConflict: Given I have created a User when I POST
+or PATCH another User with their email or nickname then the HTTP status
+code will be 409 Conflict and the problem names the attribute.
+*/
+func TestDuplicateStatusIsConflict(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	ken := validAttributes()
+	ken["email"] = "ken@bob.com"
+	ken["nickname"] = "ken"
+	postUser(t, us, ken)
+
+	id := getUsers(t, us, "/users?nickname=ken")[0]["id"]
+
+	duplicate := validAttributes()
+	duplicate["email"] = "Alice@Bob.com"
+	duplicate["nickname"] = "alice"
+
+	body, err := json.Marshal(duplicate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, request := range []struct {
+		method string
+		url    string
+		body   string
+		field  string
+	}{
+		{"POST", "/users", string(body), "email"},
+		{"PATCH", "/users/" + id, `{"nickname":"ab123"}`, "nickname"},
+	} {
+		w := serveWithToken(t, us, request.method, request.url, "", request.body)
+
+		p := expectProblem(t, w, http.StatusConflict, "conflict", request.url)
+		if len(p.Errors) != 1 || p.Errors[0].Field != request.field {
+			t.Fatalf("%s %s: expected a conflict on %s but got %v", request.method, request.url, request.field, p.Errors)
+		}
+	}
+
+	if getUsers(t, us, "/users?nickname=ken")[0]["id"] != id {
+		t.Fatal("expected a conflicting PATCH not to modify the user")
+	}
+}
+
+/*
+Create count users in a memory store, spread over a few countries and
+names so filters on each attribute narrow them down differently.
+*/
+func newFilledMemoryStore(tb testing.TB, count int) *memoryStore {
+	ms := newMemoryStore()
+
+	countries := []string{"GB", "US", "CA", "CH", "FR", "DE", "NZ", "AU"}
+
+	for i := 0; i < count; i++ {
+		err := ms.Create(&user{
+			ID:        uuid.NewString(),
+			Country:   countries[i%len(countries)],
+			Email:     fmt.Sprintf("user_%d@bob.com", i),
+			FirstName: fmt.Sprintf("User%d", i%100),
+			LastName:  fmt.Sprintf("%d", i%1000),
+			Nickname:  fmt.Sprintf("user_%d", i),
+		})
+		if err != nil {
+			tb.Fatal(err.Error())
+		}
+	}
+
+	return ms
+}
+
+/* List the users in ms that match filters by looking at every one of them. */
+func scanMemoryStore(ms *memoryStore, filters []*filter) []*user {
+	ch := make(chan []*user)
+
+	ms.callback <- func() {
+		users := []*user{}
+		for _, user := range ms.users {
+			if user.matches(filters) {
+				users = append(users, user.clone())
+			}
+		}
+
+		ch <- users
+	}
+
+	return <-ch
+}
+
+/*
+TestMemoryStoreListUsesIndexes: Given a memory store with Users that
+have been created, updated and deleted when I list them with filters
+on indexed and unindexed attributes then I get the same Users as a
+scan of every User would.
+*/
+func TestMemoryStoreListUsesIndexes(t *testing.T) {
+	ms := newFilledMemoryStore(t, 2000)
+
+	users, err := ms.List([]*filter{equals("first_name", "User7")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i, listed := range users {
+		if i%2 == 0 {
+			err = ms.Delete(listed.ID)
+		} else {
+			_, err = ms.Update(listed.ID, func(user *user) error {
+				user.Country = "GB"
+				user.EmailVerified = true
+				return nil
+			})
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"country=GB",
+		"country=GB&first_name=User7",
+		"country=US&first_name=User7",
+		"country=GB&email_verified=true",
+		"email=user_7@bob.com",
+		"last_name=7&first_name=User7&country=GB",
+		"nickname=nobody",
+		"email_verified=false",
+		"country[in]=GB,FR&first_name=User7",
+		"country[in]=GB,XX&last_name[in]=7,8",
+		"country[in]=XX,YY",
+		"country[not_eq]=GB&first_name=User7",
+		"first_name[ieq]=user7&country=GB",
+		"nickname[prefix]=user_7&country[not_in]=US,CA",
+		"q=usr7",
+		"q=user_77&country=GB",
+		"q=bob+nobody",
+	} {
+		filters, err := parseFilters(parseQuery(t, query), time.Now())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		got, err := ms.List(filters)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		expected := scanMemoryStore(ms, filters)
+
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected %d users but got %d", query, len(expected), len(got))
+		}
+
+		for _, user := range got {
+			if !user.matches(filters) {
+				t.Fatalf("%s: got %q which doesn't match", query, user.ID)
+			}
+		}
+	}
+}
+
+/*
+BenchmarkMemoryStoreList: compare listing the Users that match some
+filters with the indexes to scanning every User, at the scale of
+TestLimitAndPageUserCount and ten times it.
+*/
+func BenchmarkMemoryStoreList(b *testing.B) {
+	for _, count := range []int{9000, 90000} {
+		ms := newFilledMemoryStore(b, count)
+
+		for name, filters := range map[string][]*filter{
+			"country":           {equals("country", "GB")},
+			"nickname":          {equals("nickname", "user_42")},
+			"country+last_name": {equals("country", "GB"), equals("last_name", "42")},
+			"unindexed":         {equals("email_verified", "true")},
+			"search":            {{attribute: "q", operator: "search", values: []string{"usr", "42"}}},
+		} {
+			b.Run(fmt.Sprintf("%d/indexed/%s", count, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := ms.List(filters)
+					if err != nil {
+						b.Fatal(err.Error())
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("%d/scan/%s", count, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					scanMemoryStore(ms, filters)
+				}
+			})
+		}
+
+		ms.Close()
+	}
+}
+
+/*
+TestStoresCountLocked: Given Users whose accounts are locked until
+different times when the locked accounts are counted then only those
+still locked are, and not once they're unlocked or deleted, with the
+memory store and the SQL store.
+*/
+func TestStoresCountLocked(t *testing.T) {
+	for name, store := range map[string]Store{
+		"memory": NewMemoryStore(),
+		"sql":    openSQL(t, filepath.Join(t.TempDir(), "users.db")),
+	} {
+		now := time.Unix(1700000000, 0)
+
+		ids := createUsers(t, store, "rob", "ken", "griesemer", "pike")
+
+		for i, until := range []time.Duration{time.Minute, time.Hour, -time.Minute} {
+			lockedUntil := now.Add(until)
+
+			_, err := store.Update(ids[i], func(user *user) error {
+				user.Auth.LockedUntil = &lockedUntil
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		_, err := store.Update(ids[0], func(user *user) error {
+			user.FirstName = "Rob"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, test := range []struct {
+			at       time.Time
+			expected int
+		}{
+			{now, 2},
+			{now.Add(time.Minute), 1},
+			{now.Add(time.Hour), 0},
+		} {
+			count, err := store.CountLocked(test.at)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if count != test.expected {
+				t.Fatalf("%s: expected %d locked at %s but got %d", name, test.expected, test.at, count)
+			}
+		}
+
+		_, err = store.Update(ids[0], func(user *user) error {
+			user.Auth.LockedUntil = nil
+			return nil
+		})
+		if err == nil {
+			err = store.Delete(ids[1])
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		count, err := store.CountLocked(now)
+		if err != nil || count != 0 {
+			t.Fatalf("%s: expected none locked once unlocked and deleted but got %d %v", name, count, err)
+		}
+
+		store.Close()
+	}
+}
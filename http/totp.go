@@ -0,0 +1,379 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	/* Digits in a TOTP code. */
+	totpDigits = 6
+
+	/* How long each TOTP code is for, the time step of RFC 6238. */
+	totpPeriod = 30 * time.Second
+
+	/* Time steps either side of now a code is accepted from, to allow for clock drift. */
+	totpSkew = 1
+
+	/* Recovery codes made when TOTP is enrolled. */
+	recoveryCodeCount = 10
+)
+
+var (
+	errSecondFactorRequired = errors.New("second factor required")
+	errInvalidSecondFactor  = errors.New("invalid second factor")
+)
+
+/* Base32 without padding, as authenticator apps expect secrets. */
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+totpState is a user's enrolment in TOTP. The secret has to be kept to
+check codes, but recovery codes are only kept hashed. LastStep is the
+time step of the last code used, so a code can't be used twice.
+*/
+type totpState struct {
+	Confirmed     bool     `json:"confirmed"`
+	LastStep      int64    `json:"last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	Secret        string   `json:"secret"`
+}
+
+/* Is TOTP required to authenticate? */
+func (ts *totpState) enrolled() bool {
+	return ts != nil && ts.Confirmed
+}
+
+/*
+The HOTP value of RFC 4226 for key at counter, which TOTP uses with the
+time step as the counter.
+*/
+func hotp(key []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+/* The time step of RFC 6238 at now. */
+func totpStep(now time.Time) int64 {
+	return now.Unix() / int64(totpPeriod/time.Second)
+}
+
+/*
+Check code against the secret at now, returning the time step it
+matched. Codes from before the last one used are refused.
+*/
+func (ts *totpState) verify(code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(ts.Secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= ts.LastStep {
+			continue
+		}
+
+		expected := hotp(key, uint64(step), totpDigits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+/* Make a new TOTP secret. */
+func newTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+/*
+The otpauth URI of Google Authenticator's key URI format, which
+authenticator apps read from a QR code.
+*/
+func totpURI(account string, secret string) string {
+	query := url.Values{}
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("issuer", tokenIssuerName)
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	query.Set("secret", secret)
+
+	label := url.PathEscape(tokenIssuerName + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+/* Recovery codes are compared without case, spaces or dashes. */
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToLower(code))
+}
+
+/* Make new recovery codes, returning them and their hashes to store. */
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 10)
+
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		hashes[i] = hashOpaqueToken(normalizeRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+/*
+Check the second factor in data for the user with id, which is either
+a TOTP code or a recovery code. A recovery code is used up, and a TOTP
+code can't be used again.
+*/
+func (us *UserService) useSecondFactor(id string, data map[string]string, now time.Time) error {
+	_, err := us.store.Update(id, func(user *user) error {
+		totp := user.Auth.TOTP
+
+		code, ok := data["totp"]
+		if ok {
+			step, ok := totp.verify(code, now)
+			if !ok {
+				return errInvalidSecondFactor
+			}
+
+			totp.LastStep = step
+
+			return nil
+		}
+
+		recovery, ok := data["recovery_code"]
+		if ok {
+			hash := hashOpaqueToken(normalizeRecoveryCode(recovery))
+
+			i := slices.Index(totp.RecoveryCodes, hash)
+			if i < 0 {
+				return errInvalidSecondFactor
+			}
+
+			log.Printf("recovery code used by %q, %d left", id, len(totp.RecoveryCodes)-1)
+
+			totp.RecoveryCodes = slices.Delete(totp.RecoveryCodes, i, i+1)
+
+			return nil
+		}
+
+		return errSecondFactorRequired
+	})
+
+	return err
+}
+
+/* The body returned when TOTP enrolment starts. */
+type totpEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+/* The body returned when TOTP enrolment is confirmed. */
+type totpConfirmation struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+/* Write body as JSON with the status 200 OK. */
+func (us *UserService) writeJSON(w http.ResponseWriter, r *http.Request, body any) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("[%s] %s %s: unable to marshal response %q", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to marshal the response")
+		return
+	}
+
+	us.hc.increment(http.StatusOK)
+	w.Write(raw)
+}
+
+func (us *UserService) enrolTOTP(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	id := r.PathValue("id")
+
+	log.Printf("[%s] POST /users/{id}/mfa/totp: attempting to enrol %q", sender, id)
+
+	err := uuid.Validate(id)
+	if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp: %q is not a valid user id", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp: unable to make secret: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to make a secret")
+		return
+	}
+
+	errEnrolled := errors.New("already enrolled")
+
+	user, err := us.store.Update(id, func(user *user) error {
+		if user.Auth.TOTP.enrolled() {
+			return errEnrolled
+		}
+
+		user.Auth.TOTP = &totpState{Secret: secret}
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("[%s] POST /users/{id}/mfa/totp: %q is not a user", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if errors.Is(err, errEnrolled) {
+		log.Printf("[%s] POST /users/{id}/mfa/totp: %q is already enrolled", sender, id)
+
+		us.fail(w, r, http.StatusConflict, "the user is already enrolled")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp: unable to enrol %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to enrol the user")
+		return
+	}
+
+	log.Printf("[%s] POST /users/{id}/mfa/totp: started enrolment of %q", sender, id)
+
+	us.writeJSON(w, r, &totpEnrolment{Secret: secret, URI: totpURI(user.Email, secret)})
+}
+
+func (us *UserService) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	id := r.PathValue("id")
+
+	log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: attempting to confirm enrolment of %q", sender, id)
+
+	err := uuid.Validate(id)
+	if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: %q is not a valid user id", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	}
+
+	data := map[string]string{}
+
+	err = decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || data["totp"] == "" {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: expected totp", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected totp")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: unable to make recovery codes: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to make recovery codes")
+		return
+	}
+
+	errNotPending := errors.New("no enrolment pending")
+	now := us.clock()
+
+	_, err = us.store.Update(id, func(user *user) error {
+		totp := user.Auth.TOTP
+		if totp == nil || totp.Confirmed {
+			return errNotPending
+		}
+
+		step, ok := totp.verify(data["totp"], now)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+
+		totp.Confirmed = true
+		totp.LastStep = step
+		totp.RecoveryCodes = hashes
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: %q is not a user", sender, id)
+
+		us.fail(w, r, http.StatusNotFound, "there is no user with this id")
+		return
+	} else if errors.Is(err, errNotPending) {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: %q has no enrolment to confirm", sender, id)
+
+		us.fail(w, r, http.StatusConflict, "the user has no enrolment to confirm")
+		return
+	} else if errors.Is(err, errInvalidSecondFactor) {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: code did not match for %q", sender, id)
+
+		us.fail(w, r, http.StatusBadRequest, "the code did not match")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: unable to confirm %q: %s", sender, id, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to confirm the enrolment")
+		return
+	}
+
+	log.Printf("[%s] POST /users/{id}/mfa/totp/confirm: enrolled %q", sender, id)
+
+	us.writeJSON(w, r, &totpConfirmation{RecoveryCodes: codes})
+}
@@ -0,0 +1,268 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestHOTPMatchesRFC6238: Given the SHA1 test vectors of RFC 6238 when
+I make the 8 digit code for each time then it matches the RFC.
+*/
+func TestHOTPMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	for unix, expected := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		got := hotp(key, uint64(totpStep(time.Unix(unix, 0))), 8)
+		if got != expected {
+			t.Fatalf("expected code %q at %d but got %q", expected, unix, got)
+		}
+	}
+}
+
+/* The TOTP code of secret at now. */
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return hotp(key, uint64(totpStep(now)), totpDigits)
+}
+
+/*
+Create a UserService with sessions at a fixed time with AB123 enrolled
+in TOTP, returning the secret, recovery codes and an access token of
+AB123.
+*/
+func newTOTPService(t *testing.T, now *time.Time) (*UserService, string, []string, string) {
+	us, err := NewUserService(WithTokenKey(writeSecret(t)), WithClock(func() time.Time { return *now }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+	access := logIn(t, us).AccessToken
+
+	w := serveWithToken(t, us, "POST", "/users/"+id+"/mfa/totp", access, "")
+
+	status := w.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	enrolment := totpEnrolment{}
+
+	err = json.NewDecoder(w.Body).Decode(&enrolment)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	uri, err := url.Parse(enrolment.URI)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Query().Get("secret") != enrolment.Secret {
+		t.Fatalf("unexpected otpauth URI %q", enrolment.URI)
+	}
+
+	confirm := "/users/" + id + "/mfa/totp/confirm"
+
+	status = serveWithToken(t, us, "POST", confirm, access, `{"totp":"000000"}`).Result().StatusCode
+	if status != http.StatusBadRequest {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusBadRequest)
+	}
+
+	w = serveWithToken(t, us, "POST", confirm, access, `{"totp":"`+totpCode(t, enrolment.Secret, *now)+`"}`)
+
+	status = w.Result().StatusCode
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusOK)
+	}
+
+	confirmation := totpConfirmation{}
+
+	err = json.NewDecoder(w.Body).Decode(&confirmation)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes but got %d", recoveryCodeCount, len(confirmation.RecoveryCodes))
+	}
+
+	return us, enrolment.Secret, confirmation.RecoveryCodes, access
+}
+
+/* Authenticate as AB123 with the extra attributes of a second factor, returning the status. */
+func authenticateWith(t *testing.T, us *UserService, extra string) int {
+	return postAuthenticate(t, us, `{"nickname":"AB123","password":"`+alicePassword+`"`+extra+`}`).Result().StatusCode
+}
+
+/*
+TestAuthenticateRequiresTOTP: Given I have enrolled in TOTP when I
+authenticate then the second factor is required, a wrong or reused
+code is refused and the current code is accepted.
+*/
+func TestAuthenticateRequiresTOTP(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	us, secret, _, _ := newTOTPService(t, &now)
+
+	w := postAuthenticate(t, us, `{"nickname":"AB123","password":"`+alicePassword+`"}`)
+	if w.Result().StatusCode != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "#second-factor-required") {
+		t.Fatalf("expected a second factor to be required but got %d %s", w.Result().StatusCode, w.Body.String())
+	}
+
+	/* the code used to confirm enrolment can't be used again */
+	status := authenticateWith(t, us, `,"totp":"`+totpCode(t, secret, now)+`"`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code for a used code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+
+	now = now.Add(totpPeriod)
+
+	code := totpCode(t, secret, now)
+
+	for extra, expected := range map[string]int{
+		`,"totp":"000000"`:       http.StatusUnauthorized,
+		`,"totp":"` + code + `"`: http.StatusOK,
+	} {
+		status = authenticateWith(t, us, extra)
+		if status != expected {
+			t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", extra, status, expected)
+		}
+	}
+
+	status = authenticateWith(t, us, `,"totp":"`+code+`"`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected error code for a reused code. Got %d, %d expected.", status, http.StatusUnauthorized)
+	}
+
+	status = authenticateWith(t, us, `,"totp":"`+totpCode(t, secret, now.Add(totpPeriod))+`"`)
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected error code for the next code. Got %d, %d expected.", status, http.StatusOK)
+	}
+}
+
+/*
+TestRecoveryCodesAreSingleUse: Given I have enrolled in TOTP when I
+authenticate with a recovery code then it is accepted once, and only
+its hash is stored.
+*/
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	us, _, codes, _ := newTOTPService(t, &now)
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, stored := range users[0].Auth.TOTP.RecoveryCodes {
+		for _, code := range codes {
+			if stored == code || stored == normalizeRecoveryCode(code) {
+				t.Fatal("expected recovery codes to be stored hashed")
+			}
+		}
+	}
+
+	/* recovery codes can be typed without dashes and in upper case */
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+
+	for _, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		status := authenticateWith(t, us, `,"recovery_code":"`+typed+`"`)
+		if status != expected {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, expected)
+		}
+	}
+}
+
+/*
+TestEnrolTOTPTwiceIsConflict: Given I have enrolled in TOTP when I
+enrol again then the HTTP status code will be 409 Conflict.
+*/
+func TestEnrolTOTPTwiceIsConflict(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	us, _, _, access := newTOTPService(t, &now)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+
+	for _, path := range []string{"/users/" + id + "/mfa/totp", "/users/" + id + "/mfa/totp/confirm"} {
+		status := serveWithToken(t, us, "POST", path, access, `{"totp":"000000"}`).Result().StatusCode
+		if status != http.StatusConflict {
+			t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", path, status, http.StatusConflict)
+		}
+	}
+}
+
+/*
+TestEnrolTOTPRequiresSessions: Given sessions are enabled when I enrol
+in TOTP without an access token, or with another user's, then the HTTP
+status code will be 401 Unauthorized or 403 Forbidden. Without sessions
+nobody can enrol, as nothing says who's asking, so it's 404 Not Found.
+*/
+func TestEnrolTOTPRequiresSessions(t *testing.T) {
+	us, id := newSessionService(t)
+
+	postUser(t, us, map[string]string{
+		"country":    "GB",
+		"email":      "rob@bob.com",
+		"first_name": "Rob",
+		"last_name":  "Bob",
+		"nickname":   "rob",
+		"password":   alicePassword,
+	})
+
+	w := postAuthenticate(t, us, `{"nickname":"rob","password":"`+alicePassword+`"}`)
+
+	resp := authenticated{tokenPair: &tokenPair{}}
+
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, path := range []string{"/users/" + id + "/mfa/totp", "/users/" + id + "/mfa/totp/confirm"} {
+		for token, expected := range map[string]int{
+			"":               http.StatusUnauthorized,
+			resp.AccessToken: http.StatusForbidden,
+		} {
+			status := serveWithToken(t, us, "POST", path, token, `{"totp":"000000"}`).Result().StatusCode
+			if status != expected {
+				t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", path, status, expected)
+			}
+		}
+	}
+
+	sessionless, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, sessionless)
+
+	id = getUsers(t, sessionless, "/users")[0]["id"]
+
+	for _, path := range []string{"/users/" + id + "/mfa/totp", "/users/" + id + "/mfa/totp/confirm"} {
+		w := serveWithToken(t, sessionless, "POST", path, "", `{"totp":"000000"}`)
+
+		expectProblem(t, w, http.StatusNotFound, "not-found", path)
+	}
+}
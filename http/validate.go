@@ -0,0 +1,186 @@
+package http
+
+import (
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* The attributes of a user a client can set, with POST all are required. */
+var writableAttributes = []string{"country", "email", "first_name", "last_name", "nickname", "password"}
+
+/* The limits on the lengths of attributes, in characters. */
+const (
+	maxEmailLength    = 254
+	maxNameLength     = 100
+	maxNicknameLength = 32
+	maxPasswordLength = 1024
+	minNicknameLength = 3
+	minPasswordLength = 8
+)
+
+/* What is wrong with an attribute sent by a client. */
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+/*
+The ISO 3166-1 alpha-2 codes that are officially assigned, which is
+what country must be.
+*/
+var countryCodes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ
+		BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR
+		CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+		GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU
+		ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ
+		LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+		MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF
+		PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI
+		SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR
+		TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW
+	`) {
+		codes[code] = true
+	}
+
+	return codes
+}()
+
+/*
+Check the attributes a client sent to create or modify a user,
+returning what is wrong with each field. With POST every writable
+attribute is required, with PATCH (partial) only those sent are
+checked. Attributes that can't be written are always refused.
+*/
+func validateUser(data map[string]string, partial bool) []fieldError {
+	errs := []fieldError{}
+
+	for key := range data {
+		if !slices.Contains(writableAttributes, key) {
+			errs = append(errs, fieldError{key, "is not an attribute that can be set"})
+		}
+	}
+
+	checks := map[string]func(string) string{
+		"country":    validateCountry,
+		"email":      validateEmail,
+		"first_name": validateName,
+		"last_name":  validateName,
+		"nickname":   validateNickname,
+		"password":   validatePassword,
+	}
+
+	for _, key := range writableAttributes {
+		value, ok := data[key]
+		if !ok {
+			if !partial {
+				errs = append(errs, fieldError{key, "is required"})
+			}
+
+			continue
+		}
+
+		message := checks[key](value)
+		if message != "" {
+			errs = append(errs, fieldError{key, message})
+		}
+	}
+
+	slices.SortFunc(errs, func(a, b fieldError) int {
+		return strings.Compare(a.Field, b.Field)
+	})
+
+	return errs
+}
+
+func validateCountry(country string) string {
+	if !countryCodes[country] {
+		return "must be an ISO 3166-1 alpha-2 country code, e.g. GB"
+	}
+
+	return ""
+}
+
+func validateEmail(email string) string {
+	if len(email) > maxEmailLength {
+		return "must be at most 254 characters"
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "must be an email address, e.g. alice@bob.com"
+	}
+
+	return ""
+}
+
+func validateName(name string) string {
+	length := utf8.RuneCountInString(name)
+	if !utf8.ValidString(name) || strings.TrimSpace(name) == "" || length > maxNameLength {
+		return "must be between 1 and 100 characters"
+	}
+
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "must not contain control characters"
+	}
+
+	return ""
+}
+
+func validateNickname(nickname string) string {
+	if len(nickname) < minNicknameLength || len(nickname) > maxNicknameLength {
+		return "must be between 3 and 32 characters"
+	}
+
+	for _, r := range nickname {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-", r)) {
+			return "must only contain letters, digits, '_', '.' and '-'"
+		}
+	}
+
+	return ""
+}
+
+/*
+Passwords are only checked for length, as clients send a hash of the
+password rather than the password itself.
+*/
+func validatePassword(password string) string {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "must be between 8 and 1024 characters"
+	}
+
+	return ""
+}
+
+/* Respond 400 Bad Request with what is wrong with each field. */
+func (us *UserService) invalid(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	for _, err := range errs {
+		log.Printf("[%s] %s %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path, err.Field, err.Message)
+	}
+
+	us.problem(w, r, &problem{
+		Type:   problemTypes + "invalid-attributes",
+		Title:  "Invalid attributes",
+		Status: http.StatusBadRequest,
+		Detail: "one or more attributes are not valid, see errors",
+		Errors: errs,
+	})
+}
+
+/* Respond 409 Conflict with the attribute another user already has. */
+func (us *UserService) conflict(w http.ResponseWriter, r *http.Request, err *conflictError) {
+	log.Printf("[%s] %s %s: %s", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+
+	p := newProblem(http.StatusConflict, "another user already has this "+err.Field)
+	p.Errors = []fieldError{{err.Field, "is already taken"}}
+
+	us.problem(w, r, p)
+}
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/* Valid attributes for a new User, which tests break one at a time. */
+func validAttributes() map[string]string {
+	return map[string]string{
+		"country":    "GB",
+		"email":      "alice@bob.com",
+		"first_name": "Alice",
+		"last_name":  "Bob",
+		"nickname":   "AB123",
+		"password":   alicePassword,
+	}
+}
+
+/*
+TestValidateUserRefusesEachField: Given valid attributes when one of
+them is changed to something invalid then only that field has an
+error.
+*/
+func TestValidateUserRefusesEachField(t *testing.T) {
+	errs := validateUser(validAttributes(), false)
+	if len(errs) != 0 {
+		t.Fatalf("expected valid attributes but got %v", errs)
+	}
+
+	for _, invalid := range []struct {
+		key   string
+		value string
+	}{
+		{"country", "UK"},
+		{"country", "gb"},
+		{"country", "Canada/Australia"},
+		{"email", "alice"},
+		{"email", "Alice <alice@bob.com>"},
+		{"email", strings.Repeat("a", 250) + "@bob.com"},
+		{"first_name", ""},
+		{"first_name", "   "},
+		{"first_name", strings.Repeat("a", maxNameLength+1)},
+		{"last_name", "Bob\n"},
+		{"nickname", "AB"},
+		{"nickname", "AB 123"},
+		{"nickname", "Ælfred"},
+		{"nickname", strings.Repeat("a", maxNicknameLength+1)},
+		{"password", "short"},
+		{"password", strings.Repeat("a", maxPasswordLength+1)},
+		{"id", "9f4ce4f5-32bf-499d-af6c-c475293d7612"},
+	} {
+		data := validAttributes()
+		data[invalid.key] = invalid.value
+
+		errs := validateUser(data, false)
+		if len(errs) != 1 || errs[0].Field != invalid.key {
+			t.Fatalf("expected only %s %q to be invalid but got %v", invalid.key, invalid.value, errs)
+		}
+	}
+}
+
+/*
+TestValidateUserPartial: Given a PATCH only sends some attributes when
+they are validated then the missing ones are not required.
+*/
+func TestValidateUserPartial(t *testing.T) {
+	data := map[string]string{"nickname": "ken"}
+
+	if len(validateUser(data, true)) != 0 {
+		t.Fatal("expected a partial user to be valid")
+	}
+
+	errs := validateUser(data, false)
+	if len(errs) != len(writableAttributes)-1 {
+		t.Fatalf("expected every other attribute to be required but got %v", errs)
+	}
+}
+
+/*
+TestInvalidAttributesStatusIsBadRequest: Given I send invalid attributes
+to POST /users or PATCH /users/{id} then the HTTP status code will be
+400 Bad Request and the body lists the error of each field.
+*/
+func TestInvalidAttributesStatusIsBadRequest(t *testing.T) {
+	us, err := NewUserService()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	postAlice(t, us)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+
+	for _, request := range []struct {
+		method string
+		url    string
+		body   string
+		fields []string
+	}{
+		{"POST", "/users", `{"country":"UK","email":"alice"}`, []string{"country", "email", "first_name", "last_name", "nickname", "password"}},
+		{"PATCH", "/users/" + id, `{"nickname":"A","id":"x"}`, []string{"id", "nickname"}},
+		{"PATCH", "/users/" + id, `{"email_verified":"true"}`, []string{"email_verified"}},
+	} {
+		w := serveWithToken(t, us, request.method, request.url, "", request.body)
+
+		status := w.Result().StatusCode
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s %s: Got %d, %d expected.", request.method, request.url, status, http.StatusBadRequest)
+		}
+
+		body := problem{}
+
+		err = json.NewDecoder(w.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		fields := []string{}
+		for _, fieldErr := range body.Errors {
+			fields = append(fields, fieldErr.Field)
+		}
+
+		if strings.Join(fields, ",") != strings.Join(request.fields, ",") {
+			t.Fatalf("%s %s: expected errors for %v but got %v", request.method, request.url, request.fields, body.Errors)
+		}
+	}
+
+	if getUsers(t, us, "/users")[0]["nickname"] != "AB123" {
+		t.Fatal("expected an invalid PATCH not to modify the user")
+	}
+}
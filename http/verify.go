@@ -0,0 +1,106 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* How long an email verification token can be used for. */
+const emailVerificationTTL = 24 * time.Hour
+
+/*
+Make a new email verification token for the user with id, returning
+the token to send them and what to store in their auth state.
+*/
+func newEmailVerification(id string, now time.Time) (string, *oneTimeToken, error) {
+	token, hash, err := newOpaqueToken(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &oneTimeToken{ExpiresAt: now.Add(emailVerificationTTL), Hash: hash}, nil
+}
+
+/*
+Send an email verification token to email. The user has already been
+stored, so failing to send is only logged.
+*/
+func (us *UserService) sendEmailVerification(id string, email string, token string, now time.Time) {
+	err := us.notifier.Notify(&Message{
+		Body:    fmt.Sprintf("Use this token to verify your email, it expires in %s:\n\n%s\n", emailVerificationTTL, token),
+		SentAt:  now,
+		Subject: "Verify your email",
+		To:      email,
+	})
+	if err != nil {
+		log.Printf("unable to send email verification to %q: %s", id, err.Error())
+	}
+}
+
+/* Mark the email of the user the verification token belongs to as verified. */
+func (us *UserService) confirmEmailVerification(presented string) error {
+	id, ok := opaqueTokenUser(presented)
+	if !ok {
+		return errInvalidToken
+	}
+
+	now := us.clock()
+
+	_, err := us.store.Update(id, func(user *user) error {
+		if !user.Auth.EmailVerification.accepts(presented, now) {
+			return errInvalidToken
+		}
+
+		user.EmailVerified = true
+		user.UpdatedAt.tm = now
+		user.Auth.EmailVerification = nil
+
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return errInvalidToken
+	}
+
+	return err
+}
+
+func (us *UserService) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	sender := r.RemoteAddr
+
+	log.Printf("[%s] POST /users/verify-email: attempting to verify email", sender)
+
+	data := map[string]string{}
+
+	err := decodeBody(w, r, &data)
+	if us.tooLarge(w, r, err) {
+		return
+	}
+
+	if err != nil || data["token"] == "" {
+		log.Printf("[%s] POST /users/verify-email: expected token", sender)
+
+		us.fail(w, r, http.StatusBadRequest, "expected token")
+		return
+	}
+
+	err = us.confirmEmailVerification(data["token"])
+	if errors.Is(err, errInvalidToken) {
+		log.Printf("[%s] POST /users/verify-email: token is not valid", sender)
+
+		us.fail(w, r, http.StatusUnauthorized, "the token is not valid")
+		return
+	} else if err != nil {
+		log.Printf("[%s] POST /users/verify-email: unable to verify email: %s", sender, err.Error())
+
+		us.fail(w, r, http.StatusInternalServerError, "unable to verify the email")
+		return
+	}
+
+	log.Printf("[%s] POST /users/verify-email: verified email", sender)
+
+	us.hc.increment(http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+/* GET url and decode the Users in the response, failing the test if it isn't 200 OK or 204 No Content. */
+func getUsers(t *testing.T, us *UserService, url string) []map[string]string {
+	w := serveWithToken(t, us, "GET", url, "", "")
+
+	status := w.Result().StatusCode
+	if status == http.StatusNoContent {
+		return nil
+	} else if status != http.StatusOK {
+		t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", url, status, http.StatusOK)
+	}
+
+	users := userList{}
+
+	err := json.NewDecoder(w.Body).Decode(&users)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return users
+}
+
+/*
+TestEmailVerificationOnCreate: Given I have created a User when I
+confirm the token they were sent then the HTTP status code will be
+204 No Content and their email_verified will be "true", and the token
+can't be used again.
+*/
+func TestEmailVerificationOnCreate(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	if notifier.messages[0].To != "alice@bob.com" {
+		t.Fatalf("expected verification sent to %q but got %q", "alice@bob.com", notifier.messages[0].To)
+	}
+
+	if getUsers(t, us, "/users")[0]["email_verified"] != "false" {
+		t.Fatal("expected a new user's email to be unverified")
+	}
+
+	token := notifier.lastToken(t)
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusUnauthorized} {
+		status := postStatus(t, us, "/users/verify-email", `{"token":"`+token+`"}`)
+		if status != expected {
+			t.Fatalf("Unexpected error code. Got %d, %d expected.", status, expected)
+		}
+	}
+
+	if getUsers(t, us, "/users")[0]["email_verified"] != "true" {
+		t.Fatal("expected the user's email to be verified")
+	}
+
+	for body, expected := range map[string]int{
+		`{"token":"nonsense"}`: http.StatusUnauthorized,
+		`{}`:                   http.StatusBadRequest,
+		`not json`:             http.StatusBadRequest,
+	} {
+		status := postStatus(t, us, "/users/verify-email", body)
+		if status != expected {
+			t.Fatalf("Unexpected error code for %s. Got %d, %d expected.", body, status, expected)
+		}
+	}
+}
+
+/*
+TestEmailVerificationOnChange: Given a User has verified their email
+when they PATCH it to another email then it is unverified and a token
+is sent to the new email, while patching anything else leaves it
+verified.
+*/
+func TestEmailVerificationOnChange(t *testing.T) {
+	us, notifier := newNotifyingService(t)
+
+	id := getUsers(t, us, "/users")[0]["id"]
+
+	postStatus(t, us, "/users/verify-email", `{"token":"`+notifier.lastToken(t)+`"}`)
+
+	for _, body := range []string{`{"email":"alice@bob.com"}`, `{"nickname":"alice"}`} {
+		serveWithToken(t, us, "PATCH", "/users/"+id, "", body)
+
+		if getUsers(t, us, "/users")[0]["email_verified"] != "true" {
+			t.Fatalf("expected %s to leave the email verified", body)
+		}
+	}
+
+	sent := len(notifier.messages)
+
+	serveWithToken(t, us, "PATCH", "/users/"+id, "", `{"email":"alice@sportsbook.com"}`)
+
+	if getUsers(t, us, "/users")[0]["email_verified"] != "false" {
+		t.Fatal("expected a changed email to be unverified")
+	}
+
+	if len(notifier.messages) != sent+1 || notifier.messages[sent].To != "alice@sportsbook.com" {
+		t.Fatal("expected a verification to be sent to the new email")
+	}
+
+	status := postStatus(t, us, "/users/verify-email", `{"token":"`+notifier.lastToken(t)+`"}`)
+	if status != http.StatusNoContent {
+		t.Fatalf("Unexpected error code. Got %d, %d expected.", status, http.StatusNoContent)
+	}
+}
+
+/*
+TestUsersGetFiltersByEmailVerified: Given I have created Users with
+verified and unverified emails when I call GET /users with the filter
+email_verified then only the Users with that status are returned, for
+each Store. A filter other than true or false is 400 Bad Request.
+*/
+func TestUsersGetFiltersByEmailVerified(t *testing.T) {
+	for name, option := range map[string]Option{
+		"memory": WithStore(NewMemoryStore()),
+		"sql":    WithDatabase(filepath.Join(t.TempDir(), "users.db")),
+	} {
+		us, notifier := newNotifyingService(t, option)
+
+		postStatus(t, us, "/users/verify-email", `{"token":"`+notifier.lastToken(t)+`"}`)
+
+		postUser(t, us, map[string]string{
+			"country":    "US",
+			"email":      "ken@bob.com",
+			"first_name": "Ken",
+			"last_name":  "Thompson",
+			"nickname":   "ken",
+			"password":   alicePassword,
+		})
+
+		for filter, expected := range map[string]string{
+			"true":  "AB123",
+			"false": "ken",
+		} {
+			users := getUsers(t, us, "/users?email_verified="+filter)
+			if len(users) != 1 || users[0]["nickname"] != expected {
+				t.Fatalf("%s: expected email_verified=%s to return only %q but got %v", name, filter, expected, users)
+			}
+		}
+
+		status := serveWithToken(t, us, "GET", "/users?email_verified=yes", "", "").Result().StatusCode
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s: Unexpected error code. Got %d, %d expected.", name, status, http.StatusBadRequest)
+		}
+
+		us.Close()
+	}
+}
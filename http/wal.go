@@ -0,0 +1,295 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walDelete = "delete"
+	walPut    = "put"
+)
+
+/*
+wal is an append-only write-ahead log of the mutations made to a
+Store. Each record is a line of JSON prefixed with the hex CRC-32 of
+the JSON, and the file is fsync'd before the mutation is applied.
+
+If a record can't be written it is truncated from the file, so the
+records after it aren't stuck behind a corrupt one. If that fails too
+the wal is broken and refuses every record after.
+
+records is how many records are in the file, so a wal with none isn't
+rotated.
+*/
+type wal struct {
+	broken  error
+	file    *os.File
+	records int
+	seq     uint64
+}
+
+/*
+A single mutation in the wal. A put carries the whole user as it was
+after the mutation, so replaying a put is the same as replaying a
+create or a modify.
+*/
+type walRecord struct {
+	ID   string `json:"id"`
+	Op   string `json:"op"`
+	Seq  uint64 `json:"seq"`
+	User *user  `json:"user,omitempty"`
+}
+
+/*
+Open the wal at path, creating it if it doesn't exist, and call
+replay in order with each of its records after seq, the last record
+that has already been applied (i.e. from a snapshot or an earlier
+wal).
+
+If the final record is torn, i.e. the process died while writing it,
+it is truncated from the file as it was never acknowledged. A bad
+record followed by more records can't be explained by a crash, so that
+is an error.
+*/
+func openWAL(path string, seq uint64, replay func(record *walRecord) error) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &wal{file: file, seq: seq}
+
+	err = l.replay(replay)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *wal) replay(replay func(record *walRecord) error) error {
+	r := bufio.NewReader(l.file)
+
+	var last uint64
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return l.truncate(offset)
+			}
+
+			break
+		} else if err != nil {
+			return err
+		}
+
+		record := &walRecord{}
+
+		err = decodeLine(line, record)
+		if err != nil {
+			_, peek := r.Peek(1)
+			if peek == io.EOF {
+				return l.truncate(offset)
+			}
+
+			return fmt.Errorf("%s: corrupt record at offset %d: %w", l.file.Name(), offset, err)
+		}
+
+		if record.Seq <= last {
+			return fmt.Errorf("%s: record at offset %d is out of sequence", l.file.Name(), offset)
+		}
+
+		last = record.Seq
+		offset += int64(len(line))
+		l.records++
+
+		if record.Seq <= l.seq {
+			continue
+		}
+
+		if record.Seq != l.seq+1 {
+			return fmt.Errorf("%s: records %d to %d are missing", l.file.Name(), l.seq+1, record.Seq-1)
+		}
+
+		err = replay(record)
+		if err != nil {
+			return err
+		}
+
+		l.seq = record.Seq
+	}
+
+	_, err := l.file.Seek(0, io.SeekEnd)
+
+	return err
+}
+
+/* Drop everything in the wal from offset onwards. */
+func (l *wal) truncate(offset int64) error {
+	err := l.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Seek(offset, io.SeekStart)
+
+	return err
+}
+
+/*
+Append a record to the wal and wait for it to reach the disk. If it
+doesn't, whatever was written of it is truncated.
+*/
+func (l *wal) append(op string, id string, user *user) error {
+	if l.broken != nil {
+		return l.broken
+	}
+
+	record := walRecord{
+		ID:   id,
+		Op:   op,
+		Seq:  l.seq + 1,
+		User: user,
+	}
+
+	line, err := encodeLine(&record)
+	if err != nil {
+		return err
+	}
+
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+
+	if err != nil {
+		truncateErr := l.truncate(offset)
+		if truncateErr != nil {
+			l.broken = fmt.Errorf("%s: unable to truncate a record that wasn't written, so no more can be: %w", l.file.Name(), truncateErr)
+		}
+
+		return err
+	}
+
+	l.seq = record.Seq
+	l.records++
+
+	return nil
+}
+
+/*
+Move the records in the wal to the file segment and carry on with an
+empty wal, so the records can be deleted once they are in a snapshot.
+A wal without records isn't moved, as its records are already in a
+segment, and an existing segment is never replaced.
+*/
+func (l *wal) rotate(segment string) error {
+	if l.records == 0 {
+		return nil
+	}
+
+	name := l.file.Name()
+
+	err := os.Link(name, segment)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		os.Remove(segment)
+		return err
+	}
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		os.Rename(segment, name)
+		return err
+	}
+
+	err = syncDir(filepath.Dir(name))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.records = 0
+
+	return nil
+}
+
+func (l *wal) close() error {
+	return l.file.Close()
+}
+
+/*
+Encode v as a line of JSON prefixed with the hex CRC-32 of the JSON,
+which is how each line of the wal and the snapshots are stored.
+*/
+func encodeLine(v any) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	line := fmt.Appendf(nil, "%08x ", crc32.ChecksumIEEE(body))
+	line = append(line, body...)
+	line = append(line, '\n')
+
+	return line, nil
+}
+
+/* Check the checksum of a line made by encodeLine and decode it in to v. */
+func decodeLine(line []byte, v any) error {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	checksum, body, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return errors.New("missing checksum")
+	}
+
+	if string(checksum) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(body)) {
+		return errors.New("checksum mismatch")
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+/* fsync a directory so the files created in it survive a crash. */
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
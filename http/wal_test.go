@@ -0,0 +1,440 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+TestWALReplaysRecords: Given I have appended records to a wal when I
+open it again then each record is replayed in the order it was
+appended.
+*/
+func TestWALReplaysRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walName)
+
+	l, err := openWAL(path, 0, func(record *walRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+	for _, id := range ids {
+		err = l.append(walPut, id, &user{ID: id})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	l.close()
+
+	replayed := []string{}
+	l, err = openWAL(path, 0, func(record *walRecord) error {
+		replayed = append(replayed, record.ID)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.close()
+
+	if len(replayed) != len(ids) {
+		t.Fatalf("expected %d records to be replayed but got %d", len(ids), len(replayed))
+	}
+
+	for i, id := range ids {
+		if replayed[i] != id {
+			t.Fatalf("expected record %d to be %q but got %q", i, id, replayed[i])
+		}
+	}
+}
+
+/*
+TestWALTruncatesTornRecord: Given the final record of a wal was torn
+by a crash when I open it then the torn record is dropped, the rest
+are replayed and new records can be appended after them.
+*/
+func TestWALTruncatesTornRecord(t *testing.T) {
+	for name, torn := range map[string]string{
+		"partial line":   `1a2b3c4d {"id":"`,
+		"bad checksum":   "00000000 {}\n",
+		"missing prefix": "{}\n",
+	} {
+		path := filepath.Join(t.TempDir(), walName)
+
+		l, err := openWAL(path, 0, func(record *walRecord) error { return nil })
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		err = l.append(walDelete, "first", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		_, err = l.file.WriteString(torn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		l.close()
+
+		count := 0
+		l, err = openWAL(path, 0, func(record *walRecord) error {
+			count++
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		if count != 1 {
+			t.Fatalf("%s: expected 1 record to be replayed but got %d", name, count)
+		}
+
+		err = l.append(walDelete, "second", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		l.close()
+
+		count = 0
+		l, err = openWAL(path, 0, func(record *walRecord) error {
+			count++
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		l.close()
+
+		if count != 2 {
+			t.Fatalf("%s: expected 2 records to be replayed but got %d", name, count)
+		}
+	}
+}
+
+/*
+TestWALRejectsCorruptRecord: Given a record in the middle of a wal is
+corrupt when I open it then an error is returned.
+*/
+func TestWALRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walName)
+
+	l, err := openWAL(path, 0, func(record *walRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, id := range []string{"first", "second"} {
+		err = l.append(walDelete, id, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	l.close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	content = bytes.Replace(content, []byte("first"), []byte("fir5t"), 1)
+
+	err = os.WriteFile(path, content, 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = openWAL(path, 0, func(record *walRecord) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error opening a corrupt wal")
+	}
+}
+
+/*
+TestDataDirSurvivesRestart: Given I have created, patched and deleted
+Users with a UserService using a data directory when I create a new
+UserService with the same data directory then the GET method returns
+the Users as they were before the restart.
+*/
+func TestDataDirSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	us, err := NewUserService(WithDataDir(dir, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, nickname := range []string{"rob", "ken", "griesemer"} {
+		data := map[string]string{
+			"country":    "US",
+			"email":      nickname + "@bob.com",
+			"first_name": nickname,
+			"last_name":  nickname,
+			"nickname":   nickname,
+			"password":   "b3bb4cd67f11e1f6350a5792c8a0f91c2e7920ab93ccd7e964d97d79ad9f8270",
+		}
+
+		post_body, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		post_req, err := http.NewRequest("POST", "/users", bytes.NewReader(post_body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		us.ServeHTTP(httptest.NewRecorder(), post_req)
+	}
+
+	users, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	byNickname := map[string]*user{}
+	for _, user := range users {
+		byNickname[user.Nickname] = user
+	}
+
+	patch_req, err := http.NewRequest("PATCH", "/users/"+byNickname["rob"].ID, bytes.NewReader([]byte(`{"country":"CA"}`)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us.ServeHTTP(httptest.NewRecorder(), patch_req)
+
+	delete_req, err := http.NewRequest("DELETE", "/users/"+byNickname["ken"].ID, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us.ServeHTTP(httptest.NewRecorder(), delete_req)
+
+	before, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	us.Close()
+
+	/* restart */
+
+	us, err = NewUserService(WithDataDir(dir, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer us.Close()
+
+	after, err := us.store.List(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(after) != len(before) {
+		t.Fatalf("expected %d users after restart but got %d", len(before), len(after))
+	}
+
+	for _, expected := range before {
+		got, err := us.store.Get(expected.ID)
+		if err != nil {
+			t.Fatalf("expected user %q after restart but got %q", expected.ID, err.Error())
+		}
+
+		expected_body, _ := json.Marshal(expected)
+		got_body, _ := json.Marshal(got)
+
+		if !bytes.Equal(expected_body, got_body) {
+			t.Fatalf("expected user %s after restart but got %s", expected_body, got_body)
+		}
+	}
+}
+
+/*
+TestWALRefusesRecordsOnceBroken: Given a record can't be written to a
+wal or truncated after when I append another then it's refused, and
+the records before it can still be replayed.
+*/
+func TestWALRefusesRecordsOnceBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walName)
+
+	l, err := openWAL(path, 0, func(record *walRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = l.append(walDelete, "first", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	/* neither write nor truncate a file that's only open for reading */
+
+	l.file.Close()
+
+	l.file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, id := range []string{"second", "third"} {
+		err = l.append(walDelete, id, nil)
+		if err == nil {
+			t.Fatalf("expected %s to be refused", id)
+		}
+	}
+
+	if l.broken == nil || l.seq != 1 {
+		t.Fatalf("expected the wal to be broken at 1 but got %v at %d", l.broken, l.seq)
+	}
+
+	l.close()
+
+	replayed := 0
+	l, err = openWAL(path, 0, func(record *walRecord) error {
+		replayed++
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.close()
+
+	if replayed != 1 {
+		t.Fatalf("expected 1 record to be replayed but got %d", replayed)
+	}
+}
+
+/*
+TestWALRotateKeepsSegments: Given a segment of the wal already exists
+when the wal is rotated to it then it's refused and neither the
+segment nor the wal lose their records.
+*/
+func TestWALRotateKeepsSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := openWAL(filepath.Join(dir, walName), 0, func(record *walRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	segment := filepath.Join(dir, segmentName(1))
+
+	err = l.append(walDelete, "first", nil)
+	if err == nil {
+		err = l.rotate(segment)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = l.rotate(segment)
+	if err != nil {
+		t.Fatalf("expected rotating an empty wal to do nothing but got %s", err.Error())
+	}
+
+	err = l.append(walDelete, "second", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = l.rotate(segment)
+	if err == nil {
+		t.Fatal("expected rotating on to an existing segment to be refused")
+	}
+
+	l.close()
+
+	for path, expected := range map[string]uint64{segment: 1, filepath.Join(dir, walName): 2} {
+		l, err := openWAL(path, expected-1, func(record *walRecord) error { return nil })
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if l.seq != expected || l.records != 1 {
+			t.Fatalf("%s: expected record %d but got %d records to %d", path, expected, l.records, l.seq)
+		}
+
+		l.close()
+	}
+}
+
+/*
+TestDataDirKeepsNanoseconds: Given Users created within the same
+second when the durable store is reopened from its wal and then from
+a snapshot then their times are the same to the nanosecond. A user
+saved with times in DtLayout can still be read.
+*/
+func TestDataDirKeepsNanoseconds(t *testing.T) {
+	dir := t.TempDir()
+
+	ms := openDurable(t, dir)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+
+	times := map[string]time.Time{}
+	for i, nickname := range []string{"aaa", "bbb", "ccc"} {
+		id := uuid.NewString()
+		tm := created.Add(time.Duration(i) * 100 * time.Millisecond)
+
+		err := ms.Create(&user{ID: id, Email: nickname + "@bob.com", Nickname: nickname, CreatedAt: datetime{tm}, UpdatedAt: datetime{tm.Add(time.Nanosecond)}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		times[id] = tm
+	}
+
+	expectTimes := func(store Store) {
+		for id, tm := range times {
+			user, err := store.Get(id)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if !user.CreatedAt.tm.Equal(tm) || !user.UpdatedAt.tm.Equal(tm.Add(time.Nanosecond)) {
+				t.Fatalf("expected %s and %s but got %s and %s", tm, tm.Add(time.Nanosecond), user.CreatedAt.tm, user.UpdatedAt.tm)
+			}
+		}
+	}
+
+	ms.Close()
+
+	ms = openDurable(t, dir)
+	expectTimes(ms)
+
+	snapshotNow(t, ms)
+	ms.Close()
+
+	ms = openDurable(t, dir)
+	expectTimes(ms)
+	ms.Close()
+
+	legacy := &user{}
+
+	err := json.Unmarshal([]byte(`{"id":"1","created_at":"2024-01-02T03:04.05Z","updated_at":"2024-01-02T03:04.06Z"}`), legacy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !legacy.CreatedAt.tm.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) || legacy.ID != "1" {
+		t.Fatalf("expected a user in DtLayout to be read but got %+v", legacy)
+	}
+}
@@ -1,18 +1,175 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 	"user-service/http"
 )
 
 func main() {
-	us, err := http.NewUserService()
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importUsers(os.Args[2:]))
+	}
+
+	database := flag.String("database", "", "SQL database file users are kept in instead of the data directory")
+	data := flag.String("data", "data", "directory users are persisted in, empty to keep them in memory only")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "how often to snapshot persisted users, 0 to never")
+	adminToken := flag.String("admin-token", "", "file with the token admins send, empty to disable the admin endpoints")
+	outbox := flag.String("outbox", "", "file messages to users are appended to, empty to only log that they were sent")
+	tokenKey := flag.String("token-key", "", "file with the HS256 secret or Ed25519 PEM key access tokens are signed with, empty to disable sessions")
+	cursorKey := flag.String("cursor-key", "", "file with the secret cursors of GET /users are signed with, empty to make one each time the service starts")
+	flag.Parse()
+
+	options := storeOptions(*database, *data, *snapshotInterval)
+
+	if *adminToken != "" {
+		options = append(options, http.WithAdminToken(*adminToken))
+	}
+
+	if *outbox != "" {
+		options = append(options, http.WithNotifier(http.NewOutboxNotifier(*outbox)))
+	}
+
+	if *tokenKey != "" {
+		options = append(options, http.WithTokenKey(*tokenKey))
+	}
+
+	if *cursorKey != "" {
+		options = append(options, http.WithCursorKey(*cursorKey))
+	}
+
+	us, err := http.NewUserService(options...)
 	if err != nil {
 		log.Fatalf("Unable to create UserService %q", err.Error())
 	}
 
-	const addr = "0.0.0.0:8080"
+	os.Exit(serve(us, "0.0.0.0:8080"))
+}
+
+/*
+Serve us on addr until the service is interrupted or terminated, then
+wait for the requests in flight and close it, so everything it has
+written is flushed. The exit status is 1 if either fails.
+*/
+func serve(us *http.UserService, addr string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Printf("Coming up on %q", addr)
-	log.Fatal(us.ListenAndServe(addr))
+
+	status := 0
+
+	err := us.ListenAndServe(ctx, addr)
+	if err != nil {
+		log.Printf("Unable to serve %q", err.Error())
+		status = 1
+	}
+
+	log.Printf("Shutting down")
+
+	err = us.Close()
+	if err != nil {
+		log.Printf("Unable to close UserService %q", err.Error())
+		status = 1
+	}
+
+	return status
+}
+
+/* Get the options for where users are kept. */
+func storeOptions(database string, data string, snapshotInterval time.Duration) []http.Option {
+	if database != "" {
+		return []http.Option{http.WithDatabase(database)}
+	} else if data != "" {
+		return []http.Option{http.WithDataDir(data, snapshotInterval)}
+	}
+
+	return []http.Option{}
+}
+
+/*
+Run `user-service import [flags] [FILE]`, which creates users from FILE,
+or stdin if there isn't one, as POST /users/import does, and prints the
+report. The exit status is 1 if any user wasn't created.
+*/
+func importUsers(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] [FILE]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+
+	database := flags.String("database", "", "SQL database file users are kept in instead of the data directory")
+	data := flags.String("data", "data", "directory users are persisted in, the service must not be running")
+	snapshotInterval := flags.Duration("snapshot-interval", 5*time.Minute, "how often to snapshot persisted users, 0 to never")
+	outbox := flags.String("outbox", "", "file messages to users are appended to, empty to only log that they were sent")
+	format := flags.String("format", "", "ndjson or csv, by default csv if FILE ends in .csv and otherwise ndjson")
+	dryRun := flags.Bool("dry-run", false, "report which users would fail without creating any")
+	notify := flags.Bool("notify", false, "send each user created an email verification")
+	flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Printf("Unable to open %q", err.Error())
+			return 1
+		}
+		defer file.Close()
+
+		input = file
+
+		if *format == "" && filepath.Ext(file.Name()) == ".csv" {
+			*format = "csv"
+		}
+	}
+
+	if *format == "" {
+		*format = "ndjson"
+	}
+
+	options := storeOptions(*database, *data, *snapshotInterval)
+
+	if *outbox != "" {
+		options = append(options, http.WithNotifier(http.NewOutboxNotifier(*outbox)))
+	}
+
+	us, err := http.NewUserService(options...)
+	if err != nil {
+		log.Printf("Unable to create UserService %q", err.Error())
+		return 1
+	}
+	defer us.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := us.Import(ctx, input, *format, http.ImportOptions{DryRun: *dryRun, Notify: *notify})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if err != nil {
+		log.Printf("Unable to import users after %d were created %q", report.Created, err.Error())
+		return 1
+	} else if report.Failed > 0 {
+		return 1
+	}
+
+	return 0
 }